@@ -14,20 +14,29 @@
 package httpapi
 
 import (
+	"context"
 	"crypto"
 	"encoding/json"
 	"fmt"
 	"github.com/wgnet/wunderdns/wunderdns"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
 var endpoints = map[string]func(http.ResponseWriter, *http.Request){
-	"/ping":    apiPingFunc,
-	"/domain":  apiDomainFunc,
-	"/record":  apiRecordFunc,
-	"/migrate": apiMigrateFunc,
+	"/ping":           apiPingFunc,
+	"/health":         apiHealthFunc,
+	"/domain":         apiDomainFunc,
+	"/record":         apiRecordFunc,
+	"/migrate":        apiMigrateFunc,
+	"/replicas":       apiReplicasFunc,
+	"/request":        apiRequestFunc,
+	"/token":          apiTokenFunc,
+	"/token/secret":   apiTokenSecretFunc,
+	"/token/children": apiTokenChildrenFunc,
+	"/admin/tokens":   apiAdminTokensFunc,
 }
 
 func writeJson(w http.ResponseWriter, r *http.Request, data interface{}) {
@@ -62,7 +71,51 @@ func apiPingFunc(w http.ResponseWriter, r *http.Request) {
 	writeJson(w, r, wunderdns.ReturnSuccess("PONG"))
 }
 
+// apiHealthFunc reports producer connection and, if the worker runs in this process, its consumers
+func apiHealthFunc(w http.ResponseWriter, r *http.Request) {
+	connected := producer.isConnected()
+	code := 200
+	if !connected || !wunderdns.Healthy() {
+		code = 503
+	}
+	writeJsonE(w, r, code, wunderdns.ReturnSuccess(map[string]interface{}{
+		"producer":  connected,
+		"consumers": wunderdns.ConsumerStates(),
+	}))
+}
+
 func checkAuthHeaders(w http.ResponseWriter, r *http.Request) (token, secret string, ok bool) {
+	if token, secret, ok, e := checkClientCertificate(r); e != nil {
+		writeJsonE(w, r, 403, wunderdns.ReturnError("certificate: ", e.Error()))
+		return "", "", false
+	} else if ok {
+		return token, secret, true
+	} else if clientCertRequired {
+		writeJsonE(w, r, 403, wunderdns.ReturnError("client certificate is required"))
+		return "", "", false
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		token, secret, assertion, e := checkBearer(r)
+		if e != nil {
+			writeJsonE(w, r, 403, wunderdns.ReturnError("bearer: ", e.Error()))
+			return "", "", false
+		}
+		// the assertion goes along with the request to be signed by signAndPush
+		*r = *r.WithContext(context.WithValue(r.Context(), assertionKey{}, assertion))
+		return token, secret, true
+	}
+	if r.Header.Get("Authorization") != "" {
+		var e error
+		if token, secret, e = checkSignature(w, r); e != nil {
+			writeJsonE(w, r, 403, wunderdns.ReturnError("authorization: ", e.Error()))
+			return "", "", false
+		}
+		return token, secret, true
+	}
+	if !signing.secretHeader {
+		writeJsonE(w, r, 403, wunderdns.ReturnError("Authorization header is missing"))
+		return "", "", false
+	}
 	token = r.Header.Get("X-API-Token")
 	secret = r.Header.Get("X-API-Secret")
 	ok = token != secret && token != ""
@@ -72,7 +125,16 @@ func checkAuthHeaders(w http.ResponseWriter, r *http.Request) (token, secret str
 	return
 }
 
+// signature version of requests - v2 unless workers are too old to check it
+var signatureVersion = wunderdns.SignatureV2
+
 func signRequest(request *wunderdns.WunderRequest, token, secret string) {
+	if signatureVersion == wunderdns.SignatureV2 {
+		if e := wunderdns.SignRequest(request, token, secret); e != nil {
+			log.Print("Error signing request: ", e.Error())
+		}
+		return
+	}
 	request.Auth = new(wunderdns.AuthHeader)
 	request.Auth.Token = token
 	t := time.Now().Unix()
@@ -127,18 +189,22 @@ func mergeReply(reply ...*wunderdns.WunderReply) *wunderdns.WunderReply {
 	return ret
 }
 
-func signAndPush(request *wunderdns.WunderRequest, token, secret string) *wunderdns.WunderReply {
+func signAndPush(ctx context.Context, request *wunderdns.WunderRequest, token, secret string) *wunderdns.WunderReply {
+	if request.Asserted = assertionFrom(ctx); request.Asserted != nil && signatureVersion != wunderdns.SignatureV2 {
+		return wunderdns.ReturnError("asserted identities need v2 signatures")
+	}
+	request.Origin = originFrom(ctx)
 	if request.Domain != nil {
 		if request.Domain.View == wunderdns.DomainViewAny {
 			request.Domain.View = wunderdns.DomainViewPrivate
 			signRequest(request, token, secret)
-			re1 := producer.pushMessage(request)
+			re1 := producer.pushMessage(ctx, request)
 			request.Domain.View = wunderdns.DomainViewPublic
 			signRequest(request, token, secret)
-			re2 := producer.pushMessage(request)
+			re2 := producer.pushMessage(ctx, request)
 			return mergeReply(re1, re2)
 		}
 	}
 	signRequest(request, token, secret)
-	return producer.pushMessage(request)
+	return producer.pushMessage(ctx, request)
 }
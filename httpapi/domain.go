@@ -14,6 +14,7 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -37,16 +38,16 @@ func apiDomainFunc(w http.ResponseWriter, r *http.Request) {
 				writeJsonE(w, r, 503, "Internal Server Error")
 				return
 			}
-			writeJson(w, r, apiCreateDomain(req, token, secret))
+			writeJson(w, r, apiCreateDomain(r.Context(), req, token, secret))
 		case http.MethodGet:
-			writeJson(w, r, apiListDomains(getDomainView(r), token, secret, pretty))
+			writeJson(w, r, apiListDomains(r.Context(), getDomainView(r), token, secret, pretty))
 		default:
 			writeJsonE(w, r, 422, "Method not supported")
 		}
 	}
 }
 
-func apiCreateDomain(params map[string]interface{}, token, secret string) *wunderdns.WunderReply {
+func apiCreateDomain(ctx context.Context, params map[string]interface{}, token, secret string) *wunderdns.WunderReply {
 	defer func() {
 		if e := recover(); e != nil {
 			log.Printf("apiCreateDomain(%v) error: %v", params, e)
@@ -59,10 +60,10 @@ func apiCreateDomain(params map[string]interface{}, token, secret string) *wunde
 		},
 		Cmd: wunderdns.CommandCreateDomain,
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
 
-func apiListDomains(domainView wunderdns.DomainView, token, secret string, pretty bool) *wunderdns.WunderReply {
+func apiListDomains(ctx context.Context, domainView wunderdns.DomainView, token, secret string, pretty bool) *wunderdns.WunderReply {
 	req := &wunderdns.WunderRequest{
 		Domain: &wunderdns.Domain{
 			Name: "*",
@@ -71,5 +72,5 @@ func apiListDomains(domainView wunderdns.DomainView, token, secret string, prett
 		Cmd:    wunderdns.CommandListDomains,
 		Pretty: pretty,
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
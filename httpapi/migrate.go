@@ -14,6 +14,7 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/wgnet/wunderdns/wunderdns"
@@ -55,7 +56,7 @@ func apiMigrateFunc(w http.ResponseWriter, r *http.Request) {
 			}
 			switch req["domain_view"] {
 			case "public", "private", "*":
-				writeJson(w, r, apiReplaceOwner(token, secret,
+				writeJson(w, r, apiReplaceOwner(r.Context(), token, secret,
 					req["domain"].(string),
 					req["domain_view"].(string),
 					req["new_token"].(string),
@@ -71,7 +72,7 @@ func apiMigrateFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func apiReplaceOwner(token, secret string, domain string, domainView string, newToken string, records []map[string]interface{}) *wunderdns.WunderReply {
+func apiReplaceOwner(ctx context.Context, token, secret string, domain string, domainView string, newToken string, records []map[string]interface{}) *wunderdns.WunderReply {
 	recs := make([]*wunderdns.Record, 0)
 	for _, req := range records {
 		req["data"] = ""
@@ -90,5 +91,5 @@ func apiReplaceOwner(token, secret string, domain string, domainView string, new
 		Record:   recs,
 		Pretty:   false,
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
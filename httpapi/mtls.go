@@ -0,0 +1,66 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"net/http"
+)
+
+// every request must come with a client certificate mapped to a token
+var clientCertRequired = false
+
+// certificateNames are what `certificate` of a token is matched against:
+// subject DN, its common name and every SAN ( dns, email, uri, ip )
+func certificateNames(cert *x509.Certificate) []string {
+	ret := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		ret = append(ret, cert.Subject.CommonName)
+	}
+	ret = append(ret, cert.DNSNames...)
+	ret = append(ret, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ret = append(ret, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+// checkClientCertificate maps a verified client certificate to a token & its secret;
+// ok is false if there is no verified certificate at all
+func checkClientCertificate(r *http.Request) (token, secret string, ok bool, e error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false, nil
+	}
+	names := certificateNames(r.TLS.VerifiedChains[0][0])
+	found := false
+	for _, n := range names {
+		if token, found = signing.certificates[n]; found {
+			break
+		}
+	}
+	if !found {
+		if token, found = wunderdns.LookupCertificate(names); !found {
+			return "", "", true, errors.New("certificate " + names[0] + " is not mapped to a token")
+		}
+	}
+	if secret, found = lookupSecret(token); !found {
+		return "", "", true, errors.New("token of certificate " + names[0] + " has no secret")
+	}
+	return token, secret, true, nil
+}
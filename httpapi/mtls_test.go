@@ -0,0 +1,146 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueCertificate makes a client certificate signed by the ca ( self-signed ca if it's nil )
+func issueCertificate(t *testing.T, serial int64, cn string, dnsNames []string, ca *tls.Certificate) tls.Certificate {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"wunderdns"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if e != nil {
+		t.Fatal(e)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCheckClientCertificate(t *testing.T) {
+	ca := issueCertificate(t, 1, "wunderdns ca", nil, nil)
+	byCN := issueCertificate(t, 2, "robot", nil, &ca)
+	bySAN := issueCertificate(t, 3, "ci runner", []string{"ci.example.com"}, &ca)
+	unmapped := issueCertificate(t, 4, "stranger", []string{"stranger.example.com"}, &ca)
+	orphan := issueCertificate(t, 5, "orphan", nil, &ca)
+	foreign := issueCertificate(t, 6, "robot", nil, nil) // not issued by the ca
+
+	signing.certificates["robot"] = "robot"
+	signing.certificates["ci.example.com"] = "ci"
+	signing.certificates["orphan"] = "orphan" // the token has no secret
+	signing.secrets["robot"] = []wunderdns.TokenSecret{{Value: "robot-secret"}}
+	signing.secrets["ci"] = []wunderdns.TokenSecret{{Value: "ci-secret"}}
+	defer func() {
+		for _, n := range []string{"robot", "ci.example.com", "orphan"} {
+			delete(signing.certificates, n)
+		}
+		delete(signing.secrets, "robot")
+		delete(signing.secrets, "ci")
+	}()
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, secret, ok := checkAuthHeaders(w, r); ok {
+			writeJson(w, r, wunderdns.ReturnSuccess(token+"/"+secret))
+		}
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	s.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	s.StartTLS()
+	defer s.Close()
+
+	get := func(cert *tls.Certificate, headers bool) (int, string) {
+		transport := s.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			// sent even if it's not issued by the ca the server asks for
+			transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		cli := &http.Client{Transport: transport}
+		defer transport.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodGet, s.URL+"/domain", nil)
+		if headers {
+			req.Header.Set("X-API-Token", "header")
+			req.Header.Set("X-API-Secret", "header-secret")
+		}
+		resp, e := cli.Do(req)
+		if e != nil {
+			return 0, e.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	cases := []struct {
+		name     string
+		cert     *tls.Certificate
+		headers  bool
+		required bool
+		code     int
+		expected string
+	}{
+		{"mapped cn", &byCN, false, false, 200, `"robot/robot-secret"`},
+		{"mapped san", &bySAN, false, false, 200, `"ci/ci-secret"`},
+		// a certificate takes over the headers
+		{"mapped cn & headers", &byCN, true, false, 200, `"robot/robot-secret"`},
+		// an unmapped certificate isn't passed over to the headers
+		{"unmapped", &unmapped, true, false, 403, "certificate CN=stranger,O=wunderdns is not mapped to a token"},
+		{"mapped to no secret", &orphan, false, false, 403, "token of certificate CN=orphan,O=wunderdns has no secret"},
+		{"no certificate", nil, true, false, 200, `"header/header-secret"`},
+		{"no certificate required", nil, true, true, 403, "client certificate is required"},
+		// the handshake fails, the handler is never called
+		{"foreign certificate", &foreign, false, false, 0, "tls"},
+	}
+	defer func() { clientCertRequired = false }()
+	for _, c := range cases {
+		clientCertRequired = c.required
+		code, body := get(c.cert, c.headers)
+		if code != c.code || !strings.Contains(body, c.expected) {
+			t.Errorf("%s: %d %s", c.name, code, body)
+		}
+	}
+}
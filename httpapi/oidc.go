@@ -0,0 +1,350 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"gopkg.in/go-ini/ini.v1"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `Authorization: Bearer <JWT>` of an OIDC provider: the token is verified against the provider's JWKS,
+// its claims are mapped to permissions by rules and the request is signed by the delegate token
+// with the identity & permissions asserted; the worker permits what both the delegate & the rules allow
+
+type oidcRule struct {
+	claim       string
+	value       string
+	permissions []wunderdns.Permission
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var oidc = struct {
+	enabled  bool
+	jwks     string // file or url
+	issuer   string
+	audience string
+	delegate string
+	leeway   time.Duration
+	rules    []oidcRule
+	keys     map[string]crypto.PublicKey
+	loaded   time.Time
+	lock     sync.RWMutex
+}{
+	leeway: time.Minute,
+	keys:   make(map[string]crypto.PublicKey),
+}
+
+type assertionKey struct{}
+
+// keys of unknown ids are looked up in the request path, a slow provider can't hold requests longer
+var jwksReloadTimeout = 3 * time.Second
+
+func loadOIDCConfig(f *ini.File) error {
+	s, e := f.GetSection("oidc")
+	if e != nil {
+		return nil
+	}
+	for _, k := range []string{"jwks", "delegate", "issuer", "audience"} {
+		if !s.HasKey(k) {
+			return errors.New("oidc." + k + " is not set")
+		}
+	}
+	oidc.jwks = s.Key("jwks").String()
+	oidc.delegate = s.Key("delegate").String()
+	oidc.issuer = s.Key("issuer").String()
+	oidc.audience = s.Key("audience").String()
+	refresh := s.Key("refresh").MustDuration(time.Hour)
+	rules := make([]oidcRule, 0)
+	for _, sub := range s.ChildSections() {
+		if !strings.HasPrefix(sub.Name(), "oidc.rule.") {
+			continue
+		}
+		if !sub.HasKey("claim") || !sub.HasKey("value") {
+			return errors.New(sub.Name() + ": claim & value are required")
+		}
+		rule := oidcRule{
+			claim:       sub.Key("claim").String(),
+			value:       sub.Key("value").String(),
+			permissions: make([]wunderdns.Permission, 0),
+		}
+		for _, k := range sub.Keys() {
+			if k.Name() == "claim" || k.Name() == "value" {
+				continue
+			}
+			p, e := wunderdns.ParsePermission(k.Name(), k.String())
+			if e != nil {
+				return errors.New(sub.Name() + ": " + e.Error())
+			}
+			rule.permissions = append(rule.permissions, p)
+		}
+		rules = append(rules, rule)
+	}
+	oidc.rules = rules // a load replaces rules of the previous one
+	if e := loadJWKS(10 * time.Second); e != nil {
+		return errors.New("oidc.jwks: " + e.Error())
+	}
+	oidc.enabled = true
+	go func() {
+		for {
+			time.Sleep(refresh)
+			if e := loadJWKS(10 * time.Second); e != nil {
+				log.Printf("[oidc] jwks refresh error: %s", e.Error())
+			}
+		}
+	}()
+	log.Printf("[oidc] %d rules, delegate %s", len(oidc.rules), oidc.delegate)
+	return nil
+}
+
+func loadJWKS(timeout time.Duration) error {
+	var data []byte
+	var e error
+	if strings.HasPrefix(oidc.jwks, "http://") || strings.HasPrefix(oidc.jwks, "https://") {
+		cli := &http.Client{Timeout: timeout}
+		resp, e := cli.Get(oidc.jwks)
+		if e != nil {
+			return e
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return errors.New("unexpected status " + resp.Status)
+		}
+		if data, e = ioutil.ReadAll(resp.Body); e != nil {
+			return e
+		}
+	} else if data, e = ioutil.ReadFile(oidc.jwks); e != nil {
+		return e
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if e = json.Unmarshal(data, &set); e != nil {
+		return e
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, e := parseJWK(&k)
+		if e != nil {
+			log.Printf("[oidc] skipping key %s: %s", k.Kid, e.Error())
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	oidc.lock.Lock()
+	oidc.keys = keys
+	oidc.loaded = time.Now()
+	oidc.lock.Unlock()
+	return nil
+}
+
+func parseJWK(k *jwk) (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, e1 := b64.DecodeString(k.N)
+		e, e2 := b64.DecodeString(k.E)
+		if e1 != nil || e2 != nil {
+			return nil, errors.New("bad rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, e1 := b64.DecodeString(k.X)
+		y, e2 := b64.DecodeString(k.Y)
+		if e1 != nil || e2 != nil {
+			return nil, errors.New("bad ec key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return key, nil
+	case "OKP":
+		x, e := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || e != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad okp key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+func jwtKey(kid string) (crypto.PublicKey, bool) {
+	oidc.lock.RLock()
+	key, ok := oidc.keys[kid]
+	oidc.lock.RUnlock()
+	if ok {
+		return key, true
+	}
+	// keys may be rotated: one request a minute reloads them, the rest don't wait for it
+	oidc.lock.Lock()
+	reload := time.Since(oidc.loaded) > time.Minute
+	if reload {
+		oidc.loaded = time.Now()
+	}
+	oidc.lock.Unlock()
+	if reload {
+		if e := loadJWKS(jwksReloadTimeout); e != nil {
+			log.Printf("[oidc] jwks reload error: %s", e.Error())
+		}
+		oidc.lock.RLock()
+		key, ok = oidc.keys[kid]
+		oidc.lock.RUnlock()
+	}
+	return key, ok
+}
+
+// verifyJWT checks signature ( RS256, ES256, EdDSA ), issuer, audience & validity time
+func verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	h, e := b64.DecodeString(parts[0])
+	if e != nil || json.Unmarshal(h, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, e := b64.DecodeString(parts[2])
+	if e != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	key, ok := jwtKey(header.Kid)
+	if !ok {
+		return nil, errors.New("unknown key " + header.Kid)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		valid = header.Alg == "EdDSA" && ed25519.Verify(k, signed, sig)
+	}
+	if !valid {
+		return nil, errors.New("invalid token signature")
+	}
+	p, e := b64.DecodeString(parts[1])
+	if e != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	claims := make(map[string]interface{})
+	if e := json.Unmarshal(p, &claims); e != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(oidc.leeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidc.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	// tokens of the provider issued for other clients are signed with the same keys
+	if oidc.issuer == "" || claims["iss"] != oidc.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if oidc.audience == "" || !claimContains(claims["aud"], oidc.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	if sub, ok := claims["sub"].(string); !ok || sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// claimContains matches string & array claims
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkBearer verifies the JWT and returns delegate's credentials with the assertion to sign
+func checkBearer(r *http.Request) (token, secret string, assertion *wunderdns.Assertion, e error) {
+	if !oidc.enabled {
+		return "", "", nil, errors.New("bearer tokens are not accepted")
+	}
+	claims, e := verifyJWT(strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+	if e != nil {
+		return "", "", nil, e
+	}
+	assertion = &wunderdns.Assertion{
+		Subject:     claims["sub"].(string),
+		Permissions: make([]wunderdns.Permission, 0),
+	}
+	for _, rule := range oidc.rules {
+		if claimContains(claims[rule.claim], rule.value) {
+			assertion.Permissions = append(assertion.Permissions, rule.permissions...)
+		}
+	}
+	if len(assertion.Permissions) == 0 {
+		return "", "", nil, errors.New(assertion.Subject + " has no permissions")
+	}
+	secret, ok := lookupSecret(oidc.delegate)
+	if !ok {
+		return "", "", nil, errors.New("secret of delegate token is not known")
+	}
+	return oidc.delegate, secret, assertion, nil
+}
+
+func assertionFrom(ctx context.Context) *wunderdns.Assertion {
+	if a, ok := ctx.Value(assertionKey{}).(*wunderdns.Assertion); ok {
+		return a
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"gopkg.in/go-ini/ini.v1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// jwksServer serves keys of the test identity provider
+type jwksServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	keys    []jwk
+	fetches int
+	delay   time.Duration
+}
+
+func newJWKSServer(keys ...jwk) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.fetches++
+		set := map[string]interface{}{"keys": s.keys}
+		delay := s.delay
+		s.lock.Unlock()
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(set)
+	}))
+	return s
+}
+
+func (s *jwksServer) fetched() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fetches
+}
+
+// useOIDC points oidc at the server and loads its keys
+func useOIDC(t *testing.T, s *jwksServer) func() {
+	jwks, issuer, audience, delegate, rules, enabled := oidc.jwks, oidc.issuer, oidc.audience, oidc.delegate,
+		oidc.rules, oidc.enabled
+	oidc.jwks, oidc.issuer, oidc.audience, oidc.delegate = s.URL, "https://sso.example.com", "wunderdns", "delegate"
+	oidc.rules, oidc.enabled = nil, true
+	if e := loadJWKS(time.Second); e != nil {
+		t.Fatal(e)
+	}
+	return func() {
+		oidc.jwks, oidc.issuer, oidc.audience, oidc.delegate = jwks, issuer, audience, delegate
+		oidc.rules, oidc.enabled = rules, enabled
+		oidc.lock.Lock()
+		oidc.keys, oidc.loaded = make(map[string]crypto.PublicKey), time.Time{}
+		oidc.lock.Unlock()
+	}
+}
+
+func pad32(i *big.Int) []byte {
+	b := i.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func publicJWK(kid string, key crypto.Signer) jwk {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: b64.EncodeToString(k.N.Bytes()),
+			E: b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64.EncodeToString(pad32(k.X)), Y: b64.EncodeToString(pad32(k.Y))}
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: b64.EncodeToString(k)}
+	}
+	return jwk{}
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	p, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(p)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var e error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, e = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, e = ecdsa.Sign(rand.Reader, k, digest[:]); e == nil {
+			sig = append(pad32(r), pad32(s)...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if e != nil {
+		t.Fatal(e)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// unsigned drops the signature of the token
+func unsigned(token string) string {
+	return token[:strings.LastIndex(token, ".")+1]
+}
+
+func testClaims(change map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": "https://sso.example.com",
+		"aud": []string{"other", "wunderdns"},
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range change {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	s := newJWKSServer(publicJWK("rsa", rsaKey), publicJWK("ec", ecKey), publicJWK("ed", edKey))
+	defer s.Close()
+	defer useOIDC(t, s)()
+	past := time.Now().Add(-time.Hour).Unix()
+	cases := []struct {
+		name   string
+		token  string
+		errors string
+	}{
+		{"rs256", signJWT(t, "RS256", "rsa", rsaKey, testClaims(nil)), ""},
+		{"es256", signJWT(t, "ES256", "ec", ecKey, testClaims(nil)), ""},
+		{"eddsa", signJWT(t, "EdDSA", "ed", edKey, testClaims(nil)), ""},
+		{"string audience", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"aud": "wunderdns"})), ""},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"aud": "other"})),
+			"unexpected audience"},
+		{"no audience", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"aud": nil})),
+			"unexpected audience"},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"iss": "https://evil.com"})),
+			"unexpected issuer"},
+		{"no issuer", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"iss": nil})),
+			"unexpected issuer"},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"exp": past})),
+			"token is expired"},
+		{"no expiry", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"exp": nil})),
+			"token is expired"},
+		{"not valid yet", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{
+			"nbf": time.Now().Add(time.Hour).Unix()})), "token is not valid yet"},
+		{"no subject", signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"sub": nil})),
+			"token has no subject"},
+		// the algorithm must match the key
+		{"wrong alg", signJWT(t, "ES256", "rsa", rsaKey, testClaims(nil)), "invalid token signature"},
+		{"alg none", unsigned(signJWT(t, "none", "rsa", rsaKey, testClaims(nil))), "invalid token signature"},
+		{"foreign key", signJWT(t, "EdDSA", "ed", ed25519.NewKeyFromSeed(make([]byte, 32)), testClaims(nil)),
+			"invalid token signature"},
+		{"unknown kid", signJWT(t, "RS256", "other", rsaKey, testClaims(nil)), "unknown key other"},
+		{"malformed", "a.b", "malformed token"},
+	}
+	for _, c := range cases {
+		claims, e := verifyJWT(c.token)
+		if c.errors == "" {
+			if e != nil || claims["sub"] != "alice" {
+				t.Errorf("%s: %v", c.name, e)
+			}
+		} else if e == nil || e.Error() != c.errors {
+			t.Errorf("%s: expected %q, got %v", c.name, c.errors, e)
+		}
+	}
+	// issuer & audience are never skipped
+	oidc.issuer = ""
+	token := signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"iss": ""}))
+	if _, e := verifyJWT(token); e == nil || e.Error() != "unexpected issuer" {
+		t.Errorf("token is accepted without issuer: %v", e)
+	}
+	oidc.issuer, oidc.audience = "https://sso.example.com", ""
+	token = signJWT(t, "RS256", "rsa", rsaKey, testClaims(map[string]interface{}{"aud": ""}))
+	if _, e := verifyJWT(token); e == nil || e.Error() != "unexpected audience" {
+		t.Errorf("token is accepted without audience: %v", e)
+	}
+}
+
+func TestLoadOIDCConfig(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s := newJWKSServer(publicJWK("ec", key))
+	defer s.Close()
+	defer useOIDC(t, s)()
+	load := func(oidcSection, rules string) error {
+		f, e := ini.Load([]byte(oidcSection + rules))
+		if e != nil {
+			t.Fatal(e)
+		}
+		return loadOIDCConfig(f)
+	}
+	full := "[oidc]\njwks=" + s.URL + "\nissuer=https://sso.example.com\naudience=wunderdns\ndelegate=delegate\n"
+	for _, k := range []string{"jwks", "issuer", "audience", "delegate"} {
+		var section []string
+		for _, l := range strings.Split(full, "\n") {
+			if !strings.HasPrefix(l, k+"=") {
+				section = append(section, l)
+			}
+		}
+		if e := load(strings.Join(section, "\n"), ""); e == nil || e.Error() != "oidc."+k+" is not set" {
+			t.Errorf("without %s: %v", k, e)
+		}
+	}
+	rule := func(name, value string) string {
+		return "[oidc.rule." + name + "]\nclaim=groups\nvalue=" + value + "\n*,*=list_domains\n"
+	}
+	if e := load(full, rule("a", "a")+rule("b", "b")); e != nil || len(oidc.rules) != 2 {
+		t.Fatalf("%v, %d rules", e, len(oidc.rules))
+	}
+	// rules of the previous load are gone
+	if e := load(full, rule("c", "c")); e != nil || len(oidc.rules) != 1 || oidc.rules[0].value != "c" {
+		t.Errorf("rules aren't replaced: %v, %+v", e, oidc.rules)
+	}
+}
+
+func TestJWTKeyReload(t *testing.T) {
+	old, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s := newJWKSServer(publicJWK("old", old))
+	defer s.Close()
+	defer useOIDC(t, s)()
+	s.lock.Lock()
+	s.keys = append(s.keys, publicJWK("rotated", rotated))
+	s.lock.Unlock()
+	token := signJWT(t, "ES256", "rotated", rotated, testClaims(nil))
+
+	// keys are loaded just now, an unknown kid doesn't reload them
+	if _, e := verifyJWT(token); e == nil || s.fetched() != 1 {
+		t.Fatalf("keys are reloaded too often: %v, %d fetches", e, s.fetched())
+	}
+	oidc.lock.Lock()
+	oidc.loaded = time.Now().Add(-2 * time.Minute)
+	oidc.lock.Unlock()
+	if _, e := verifyJWT(token); e != nil || s.fetched() != 2 {
+		t.Fatalf("rotated key: %v, %d fetches", e, s.fetched())
+	}
+	if _, e := verifyJWT(signJWT(t, "ES256", "old", old, testClaims(nil))); e != nil || s.fetched() != 2 {
+		t.Errorf("old key: %v, %d fetches", e, s.fetched())
+	}
+
+	// a slow provider doesn't hold requests longer than the timeout, and only one of them waits
+	defer func(timeout time.Duration) { jwksReloadTimeout = timeout }(jwksReloadTimeout)
+	jwksReloadTimeout = 50 * time.Millisecond
+	s.lock.Lock()
+	s.delay = 500 * time.Millisecond
+	s.lock.Unlock()
+	oidc.lock.Lock()
+	oidc.loaded = time.Now().Add(-2 * time.Minute)
+	oidc.lock.Unlock()
+	unknown := signJWT(t, "ES256", "unknown", rotated, testClaims(nil))
+	start := time.Now()
+	if _, e := verifyJWT(unknown); e == nil {
+		t.Error("unknown key is accepted")
+	}
+	if _, e := verifyJWT(unknown); e == nil {
+		t.Error("unknown key is accepted")
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("slow jwks reload takes %s", d)
+	}
+	if s.fetched() != 3 {
+		t.Errorf("%d fetches", s.fetched())
+	}
+	if _, e := verifyJWT(token); e != nil {
+		t.Errorf("known keys are lost on a failed reload: %v", e)
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	bad := []jwk{
+		{Kty: "oct", Kid: "hmac"},
+		{Kty: "EC", Crv: "P-384", X: "AA", Y: "AA"},
+		{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(pad32(ecKey.X)), Y: b64.EncodeToString(pad32(ecKey.X))},
+		{Kty: "OKP", Crv: "Ed25519", X: "AAAA"},
+		{Kty: "RSA", N: "!", E: "AQAB"},
+	}
+	for i, k := range bad {
+		if _, e := parseJWK(&k); e == nil {
+			t.Errorf("bad key %d is accepted", i)
+		}
+	}
+	k := publicJWK("ec", ecKey)
+	if key, e := parseJWK(&k); e != nil || key.(*ecdsa.PublicKey).X.Cmp(ecKey.X) != 0 ||
+		key.(*ecdsa.PublicKey).Y.Cmp(ecKey.Y) != 0 {
+		t.Errorf("ec key is parsed wrong: %v", e)
+	}
+}
+
+func TestCheckBearer(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s := newJWKSServer(publicJWK("ed", key))
+	defer s.Close()
+	defer useOIDC(t, s)()
+	admins, _ := wunderdns.ParsePermission("*,*", "*")
+	oidc.rules = []oidcRule{{claim: "groups", value: "dns-admins", permissions: []wunderdns.Permission{admins}}}
+	signing.secrets["delegate"] = []wunderdns.TokenSecret{{Value: "secret"}}
+	defer delete(signing.secrets, "delegate")
+
+	bearer := func(claims map[string]interface{}) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/domain", nil)
+		r.Header.Set("Authorization", "Bearer "+signJWT(t, "EdDSA", "ed", key, testClaims(claims)))
+		return r
+	}
+	token, secret, assertion, e := checkBearer(bearer(map[string]interface{}{"groups": []string{"dns-admins"}}))
+	if e != nil || token != "delegate" || secret != "secret" || assertion.Subject != "alice" ||
+		len(assertion.Permissions) != 1 {
+		t.Errorf("bearer is not accepted: %v %v", assertion, e)
+	}
+	if _, _, _, e := checkBearer(bearer(map[string]interface{}{"groups": "users"})); e == nil {
+		t.Error("bearer without permissions is accepted")
+	}
+	if _, _, _, e := checkBearer(bearer(map[string]interface{}{"groups": "dns-admins", "aud": "other"})); e == nil {
+		t.Error("bearer of another audience is accepted")
+	}
+	oidc.enabled = false
+	if _, _, _, e := checkBearer(bearer(map[string]interface{}{"groups": "dns-admins"})); e == nil {
+		t.Error("bearer is accepted with oidc disabled")
+	}
+}
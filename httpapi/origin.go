@@ -0,0 +1,77 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// client address goes along with requests, workers check it against allow_from of tokens.
+// X-Forwarded-For is honoured for connections from trusted proxies only: the address is the rightmost
+// one not belonging to them
+
+var trustedProxies []*net.IPNet
+
+type originKey struct{}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientAddress(r *http.Request) string {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	hops := make([]string, 0)
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break // garbage - stop at the last known one
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func withOrigin(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f(w, r.WithContext(context.WithValue(r.Context(), originKey{}, clientAddress(r))))
+	}
+}
+
+func originFrom(ctx context.Context) string {
+	if o, ok := ctx.Value(originKey{}).(string); ok {
+		return o
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"github.com/wgnet/wunderdns/wunderdns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	proxies, e := wunderdns.ParseNetworks("10.0.0.0/8, 2001:db8::1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func(old []*net.IPNet) { trustedProxies = old }(trustedProxies)
+	trustedProxies = proxies
+	cases := []struct {
+		name     string
+		remote   string
+		xff      []string
+		expected string
+	}{
+		{"direct", "192.0.2.1:4000", nil, "192.0.2.1"},
+		{"direct ipv6", "[2001:db8::2]:4000", nil, "2001:db8::2"},
+		{"no port", "192.0.2.1", nil, "192.0.2.1"},
+		// only trusted proxies may forward addresses
+		{"spoofed by client", "192.0.2.1:4000", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"spoofed by untrusted proxy", "203.0.113.5:4000", []string{"10.1.1.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted ipv6 proxy", "[2001:db8::1]:4000", []string{"2001:db8:1::5"}, "2001:db8:1::5"},
+		{"proxy without xff", "10.0.0.1:4000", nil, "10.0.0.1"},
+		// multi-hop: the rightmost address not of a trusted proxy, what's left of it is the client's word
+		{"chain", "10.0.0.1:4000", []string{"198.51.100.7, 10.2.2.2, 10.3.3.3"}, "198.51.100.7"},
+		{"chain with spoofed head", "10.0.0.1:4000", []string{"192.0.2.66, 198.51.100.7, 10.2.2.2"}, "198.51.100.7"},
+		{"chain over headers", "10.0.0.1:4000", []string{"192.0.2.66, 198.51.100.7", "10.2.2.2"}, "198.51.100.7"},
+		{"chain of proxies only", "10.0.0.1:4000", []string{"10.4.4.4,10.5.5.5"}, "10.4.4.4"},
+		{"garbage hop", "10.0.0.1:4000", []string{"198.51.100.7, unknown, 10.2.2.2"}, "10.2.2.2"},
+		{"garbage last hop", "10.0.0.1:4000", []string{"198.51.100.7, _hidden"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		r.RemoteAddr = c.remote
+		for _, h := range c.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if a := clientAddress(r); a != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, a)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"gopkg.in/go-ini/ini.v1"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const transportPGQueue = "pgqueue"
+
+var pgIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// pgTransport puts requests into the queue table of wunderdns workers
+// and waits for NOTIFY <channel>_reply, id to pick the reply up
+type pgTransport struct {
+	table       string
+	channel     string
+	timeout     time.Duration
+	db          *sql.DB
+	listener    *pq.Listener
+	connected   bool
+	lock        sync.Mutex
+	pending     map[int64]chan bool
+	pendingLock sync.Mutex
+}
+
+func newPGTransport(f *ini.File) *pgTransport {
+	s, e := f.GetSection("pgqueue")
+	if e != nil {
+		log.Fatal("Section [pgqueue] not found")
+		return nil
+	}
+	ret := &pgTransport{
+		table:   "wunderdns_queue",
+		channel: "wunderdns",
+		timeout: time.Minute,
+		pending: make(map[int64]chan bool),
+	}
+	if !s.HasKey("url") {
+		log.Fatal("url not found in section [pgqueue]")
+		return nil
+	}
+	url := s.Key("url").String()
+	if s.HasKey("table") {
+		ret.table = s.Key("table").String()
+	}
+	if !pgIdentifier.MatchString(ret.table) {
+		log.Fatal("pgqueue.table is not a valid table name")
+		return nil
+	}
+	if s.HasKey("channel") {
+		ret.channel = s.Key("channel").String()
+	}
+	if t, e := f.GetSection("timeout"); e == nil && t.HasKey("default") {
+		if d, e := t.Key("default").Duration(); e == nil && d > 0 {
+			ret.timeout = d
+		}
+	}
+	if ret.db, e = sql.Open("postgres", url); e != nil {
+		log.Fatal("pgqueue open error: ", e.Error())
+		return nil
+	}
+	ret.listener = pq.NewListener(url, time.Second, time.Minute, func(ev pq.ListenerEventType, e error) {
+		ret.lock.Lock()
+		ret.connected = ev == pq.ListenerEventConnected || ev == pq.ListenerEventReconnected
+		ret.lock.Unlock()
+		if e != nil {
+			log.Printf("[producer] pgqueue listener: %s", e.Error())
+		}
+	})
+	if e = ret.listener.Listen(ret.channel + "_reply"); e != nil {
+		log.Printf("[producer] pgqueue listen error: %s", e.Error())
+	}
+	go ret.dispatchReplies()
+	log.Printf("[producer] using pgqueue transport, table %s", ret.table)
+	return ret
+}
+
+func (t *pgTransport) dispatchReplies() {
+	for n := range t.listener.Notify {
+		if n == nil {
+			// reconnected - replies could be missed, let everybody check
+			t.pendingLock.Lock()
+			for _, c := range t.pending {
+				select {
+				case c <- true:
+				default:
+				}
+			}
+			t.pendingLock.Unlock()
+			continue
+		}
+		id, e := strconv.ParseInt(n.Extra, 10, 64)
+		if e != nil {
+			continue
+		}
+		t.pendingLock.Lock()
+		if c, ok := t.pending[id]; ok {
+			select {
+			case c <- true:
+			default:
+			}
+		}
+		t.pendingLock.Unlock()
+	}
+}
+
+func (t *pgTransport) pushMessage(ctx context.Context, request *wunderdns.WunderRequest) *wunderdns.WunderReply {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	data, e := json.Marshal(request)
+	if e != nil {
+		return wunderdns.ReturnError("json marshal error: " + e.Error())
+	}
+	var id int64
+	// workers schedule rows by priority, as they do amqp messages
+	e = t.db.QueryRowContext(ctx, fmt.Sprintf(`INSERT INTO %s (request, expires, priority)
+		VALUES ($1, now() + $2::interval, $3) RETURNING id`, t.table), string(data),
+		fmt.Sprintf("%d milliseconds", int64(t.timeout/time.Millisecond)), messagePriority(request)).Scan(&id)
+	if e != nil {
+		return wunderdns.ReturnError("pgqueue insert error: " + e.Error())
+	}
+	ready := make(chan bool, 1)
+	t.pendingLock.Lock()
+	t.pending[id] = ready
+	t.pendingLock.Unlock()
+	defer func() {
+		t.pendingLock.Lock()
+		delete(t.pending, id)
+		t.pendingLock.Unlock()
+		// answered requests only: a worker may still be processing it, workers purge the rest once expired
+		_, _ = t.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND state = 'done'", t.table), id)
+	}()
+	if _, e = t.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", t.channel, strconv.FormatInt(id, 10)); e != nil {
+		log.Printf("[producer] pgqueue notify error: %s", e.Error()) // workers poll anyway
+	}
+	poll := time.NewTicker(5 * time.Second)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ready:
+		case <-poll.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return wunderdns.ReturnError("request timeout")
+			}
+			return wunderdns.ReturnError("request cancelled")
+		}
+		var reply sql.NullString
+		e = t.db.QueryRowContext(ctx, fmt.Sprintf("SELECT reply FROM %s WHERE id = $1", t.table), id).Scan(&reply)
+		if e != nil && e != sql.ErrNoRows {
+			log.Printf("[producer] pgqueue select error: %s", e.Error())
+			continue
+		}
+		if !reply.Valid {
+			continue
+		}
+		ret := new(wunderdns.WunderReply)
+		if e := json.Unmarshal([]byte(reply.String), ret); e != nil {
+			return wunderdns.ReturnError("json unmarshal error: " + e.Error())
+		}
+		return ret
+	}
+}
+
+func (t *pgTransport) isConnected() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.connected
+}
@@ -14,23 +14,38 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/streadway/amqp"
 	"gopkg.in/go-ini/ini.v1"
 	"log"
 	"math/rand"
 	"github.com/wgnet/wunderdns/wunderdns"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type producerConfig struct {
-	URL      string
-	Exchange string
+	URL            string
+	Exchange       string
+	Queue          string // shared worker queue to check for consumers, if any
+	DefaultTimeout time.Duration
+	Timeouts       map[wunderdns.Command]time.Duration
+	session        *amqpSession
+	checkLock      sync.Mutex
+	lastCheck      time.Time
 }
 
 func newProducer(configFile string) *producerConfig {
-	ret := new(producerConfig)
+	ret := &producerConfig{
+		DefaultTimeout: time.Minute,
+		Timeouts:       make(map[wunderdns.Command]time.Duration),
+	}
+	channels := 8
+	maxDelay := 30 * time.Second
 	if f, e := ini.Load(configFile); e != nil {
 		log.Fatal("Can't load configuration file", e.Error())
 	} else {
@@ -50,87 +65,130 @@ func newProducer(configFile string) *producerConfig {
 				log.Fatal("exchange not found in section [producer]")
 				return nil
 			}
+			if s.HasKey("queue") {
+				ret.Queue = s.Key("queue").String()
+			}
+			if k, e := s.GetKey("channels"); e == nil {
+				if i, e := k.Int(); e == nil && i > 0 {
+					channels = i
+				}
+			}
+			if k, e := s.GetKey("reconnect_max_delay"); e == nil {
+				if d, e := k.Duration(); e == nil && d > 0 {
+					maxDelay = d
+				}
+			}
+		}
+		if s, e := f.GetSection("timeout"); e == nil {
+			for _, k := range s.Keys() {
+				d, e := k.Duration()
+				if e != nil || d <= 0 {
+					log.Printf("timeout.%s is not a valid duration, ignoring", k.Name())
+					continue
+				}
+				if k.Name() == "default" {
+					ret.DefaultTimeout = d
+				} else {
+					ret.Timeouts[wunderdns.Command(k.Name())] = d
+				}
+			}
 		}
 	}
+	ret.session = newAMQPSession(ret.URL, channels, maxDelay)
 	return ret
 }
 
-func (conf *producerConfig) pushMessage(request *wunderdns.WunderRequest) *wunderdns.WunderReply {
-	url := conf.URL
-	if !strings.HasPrefix(url, "amqp://") {
-		url = "amqp://" + url
+func (conf *producerConfig) isConnected() bool {
+	return conf.session.isConnected()
+}
+
+func (conf *producerConfig) timeout(cmd wunderdns.Command) time.Duration {
+	if d, ok := conf.Timeouts[cmd]; ok {
+		return d
 	}
-	conn, e := amqp.Dial(url)
-	if e != nil {
-		return wunderdns.ReturnError("amqp connection error: " + e.Error())
+	return conf.DefaultTimeout
+}
+
+// checkConsumers fails fast if the shared worker queue has nobody consuming it
+// ( messages are routed to a durable queue even with no workers alive )
+func (conf *producerConfig) checkConsumers(ch *pooledChannel) (broken bool, e error) {
+	if conf.Queue == "" {
+		return false, nil
 	}
-	defer conn.Close()
-	ch, e := conn.Channel()
-	if e != nil {
-		return wunderdns.ReturnError("amqp channel error: " + e.Error())
+	conf.checkLock.Lock()
+	defer conf.checkLock.Unlock()
+	if time.Since(conf.lastCheck) < 5*time.Second {
+		return false, nil
 	}
-	defer ch.Close()
-	q, e := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		true,  // delete when unused
-		true,  // exclusive
-		false, // noWait
-		nil,   // arguments
-	)
+	q, e := ch.QueueInspect(conf.Queue)
 	if e != nil {
-		return wunderdns.ReturnError("amqp queue error: " + e.Error())
+		return true, errors.New("amqp queue inspect error: " + e.Error()) // channel is closed on 404
 	}
-	defer ch.QueueDelete(q.Name, false, false, false)
-	msgs, e := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if e != nil {
-		return wunderdns.ReturnError("amqp consume error: " + e.Error())
+	if q.Consumers == 0 {
+		return false, fmt.Errorf("%w on queue %s", errNoWorker, conf.Queue)
 	}
+	conf.lastCheck = time.Now()
+	return false, nil
+}
+
+// pushMessage sends request to workers and waits for the reply until the command timeout
+// or until ctx is done ( e.g. http client has gone )
+func (conf *producerConfig) pushMessage(ctx context.Context, request *wunderdns.WunderRequest) *wunderdns.WunderReply {
+	timeout := conf.timeout(request.Cmd)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	data, e := json.Marshal(request)
 	if e != nil {
 		return wunderdns.ReturnError("json marshal error: " + e.Error())
 	}
+	ch, replyQueue, generation, e := conf.session.acquire(ctx)
+	if e != nil {
+		return wunderdns.ReturnError(e.Error())
+	}
+	if broken, e := conf.checkConsumers(ch); e != nil {
+		conf.session.release(ch, generation, broken)
+		return wunderdns.ReturnError(e.Error())
+	}
 	corrId := randomString(64)
-	e = ch.Publish(
-		conf.Exchange,
-		"",
-		false,
-		false,
-		amqp.Publishing{
-			ContentType:   "application/json",
-			ReplyTo:       q.Name,
-			CorrelationId: corrId,
-			Body:          data,
-		},
-	)
+	reply := conf.session.expect(corrId)
+	defer conf.session.forget(corrId)
+	e = ch.publish(ctx, conf.Exchange, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent, // survive broker restart in shared durable queues
+		ReplyTo:       replyQueue,
+		CorrelationId: corrId,
+		Priority:      messagePriority(request),
+		// nobody waits for the reply after timeout, so don't execute it either
+		Expiration: strconv.FormatInt(int64(timeout/time.Millisecond), 10),
+		Body:       data,
+	})
+	conf.session.release(ch, generation, e != nil && !errors.Is(e, errNoWorker))
 	if e != nil {
 		return wunderdns.ReturnError("amqp publish error: " + e.Error())
 	}
-	timeout := time.After(15 * time.Minute) // 15 minutes to get reply
-	for {
-		select {
-		case m := <-msgs:
-			if m.CorrelationId == corrId {
-				ret := new(wunderdns.WunderReply)
-				if e := json.Unmarshal(m.Body, ret); e != nil {
-					return wunderdns.ReturnError("json unmarshal error: " + e.Error())
-				} else {
-					return ret
-				}
-			}
-			break
-		case <-timeout:
+	select {
+	case ret := <-reply:
+		return ret
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
 			return wunderdns.ReturnError("request timeout")
 		}
+		return wunderdns.ReturnError("request cancelled")
+	}
+}
+
+// messagePriority is the priority of the token in auth.ini, for priority queues of workers
+func messagePriority(request *wunderdns.WunderRequest) uint8 {
+	if request.Auth == nil {
+		return 0
+	}
+	p := lookupPriority(request.Auth.Token)
+	if p < 0 {
+		return 0
+	} else if p > 255 {
+		return 255
 	}
+	return uint8(p)
 }
 
 func randInt(min int, max int) int {
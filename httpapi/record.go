@@ -14,6 +14,7 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/asaskevich/govalidator"
@@ -34,19 +35,19 @@ func apiRecordFunc(w http.ResponseWriter, r *http.Request) {
 		case http.MethodGet:
 			if _, ok := r.URL.Query()["search"]; ok {
 				if record := r.FormValue("record"); record != "" {
-					writeJson(w, r, apiSearchRecords(token, secret, r.FormValue("record"), pretty))
+					writeJson(w, r, apiSearchRecords(r.Context(), token, secret, r.FormValue("record"), pretty))
 				} else {
 					writeJsonE(w, r, 422, "record parameter is missing")
 				}
 				return
 			}
 			if _, ok := r.URL.Query()["own"]; ok {
-				writeJson(w, r, apiListOwnRecords(token, secret, pretty))
+				writeJson(w, r, apiListOwnRecords(r.Context(), token, secret, pretty))
 				return
 			}
 			if domain := r.FormValue("domain"); govalidator.IsDNSName(domain) {
 				record := r.FormValue("record")
-				writeJson(w, r, apiListRecords(domain, getDomainView(r), record, token, secret, pretty))
+				writeJson(w, r, apiListRecords(r.Context(), domain, getDomainView(r), record, token, secret, pretty))
 			} else {
 				writeJsonE(w, r, 422, "Domain parameter is missing")
 			}
@@ -59,11 +60,11 @@ func apiRecordFunc(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if r.Method == http.MethodPost {
-				writeJson(w, r, apiCreateRecord(req, token, secret))
+				writeJson(w, r, apiCreateRecord(r.Context(), req, token, secret))
 			} else if r.Method == http.MethodDelete {
-				writeJson(w, r, apiDeleteRecord(req, token, secret))
+				writeJson(w, r, apiDeleteRecord(r.Context(), req, token, secret))
 			} else {
-				writeJson(w, r, apiReplaceRecord(req, token, secret))
+				writeJson(w, r, apiReplaceRecord(r.Context(), req, token, secret))
 			}
 		default:
 			writeJsonE(w, r, 422, "Method not supported")
@@ -71,7 +72,7 @@ func apiRecordFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func apiCreateRecord(req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
+func apiCreateRecord(ctx context.Context, req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
 	defer func() {
 		if e := recover(); e != nil {
 			log.Printf("apiCreateRecord(%v) error: %v", req, e)
@@ -114,8 +115,7 @@ func apiCreateRecord(req map[string]interface{}, token, secret string) (r *wunde
 		wreq.Domain.Name = req["domain"].(string)
 		wreq.Domain.View = wunderdns.DomainView(r["view"].(string))
 		wreq.Record = record2record(r)
-		signRequest(wreq, token, secret)
-		reply := producer.pushMessage(wreq)
+		reply := signAndPush(ctx, wreq, token, secret)
 		ret["replies"] = append(ret["replies"].([]interface{}), reply.Data)
 		if reply.Status == "ERROR" {
 			errors++
@@ -135,7 +135,7 @@ func apiCreateRecord(req map[string]interface{}, token, secret string) (r *wunde
 	}
 }
 
-func apiReplaceRecord(req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
+func apiReplaceRecord(ctx context.Context, req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
 	defer func() {
 		if e := recover(); e != nil {
 			log.Printf("apiReplaceRecord(%v) error: %v", req, e)
@@ -180,8 +180,7 @@ func apiReplaceRecord(req map[string]interface{}, token, secret string) (r *wund
 		wreq.Domain.Name = req["domain"].(string)
 		wreq.Domain.View = wunderdns.DomainView(r["view"].(string))
 		wreq.Record = record2record(r)
-		signRequest(wreq, token, secret)
-		reply := producer.pushMessage(wreq)
+		reply := signAndPush(ctx, wreq, token, secret)
 		ret["replies"] = append(ret["replies"].([]interface{}), reply.Data)
 		if reply.Status == "ERROR" {
 			errors++
@@ -201,7 +200,7 @@ func apiReplaceRecord(req map[string]interface{}, token, secret string) (r *wund
 	}
 }
 
-func apiDeleteRecord(req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
+func apiDeleteRecord(ctx context.Context, req map[string]interface{}, token, secret string) (r *wunderdns.WunderReply) {
 	defer func() {
 		if e := recover(); e != nil {
 			log.Printf("apiDeleteRecord(%v) error: %v", req, e)
@@ -246,8 +245,7 @@ func apiDeleteRecord(req map[string]interface{}, token, secret string) (r *wunde
 		wreq.Domain.Name = req["domain"].(string)
 		wreq.Domain.View = wunderdns.DomainView(r["view"].(string))
 		wreq.Record = record2record(r)
-		signRequest(wreq, token, secret)
-		reply := producer.pushMessage(wreq)
+		reply := signAndPush(ctx, wreq, token, secret)
 		ret["replies"] = append(ret["replies"].([]interface{}), reply.Data)
 		if reply.Status == "ERROR" {
 			errors++
@@ -276,7 +274,7 @@ func checkRecord(rec map[string]interface{}) bool {
 	return true
 }
 
-func apiListRecords(domain string, domainView wunderdns.DomainView, recordName string, token, secret string, pretty bool) *wunderdns.WunderReply {
+func apiListRecords(ctx context.Context, domain string, domainView wunderdns.DomainView, recordName string, token, secret string, pretty bool) *wunderdns.WunderReply {
 	req := &wunderdns.WunderRequest{
 		Cmd: wunderdns.CommandListRecords,
 		Domain: &wunderdns.Domain{
@@ -290,10 +288,10 @@ func apiListRecords(domain string, domainView wunderdns.DomainView, recordName s
 			Name: recordName,
 		}}
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
 
-func apiListOwnRecords(token, secret string, pretty bool) *wunderdns.WunderReply {
+func apiListOwnRecords(ctx context.Context, token, secret string, pretty bool) *wunderdns.WunderReply {
 	req := &wunderdns.WunderRequest{
 		Cmd: wunderdns.CommandListOwn,
 		Domain: &wunderdns.Domain{
@@ -302,9 +300,9 @@ func apiListOwnRecords(token, secret string, pretty bool) *wunderdns.WunderReply
 		},
 		Pretty: pretty,
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
-func apiSearchRecords(token, secret string, record string, pretty bool) *wunderdns.WunderReply {
+func apiSearchRecords(ctx context.Context, token, secret string, record string, pretty bool) *wunderdns.WunderReply {
 	req := &wunderdns.WunderRequest{
 		Cmd: wunderdns.CommandSearchRecord,
 		Domain: &wunderdns.Domain{
@@ -318,5 +316,5 @@ func apiSearchRecords(token, secret string, record string, pretty bool) *wunderd
 		},
 		Pretty: pretty,
 	}
-	return signAndPush(req, token, secret)
+	return signAndPush(ctx, req, token, secret)
 }
@@ -0,0 +1,175 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTransport keeps what is pushed to workers, reply stands in for the worker
+type recordingTransport struct {
+	lock     sync.Mutex
+	requests []*wunderdns.WunderRequest
+	reply    func(request *wunderdns.WunderRequest) *wunderdns.WunderReply
+}
+
+func (t *recordingTransport) pushMessage(ctx context.Context, request *wunderdns.WunderRequest) *wunderdns.WunderReply {
+	// signAndPush reuses the request for the other view, keep a copy of what was sent
+	data, e := json.Marshal(request)
+	if e != nil {
+		return wunderdns.ReturnError(e)
+	}
+	sent := new(wunderdns.WunderRequest)
+	if e = json.Unmarshal(data, sent); e != nil {
+		return wunderdns.ReturnError(e)
+	}
+	t.lock.Lock()
+	t.requests = append(t.requests, sent)
+	t.lock.Unlock()
+	if t.reply != nil {
+		return t.reply(sent)
+	}
+	return wunderdns.ReturnSuccess("OK")
+}
+
+func (t *recordingTransport) isConnected() bool {
+	return true
+}
+
+func useTransport(t transport) func() {
+	old := producer
+	producer = t
+	return func() { producer = old }
+}
+
+// signedWith tells if the v2 signature of the request is made with the secret
+func signedWith(request *wunderdns.WunderRequest, secret string) bool {
+	if request.Auth == nil || request.Auth.Version != wunderdns.SignatureV2 {
+		return false
+	}
+	data, e := wunderdns.CanonicalRequest(request)
+	if e != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(data)
+	return hmac.Equal([]byte(hex.EncodeToString(m.Sum(nil))), []byte(request.Auth.Sum))
+}
+
+func TestRecordWritesAsserted(t *testing.T) {
+	rt := new(recordingTransport)
+	defer useTransport(rt)()
+	assertion := &wunderdns.Assertion{
+		Subject: "alice",
+		Permissions: []wunderdns.Permission{
+			{Domain: wunderdns.Domain{Name: "*", View: wunderdns.DomainViewPublic},
+				Permitted: []wunderdns.Command{wunderdns.CommandCreateRecord}},
+		},
+	}
+	ctx := context.WithValue(context.Background(), assertionKey{}, assertion)
+	ctx = context.WithValue(ctx, originKey{}, "10.1.2.3")
+	req := map[string]interface{}{
+		"domain": "example.com",
+		"record": map[string]interface{}{
+			"target": "www", "type": "A", "view": "public", "data": "10.0.0.1",
+		},
+	}
+	writes := map[wunderdns.Command]func(context.Context, map[string]interface{}, string, string) *wunderdns.WunderReply{
+		wunderdns.CommandCreateRecord:  apiCreateRecord,
+		wunderdns.CommandReplaceRecord: apiReplaceRecord,
+		wunderdns.CommandDeleteRecord:  apiDeleteRecord,
+	}
+	for cmd, write := range writes {
+		rt.requests = nil
+		if reply := write(ctx, req, "delegate", "secret"); reply.Status != "SUCCESS" {
+			t.Fatalf("%s: %v", cmd, reply.Data)
+		}
+		if len(rt.requests) != 1 {
+			t.Fatalf("%s: %d requests pushed", cmd, len(rt.requests))
+		}
+		sent := rt.requests[0]
+		if sent.Cmd != cmd || sent.Asserted == nil || sent.Asserted.Subject != "alice" || sent.Origin != "10.1.2.3" {
+			t.Errorf("%s: assertion or origin is lost: %+v", cmd, sent)
+		}
+		if !signedWith(sent, "secret") {
+			t.Errorf("%s: bad signature", cmd)
+		}
+		// the worker limits the request to the assertion only if the signature covers it
+		sent.Asserted = nil
+		if signedWith(sent, "secret") {
+			t.Errorf("%s: signature doesn't cover the assertion", cmd)
+		}
+	}
+
+	// legacy signatures can't carry assertions, nothing is sent
+	signatureVersion = 1
+	defer func() { signatureVersion = wunderdns.SignatureV2 }()
+	rt.requests = nil
+	if reply := apiCreateRecord(ctx, req, "delegate", "secret"); reply.Status != "ERROR" || len(rt.requests) != 0 {
+		t.Errorf("asserted record is sent with a legacy signature: %v", reply.Data)
+	}
+}
+
+func TestRecordWritesAllowFrom(t *testing.T) {
+	allowed, _ := wunderdns.ParseNetworks("192.0.2.0/24")
+	rt := &recordingTransport{
+		// the worker side of allow_from: the origin is checked if the signature covers it
+		reply: func(request *wunderdns.WunderRequest) *wunderdns.WunderReply {
+			if !signedWith(request, "secret") {
+				return wunderdns.ReturnError("invalid token/secret")
+			}
+			for _, n := range allowed {
+				if ip := net.ParseIP(request.Origin); ip != nil && n.Contains(ip) {
+					return wunderdns.ReturnSuccess("OK")
+				}
+			}
+			return wunderdns.ReturnError("not allowed from ", request.Origin)
+		},
+	}
+	defer useTransport(rt)()
+	handler := withOrigin(apiRecordFunc)
+	body := `{"domain":"example.com","record":{"target":"www","type":"A","view":"public","data":"10.0.0.1"}}`
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		for remote, expected := range map[string]string{"192.0.2.10:5000": "SUCCESS", "198.51.100.10:5000": "ERROR"} {
+			rt.requests = nil
+			r := httptest.NewRequest(method, "/record", strings.NewReader(body))
+			r.RemoteAddr = remote
+			r.Header.Set("X-API-Token", "net")
+			r.Header.Set("X-API-Secret", "secret")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			reply := new(wunderdns.WunderReply)
+			if e := json.NewDecoder(w.Body).Decode(reply); e != nil {
+				t.Fatal(e)
+			}
+			if reply.Status != expected {
+				t.Errorf("%s from %s: %s %v", method, remote, reply.Status, reply.Data)
+			}
+			if len(rt.requests) != 1 || rt.requests[0].Origin+":5000" != remote {
+				t.Errorf("%s from %s: origin is not sent", method, remote)
+			}
+		}
+	}
+}
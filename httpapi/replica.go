@@ -0,0 +1,93 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"log"
+	"net/http"
+)
+
+// GET /replicas?view=public&domain=example.com&source=public1 - report drift between databases of a view
+// POST /replicas {"view": "public", "target": "public2", "source": "public1", "domain": "example.com"} - repair
+func apiReplicasFunc(w http.ResponseWriter, r *http.Request) {
+	if token, secret, ok := checkAuthHeaders(w, r); !ok {
+		return
+	} else {
+		switch r.Method {
+		case http.MethodGet:
+			domain := r.FormValue("domain")
+			if domain == "" {
+				domain = wunderdns.DomainNameAny
+			}
+			writeJson(w, r, apiCheckReplicas(r.Context(), token, secret, getDomainView(r), domain,
+				r.FormValue("source")))
+		case http.MethodPost, http.MethodPut:
+			dec := json.NewDecoder(r.Body)
+			req := make(map[string]string)
+			if e := dec.Decode(&req); e != nil {
+				log.Print("Error decoding json: ", e.Error())
+				writeJsonE(w, r, 422, "json decoding error")
+				return
+			}
+			switch wunderdns.DomainView(req["view"]) {
+			case wunderdns.DomainViewPublic, wunderdns.DomainViewPrivate:
+			default:
+				writeJsonE(w, r, 422, "view is not in (public,private)")
+				return
+			}
+			if req["target"] == "" {
+				writeJsonE(w, r, 422, "target is not set")
+				return
+			}
+			if req["domain"] == "" {
+				req["domain"] = wunderdns.DomainNameAny
+			}
+			writeJson(w, r, apiRepairReplica(r.Context(), token, secret, req))
+		default:
+			writeJsonE(w, r, 501, "not implemented")
+		}
+	}
+}
+
+func apiCheckReplicas(ctx context.Context, token, secret string, view wunderdns.DomainView, domain, source string) *wunderdns.WunderReply {
+	req := &wunderdns.WunderRequest{
+		Cmd: wunderdns.CommandCheckReplicas,
+		Domain: &wunderdns.Domain{
+			Name: domain,
+			View: view,
+		},
+	}
+	if source != "" {
+		req.Replica = &wunderdns.ReplicaSpec{Source: source}
+	}
+	return signAndPush(ctx, req, token, secret)
+}
+
+func apiRepairReplica(ctx context.Context, token, secret string, params map[string]string) *wunderdns.WunderReply {
+	req := &wunderdns.WunderRequest{
+		Cmd: wunderdns.CommandRepairReplica,
+		Domain: &wunderdns.Domain{
+			Name: params["domain"],
+			View: wunderdns.DomainView(params["view"]),
+		},
+		Replica: &wunderdns.ReplicaSpec{
+			Source: params["source"],
+			Target: params["target"],
+		},
+	}
+	return signAndPush(ctx, req, token, secret)
+}
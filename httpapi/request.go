@@ -0,0 +1,57 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"log"
+	"net"
+	"net/http"
+)
+
+// POST /request - a raw request signed by the client ( ed25519 or v2 ), passed to workers as is;
+// the gateway never sees a credential, the worker checks the signature
+func apiRequestFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonE(w, r, 501, "not implemented")
+		return
+	}
+	req := new(wunderdns.WunderRequest)
+	if e := json.NewDecoder(r.Body).Decode(req); e != nil {
+		log.Print("Error decoding json: ", e.Error())
+		writeJsonE(w, r, 422, "json decoding error")
+		return
+	}
+	if req.Auth == nil || req.Auth.Token == "" || req.Auth.Sum == "" {
+		writeJsonE(w, r, 403, "request is not signed")
+		return
+	}
+	switch req.Auth.Version {
+	case wunderdns.SignatureV2, wunderdns.SignatureEd25519:
+	default:
+		writeJsonE(w, r, 403, "unsupported signature version")
+		return
+	}
+	if req.Domain == nil {
+		writeJsonE(w, r, 422, "domain is not set")
+		return
+	}
+	// the address is signed by the client, it can't be set here
+	if req.Origin != "" && !net.ParseIP(req.Origin).Equal(net.ParseIP(originFrom(r.Context()))) {
+		writeJsonE(w, r, 403, "origin doesn't match the client address")
+		return
+	}
+	writeJson(w, r, producer.pushMessage(r.Context(), req))
+}
@@ -14,16 +14,20 @@
 package httpapi
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/asaskevich/govalidator"
+	"github.com/wgnet/wunderdns/wunderdns"
 	"gopkg.in/go-ini/ini.v1"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 )
 
-var producer *producerConfig
+var producer transport
 
 func StartAPI(configFile string) error {
 	conf := struct {
@@ -32,10 +36,18 @@ func StartAPI(configFile string) error {
 		ssl               bool
 		sslCertificate    string
 		sslCertificateKey string
+		clientCA          string
+		clientAuth        tls.ClientAuthType
 	}{}
 	if f, e := ini.Load(configFile); e != nil {
 		return errors.New("can't load configuration file: " + e.Error())
 	} else {
+		if e := loadSigningConfig(f); e != nil {
+			return e
+		}
+		if e := loadOIDCConfig(f); e != nil {
+			return e
+		}
 		if s, e := f.GetSection("http"); e != nil {
 			log.Print("[http] section not found, using default config")
 			conf.port = 8080
@@ -62,6 +74,12 @@ func StartAPI(configFile string) error {
 				log.Print("http.bind is not defined, using 0.0.0.0")
 			}
 
+			if s.HasKey("trusted_proxies") {
+				if trustedProxies, e = wunderdns.ParseNetworks(s.Key("trusted_proxies").String()); e != nil {
+					return errors.New("http.trusted_proxies: " + e.Error())
+				}
+			}
+
 			if s.HasKey("ssl") {
 				if conf.ssl, e = s.Key("ssl").Bool(); e != nil {
 					return errors.New("http.ssl is not boolean")
@@ -88,6 +106,17 @@ func StartAPI(configFile string) error {
 				} else {
 					return errors.New("SSL certificate key path is not set while ssl = true")
 				}
+				if s.HasKey("client_ca") {
+					conf.clientCA = s.Key("client_ca").String()
+					switch s.Key("client_auth").MustString("require") {
+					case "require":
+						conf.clientAuth = tls.RequireAndVerifyClientCert
+					case "optional":
+						conf.clientAuth = tls.VerifyClientCertIfGiven
+					default:
+						return errors.New("http.client_auth is not in (require,optional)")
+					}
+				}
 			}
 
 		}
@@ -95,16 +124,32 @@ func StartAPI(configFile string) error {
 	// we're here - nice
 	listen := fmt.Sprintf("%s:%d", conf.bind, conf.port)
 	var e error
-	producer = newProducer(configFile)
+	producer = newTransport(configFile)
 	if producer == nil {
 		return errors.New("producer config not found")
 	}
 	// produce functions
 	for x, f := range endpoints {
-		http.HandleFunc(x, f)
+		http.HandleFunc(x, withOrigin(f))
 	}
 	if conf.ssl {
-		e = http.ListenAndServeTLS(listen, conf.sslCertificate, conf.sslCertificateKey, nil)
+		server := &http.Server{Addr: listen}
+		if conf.clientCA != "" {
+			pem, e := ioutil.ReadFile(conf.clientCA)
+			if e != nil {
+				return errors.New("can't read http.client_ca: " + e.Error())
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.New("no certificates found in http.client_ca")
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: conf.clientAuth,
+			}
+			clientCertRequired = conf.clientAuth == tls.RequireAndVerifyClientCert
+		}
+		e = server.ListenAndServeTLS(conf.sslCertificate, conf.sslCertificateKey)
 	} else {
 		e = http.ListenAndServe(listen, nil)
 	}
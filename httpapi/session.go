@@ -0,0 +1,303 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pooledChannel is a publishing channel in confirm mode with its notifications
+type pooledChannel struct {
+	*amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// amqpSession keeps one long-lived connection to the broker with a pool of
+// publishing channels and a single reply queue shared by all requests
+type amqpSession struct {
+	url         string
+	channels    int
+	maxDelay    time.Duration
+	lock        sync.Mutex
+	conn        *amqp.Connection
+	pool        chan *pooledChannel
+	replyQueue  string
+	generation  int
+	connected   chan bool // closed while the session is usable
+	lost        chan bool // closed once the current connection is gone
+	pending     map[string]chan *wunderdns.WunderReply
+	pendingLock sync.Mutex
+}
+
+var errSessionLost = errors.New("amqp connection lost")
+var errNoWorker = errors.New("no worker is listening")
+
+func newAMQPSession(url string, channels int, maxDelay time.Duration) *amqpSession {
+	if !strings.HasPrefix(url, "amqp://") && !strings.HasPrefix(url, "amqps://") {
+		url = "amqp://" + url
+	}
+	s := &amqpSession{
+		url:       url,
+		channels:  channels,
+		maxDelay:  maxDelay,
+		connected: make(chan bool),
+		pending:   make(map[string]chan *wunderdns.WunderReply),
+	}
+	go s.run()
+	return s
+}
+
+// run (re)connects to the broker forever, with exponential backoff between attempts
+func (s *amqpSession) run() {
+	delay := 500 * time.Millisecond
+	for {
+		closed, e := s.connect()
+		if e != nil {
+			jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+			log.Printf("[producer] amqp connect error: %s; next attempt in %s", e.Error(), delay+jitter)
+			time.Sleep(delay + jitter)
+			if delay *= 2; delay > s.maxDelay {
+				delay = s.maxDelay
+			}
+			continue
+		}
+		delay = 500 * time.Millisecond
+		log.Printf("[producer] amqp connected, reply queue %s", s.replyQueue)
+		if e := <-closed; e != nil {
+			log.Printf("[producer] amqp connection closed: %s", e.Error())
+		}
+		s.disconnect()
+	}
+}
+
+func (s *amqpSession) connect() (chan *amqp.Error, error) {
+	conn, e := amqp.Dial(s.url)
+	if e != nil {
+		return nil, e
+	}
+	ch, e := conn.Channel()
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	q, e := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	msgs, e := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	pool := make(chan *pooledChannel, s.channels)
+	for i := 0; i < s.channels; i++ {
+		pch, e := newPooledChannel(conn)
+		if e != nil {
+			conn.Close()
+			return nil, e
+		}
+		pool <- pch
+	}
+	go s.dispatchReplies(msgs)
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	s.lock.Lock()
+	s.conn = conn
+	s.pool = pool
+	s.replyQueue = q.Name
+	s.generation++
+	s.lost = make(chan bool)
+	close(s.connected)
+	s.lock.Unlock()
+	return closed, nil
+}
+
+func newPooledChannel(conn *amqp.Connection) (*pooledChannel, error) {
+	ch, e := conn.Channel()
+	if e != nil {
+		return nil, e
+	}
+	if e = ch.Confirm(false); e != nil {
+		_ = ch.Close()
+		return nil, e
+	}
+	// one publish per checkout - a single slot is enough for both
+	return &pooledChannel{
+		Channel:  ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+func (s *amqpSession) disconnect() {
+	s.lock.Lock()
+	s.connected = make(chan bool)
+	close(s.lost)
+	s.conn = nil
+	s.pool = nil
+	s.lock.Unlock()
+	// replies to the old reply queue are lost for good
+	s.pendingLock.Lock()
+	for corrId, c := range s.pending {
+		c <- wunderdns.ReturnError(errSessionLost.Error())
+		delete(s.pending, corrId)
+	}
+	s.pendingLock.Unlock()
+}
+
+func (s *amqpSession) dispatchReplies(msgs <-chan amqp.Delivery) {
+	for m := range msgs {
+		s.pendingLock.Lock()
+		c, ok := s.pending[m.CorrelationId]
+		delete(s.pending, m.CorrelationId)
+		s.pendingLock.Unlock()
+		if !ok {
+			log.Printf("[producer] reply for unknown request %s", m.CorrelationId)
+			continue
+		}
+		ret := new(wunderdns.WunderReply)
+		if e := json.Unmarshal(m.Body, ret); e != nil {
+			ret = wunderdns.ReturnError("json unmarshal error: " + e.Error())
+		}
+		c <- ret
+	}
+}
+
+// acquire takes a publishing channel from the pool, waiting for the connection if needed
+func (s *amqpSession) acquire(ctx context.Context) (*pooledChannel, string, int, error) {
+	for {
+		s.lock.Lock()
+		connected := s.connected
+		s.lock.Unlock()
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, "", 0, errors.New("amqp is not connected")
+		}
+		s.lock.Lock()
+		pool, lost, replyQueue, generation := s.pool, s.lost, s.replyQueue, s.generation
+		s.lock.Unlock()
+		if pool == nil {
+			continue // lost meanwhile
+		}
+		select {
+		case ch := <-pool:
+			return ch, replyQueue, generation, nil
+		case <-lost:
+			continue // wait for the new pool
+		case <-ctx.Done():
+			return nil, "", 0, errors.New("no free amqp channel")
+		}
+	}
+}
+
+// release returns a channel to the pool; broken channels are replaced and stale ones closed
+func (s *amqpSession) release(ch *pooledChannel, generation int, broken bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if generation != s.generation || s.conn == nil {
+		_ = ch.Close()
+		return
+	}
+	if broken {
+		_ = ch.Close()
+		var e error
+		if ch, e = newPooledChannel(s.conn); e != nil {
+			log.Printf("[producer] can't reopen amqp channel: %s", e.Error())
+			return
+		}
+	}
+	s.pool <- ch
+}
+
+// publish sends a mandatory message and waits for the broker to confirm it;
+// a message nobody is bound to receive is returned to us and reported as an error
+func (ch *pooledChannel) publish(ctx context.Context, exchange string, msg amqp.Publishing) error {
+	for len(ch.returns) > 0 { // stale leftovers
+		<-ch.returns
+	}
+	if e := ch.Publish(exchange, "", true, false, msg); e != nil {
+		return e
+	}
+	select {
+	case c, ok := <-ch.confirms:
+		if !ok {
+			return errors.New("amqp channel closed")
+		}
+		if !c.Ack {
+			return errors.New("message is not accepted by broker")
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// basic.return always comes before basic.ack of the same message
+	select {
+	case r := <-ch.returns:
+		return fmt.Errorf("%w on exchange %s ( %s )", errNoWorker, exchange, r.ReplyText)
+	default:
+	}
+	return nil
+}
+
+func (s *amqpSession) isConnected() bool {
+	s.lock.Lock()
+	connected := s.connected
+	s.lock.Unlock()
+	select {
+	case <-connected:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *amqpSession) expect(corrId string) chan *wunderdns.WunderReply {
+	c := make(chan *wunderdns.WunderReply, 1)
+	s.pendingLock.Lock()
+	s.pending[corrId] = c
+	s.pendingLock.Unlock()
+	return c
+}
+
+func (s *amqpSession) forget(corrId string) {
+	s.pendingLock.Lock()
+	delete(s.pending, corrId)
+	s.pendingLock.Unlock()
+}
@@ -0,0 +1,253 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"gopkg.in/go-ini/ini.v1"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clients sign their http requests instead of sending the secret:
+//
+//	Authorization: WDNS-HMAC-SHA256 Token=<token>, Timestamp=<unix time>, Signature=<hex>
+//
+// where signature is HMAC-SHA256 with the secret over lines joined by "\n":
+// WDNS-HMAC-SHA256, timestamp, method, path, canonical query ( sorted, url-encoded k=v joined by & )
+// and hex SHA256 of the body
+const authScheme = "WDNS-HMAC-SHA256"
+
+// maxSignedBody limits bodies read for the signature check, it's before the client is known
+const maxSignedBody = 1 << 20
+
+var signing = struct {
+	secrets      map[string][]wunderdns.TokenSecret // token -> secrets, from auth file
+	certificates map[string]string                  // client certificate name -> token, from auth file
+	priorities   map[string]int                     // token -> priority, from auth file
+	maxSkew      time.Duration
+	secretHeader bool // X-API-Secret is still accepted
+	seen         map[string]time.Time
+	purged       time.Time
+	lock         sync.Mutex
+}{
+	secrets:      make(map[string][]wunderdns.TokenSecret),
+	certificates: make(map[string]string),
+	priorities:   make(map[string]int),
+	maxSkew:      5 * time.Minute,
+	secretHeader: true,
+	seen:         make(map[string]time.Time),
+}
+
+func loadSigningConfig(f *ini.File) error {
+	s, e := f.GetSection("signing")
+	if e != nil {
+		return nil // secrets in headers only
+	}
+	if s.HasKey("max_skew") {
+		if signing.maxSkew, e = s.Key("max_skew").Duration(); e != nil || signing.maxSkew <= 0 {
+			return errors.New("signing.max_skew is not a valid duration")
+		}
+	}
+	if s.HasKey("allow_secret_header") {
+		if signing.secretHeader, e = s.Key("allow_secret_header").Bool(); e != nil {
+			return errors.New("signing.allow_secret_header is not boolean")
+		}
+	}
+	if s.HasKey("auth_file") {
+		a, e := ini.Load(s.Key("auth_file").String())
+		if e != nil {
+			return errors.New("can't load signing.auth_file: " + e.Error())
+		}
+		for _, sub := range a.Section("auth").ChildSections() {
+			token := strings.TrimPrefix(sub.Name(), "auth.")
+			for _, k := range sub.Keys() {
+				if k.Name() == "secret" {
+					// the primary one goes first
+					signing.secrets[token] = append([]wunderdns.TokenSecret{{Value: k.String()}}, signing.secrets[token]...)
+				} else if strings.HasPrefix(k.Name(), "secret.") {
+					secret, e := wunderdns.ParseSecret(k.String())
+					if e != nil {
+						return errors.New(sub.Name() + ": " + k.Name() + ": " + e.Error())
+					}
+					signing.secrets[token] = append(signing.secrets[token], secret)
+				}
+			}
+			if sub.HasKey("priority") {
+				signing.priorities[token] = sub.Key("priority").MustInt(0)
+			}
+			if sub.HasKey("certificate") {
+				for _, n := range strings.Split(sub.Key("certificate").String(), ";") {
+					if n = strings.TrimSpace(n); n != "" {
+						signing.certificates[n] = token
+					}
+				}
+			}
+		}
+		log.Printf("[signing] %d tokens loaded", len(signing.secrets))
+	}
+	return nil
+}
+
+// workerSecrets are active secrets of the token known to the worker running in this process
+var workerSecrets = wunderdns.LookupSecrets
+
+// lookupSecrets finds active secrets in the auth file and in the worker running in this process:
+// secrets staged in the token store are known to the worker only
+func lookupSecrets(token string) []string {
+	ret := make([]string, 0)
+	known := make(map[string]bool)
+	now := time.Now()
+	for _, s := range signing.secrets[token] {
+		if (s.Expires.IsZero() || now.Before(s.Expires)) && !known[s.Value] {
+			known[s.Value] = true
+			ret = append(ret, s.Value)
+		}
+	}
+	for _, s := range workerSecrets(token) {
+		if !known[s] {
+			known[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// lookupPriority finds priority of the token in the auth file or in the worker running in this process,
+// it's the one the worker schedules requests by
+func lookupPriority(token string) int {
+	if p, ok := signing.priorities[token]; ok {
+		return p
+	}
+	p, _ := wunderdns.LookupPriority(token)
+	return p
+}
+
+// lookupSecret finds the secret requests of the token are signed with
+func lookupSecret(token string) (string, bool) {
+	if secrets := lookupSecrets(token); len(secrets) > 0 {
+		return secrets[0], true
+	}
+	return "", false
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0)
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func stringToSign(r *http.Request, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{
+		authScheme,
+		timestamp,
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func parseAuthorization(header string) (map[string]string, bool) {
+	if !strings.HasPrefix(header, authScheme+" ") {
+		return nil, false
+	}
+	ret := make(map[string]string)
+	for _, p := range strings.Split(strings.TrimPrefix(header, authScheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		ret[kv[0]] = kv[1]
+	}
+	return ret, true
+}
+
+// checkSignature verifies the Authorization header and returns the token & its secret
+func checkSignature(w http.ResponseWriter, r *http.Request) (token, secret string, e error) {
+	params, ok := parseAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return "", "", errors.New("unsupported authorization scheme")
+	}
+	token, timestamp, signature := params["Token"], params["Timestamp"], params["Signature"]
+	if token == "" || timestamp == "" || signature == "" {
+		return "", "", errors.New("Token, Timestamp & Signature are required")
+	}
+	t, e := strconv.ParseInt(timestamp, 10, 64)
+	if e != nil {
+		return "", "", errors.New("invalid timestamp")
+	}
+	if d := time.Since(time.Unix(t, 0)); d > signing.maxSkew || d < -signing.maxSkew {
+		return "", "", errors.New("timestamp is out of window")
+	}
+	body, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+	if e != nil {
+		return "", "", errors.New("can't read body")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	// any active secret of the token, it's rotated
+	for _, s := range lookupSecrets(token) {
+		m := hmac.New(sha256.New, []byte(s))
+		m.Write([]byte(stringToSign(r, timestamp, body)))
+		if hmac.Equal([]byte(hex.EncodeToString(m.Sum(nil))), []byte(strings.ToLower(signature))) {
+			secret = s
+			break
+		}
+	}
+	if secret == "" {
+		return "", "", errors.New("invalid token/signature")
+	}
+	// the same signature can't be used twice
+	signing.lock.Lock()
+	defer signing.lock.Unlock()
+	if now := time.Now(); now.Sub(signing.purged) > time.Minute {
+		for k, v := range signing.seen {
+			if v.Before(now) {
+				delete(signing.seen, k)
+			}
+		}
+		signing.purged = now
+	}
+	key := fmt.Sprintf("%s/%s", token, signature)
+	if _, ok := signing.seen[key]; ok {
+		return "", "", errors.New("replayed request")
+	}
+	signing.seen[key] = time.Unix(t, 0).Add(signing.maxSkew)
+	return token, secret, nil
+}
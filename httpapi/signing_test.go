@@ -0,0 +1,178 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalQuery(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=1&a=10", "a=1&a=10&a=2"}, // values are sorted too
+		{"pretty", "pretty="},
+		{"name=x+y&c%26d=e%3Df", "c%26d=e%3Df&name=x+y"},
+		{"name=x%20y&path=%2Fa%2Fb", "name=x+y&path=%2Fa%2Fb"}, // one escaping for every spelling
+		{"%C3%BC=%C3%BC&z=%7E", "z=~&%C3%BC=%C3%BC"},           // keys are sorted by bytes
+	}
+	for _, c := range cases {
+		q, e := url.ParseQuery(c.query)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if s := canonicalQuery(q); s != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.query, c.expected, s)
+		}
+	}
+}
+
+// signHTTP signs the request as a client would, by the documented format
+func signHTTP(r *http.Request, token, secret string, timestamp int64, query string, body []byte) {
+	sum := sha256.Sum256(body)
+	s := strings.Join([]string{"WDNS-HMAC-SHA256", fmt.Sprint(timestamp), r.Method, r.URL.EscapedPath(), query,
+		hex.EncodeToString(sum[:])}, "\n")
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(s))
+	r.Header.Set("Authorization", fmt.Sprintf("WDNS-HMAC-SHA256 Token=%s, Timestamp=%d, Signature=%s", token,
+		timestamp, hex.EncodeToString(m.Sum(nil))))
+}
+
+func TestCheckSignature(t *testing.T) {
+	// the old secret is still good while it's rotated
+	signing.secrets["signer"] = []wunderdns.TokenSecret{{Value: "new"}, {Value: "old"}}
+	defer delete(signing.secrets, "signer")
+	body := `{"domain":"example.com"}`
+	now := time.Now().Unix()
+	skew := int64(signing.maxSkew / time.Second)
+	request := func(target string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	}
+	cases := []struct {
+		name   string
+		sign   func(r *http.Request)
+		secret string
+		errors string
+	}{
+		{"valid", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now, "a=1&b=x+y", []byte(body))
+		}, "new", ""},
+		{"rotated secret", func(r *http.Request) {
+			signHTTP(r, "signer", "old", now-1, "a=1&b=x+y", []byte(body))
+		}, "old", ""},
+		{"uppercase signature", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now-2, "a=1&b=x+y", []byte(body))
+			h := r.Header.Get("Authorization")
+			i := strings.Index(h, "Signature=") + len("Signature=")
+			r.Header.Set("Authorization", h[:i]+strings.ToUpper(h[i:]))
+		}, "new", ""},
+		{"query order", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now, "b=x+y&a=1", []byte(body))
+		}, "", "invalid token/signature"},
+		{"body hash mismatch", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now, "a=1&b=x+y", []byte(`{"domain":"example.net"}`))
+		}, "", "invalid token/signature"},
+		{"bad signature", func(r *http.Request) {
+			signHTTP(r, "signer", "wrong", now, "a=1&b=x+y", []byte(body))
+		}, "", "invalid token/signature"},
+		{"unknown token", func(r *http.Request) {
+			signHTTP(r, "nobody", "new", now, "a=1&b=x+y", []byte(body))
+		}, "", "invalid token/signature"},
+		{"clock behind", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now-skew-60, "a=1&b=x+y", []byte(body))
+		}, "", "timestamp is out of window"},
+		{"clock ahead", func(r *http.Request) {
+			signHTTP(r, "signer", "new", now+skew+60, "a=1&b=x+y", []byte(body))
+		}, "", "timestamp is out of window"},
+		{"bad timestamp", func(r *http.Request) {
+			r.Header.Set("Authorization", "WDNS-HMAC-SHA256 Token=signer, Timestamp=yesterday, Signature=00")
+		}, "", "invalid timestamp"},
+		{"missing signature", func(r *http.Request) {
+			r.Header.Set("Authorization", fmt.Sprintf("WDNS-HMAC-SHA256 Token=signer, Timestamp=%d", now))
+		}, "", "Token, Timestamp & Signature are required"},
+		{"other scheme", func(r *http.Request) {
+			r.Header.Set("Authorization", "Basic c2lnbmVyOm5ldw==")
+		}, "", "unsupported authorization scheme"},
+	}
+	for _, c := range cases {
+		// the query is canonicalized: order & escaping of the url don't matter
+		r := request("/record?b=x%20y&a=1")
+		c.sign(r)
+		token, secret, e := checkSignature(httptest.NewRecorder(), r)
+		if c.errors == "" {
+			if e != nil || token != "signer" || secret != c.secret {
+				t.Errorf("%s: %v", c.name, e)
+				continue
+			}
+			// the body is still there for the handler
+			if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+				t.Errorf("%s: body is lost: %q", c.name, b)
+			}
+		} else if e == nil || e.Error() != c.errors {
+			t.Errorf("%s: expected %q, got %v", c.name, c.errors, e)
+		}
+	}
+
+	// the same signature can't be used twice
+	first := request("/record?a=1")
+	signHTTP(first, "signer", "new", now-3, "a=1", []byte(body))
+	again := request("/record?a=1")
+	again.Header.Set("Authorization", first.Header.Get("Authorization"))
+	if _, _, e := checkSignature(httptest.NewRecorder(), first); e != nil {
+		t.Fatal(e)
+	}
+	if _, _, e := checkSignature(httptest.NewRecorder(), again); e == nil || e.Error() != "replayed request" {
+		t.Errorf("replay: %v", e)
+	}
+
+	// bodies are read up to a limit
+	large := strings.Repeat("x", maxSignedBody+1)
+	r := httptest.NewRequest(http.MethodPost, "/record", strings.NewReader(large))
+	signHTTP(r, "signer", "new", now-4, "", []byte(large))
+	if _, _, e := checkSignature(httptest.NewRecorder(), r); e == nil || e.Error() != "can't read body" {
+		t.Errorf("large body: %v", e)
+	}
+}
+
+func TestLookupSecrets(t *testing.T) {
+	signing.secrets["merged"] = []wunderdns.TokenSecret{{Value: "file"}, {Value: "gone", Expires: time.Now().Add(-time.Minute)}}
+	defer delete(signing.secrets, "merged")
+	defer func(old func(string) []string) { workerSecrets = old }(workerSecrets)
+	// secrets staged in the token store are known to the worker only
+	workerSecrets = func(token string) []string {
+		if token == "merged" || token == "worker" {
+			return []string{"file", "staged"}
+		}
+		return nil
+	}
+	for token, expected := range map[string]string{"merged": "file,staged", "worker": "file,staged", "nobody": ""} {
+		if s := strings.Join(lookupSecrets(token), ","); s != expected {
+			t.Errorf("%s: expected %q, got %q", token, expected, s)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"log"
+	"net/http"
+	"time"
+)
+
+// GET /token - validity & permissions of the token the request is authenticated with
+func apiTokenFunc(w http.ResponseWriter, r *http.Request) {
+	if token, secret, ok := checkAuthHeaders(w, r); !ok {
+		return
+	} else {
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, r, apiTokenInfo(r.Context(), token, secret))
+		default:
+			writeJsonE(w, r, 501, "not implemented")
+		}
+	}
+}
+
+// POST /token/secret - stage a new secret of the token, it's in the reply
+// DELETE /token/secret?id=<secret id>&grace=1h - retire the secret after the grace period ( default now )
+func apiTokenSecretFunc(w http.ResponseWriter, r *http.Request) {
+	if token, secret, ok := checkAuthHeaders(w, r); !ok {
+		return
+	} else {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+			writeJson(w, r, apiSecretCommand(r.Context(), token, secret, wunderdns.CommandStageSecret, nil))
+		case http.MethodDelete:
+			spec := &wunderdns.SecretSpec{Id: r.FormValue("id")}
+			if spec.Id == "" {
+				writeJsonE(w, r, 422, "id is not set")
+				return
+			}
+			if g := r.FormValue("grace"); g != "" {
+				grace, e := time.ParseDuration(g)
+				if e != nil || grace < 0 {
+					writeJsonE(w, r, 422, "grace is not a valid duration")
+					return
+				}
+				spec.Grace = int64(grace.Seconds())
+			}
+			writeJson(w, r, apiSecretCommand(r.Context(), token, secret, wunderdns.CommandRetireSecret, spec))
+		default:
+			writeJsonE(w, r, 501, "not implemented")
+		}
+	}
+}
+
+// GET /token/children - child tokens of the token
+// POST /token/children {"permissions": ["public,*.app.company.net=create_record"], "priority": 0,
+// "expires": "2027-01-01T00:00:00Z"} - create a child token, its secret is in the reply
+// DELETE /token/children?token=<child> - revoke the child token
+func apiTokenChildrenFunc(w http.ResponseWriter, r *http.Request) {
+	if token, secret, ok := checkAuthHeaders(w, r); !ok {
+		return
+	} else {
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, wunderdns.CommandListTokens, nil))
+		case http.MethodPost, http.MethodPut:
+			spec, ok := decodeTokenSpec(w, r)
+			if !ok {
+				return
+			}
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, wunderdns.CommandCreateToken, spec))
+		case http.MethodDelete:
+			if r.FormValue("token") == "" {
+				writeJsonE(w, r, 422, "token is not set")
+				return
+			}
+			spec := &wunderdns.TokenSpec{Token: r.FormValue("token")}
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, wunderdns.CommandRevokeToken, spec))
+		default:
+			writeJsonE(w, r, 501, "not implemented")
+		}
+	}
+}
+
+// GET /admin/tokens - tokens of the token store, admin tokens only
+// POST /admin/tokens {"token": "tenant1", "permissions": ["public,*.tenant1.company.net=*"], "priority": 0,
+// "children": 10, "allow_from": ["10.0.0.0/8"], "expires": "2027-01-01T00:00:00Z"} - create a token,
+// the name is random if not set, the secret is in the reply
+// PUT /admin/tokens {"token": "tenant1", ...} - replace permissions, priority, children, allow_from & expires
+// DELETE /admin/tokens?token=<token> - revoke the token & its children
+func apiAdminTokensFunc(w http.ResponseWriter, r *http.Request) {
+	if token, secret, ok := checkAuthHeaders(w, r); !ok {
+		return
+	} else {
+		switch r.Method {
+		case http.MethodGet:
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, wunderdns.CommandAdminListTokens, nil))
+		case http.MethodPost, http.MethodPut:
+			spec, ok := decodeTokenSpec(w, r)
+			if !ok {
+				return
+			}
+			cmd := wunderdns.CommandAdminCreateToken
+			if r.Method == http.MethodPut {
+				if spec.Token == "" {
+					writeJsonE(w, r, 422, "token is not set")
+					return
+				}
+				cmd = wunderdns.CommandAdminUpdateToken
+			}
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, cmd, spec))
+		case http.MethodDelete:
+			if r.FormValue("token") == "" {
+				writeJsonE(w, r, 422, "token is not set")
+				return
+			}
+			spec := &wunderdns.TokenSpec{Token: r.FormValue("token")}
+			writeJson(w, r, apiTokenCommand(r.Context(), token, secret, wunderdns.CommandAdminRevokeToken, spec))
+		default:
+			writeJsonE(w, r, 501, "not implemented")
+		}
+	}
+}
+
+// decodeTokenSpec reads the token description, writes the error if it's bad
+func decodeTokenSpec(w http.ResponseWriter, r *http.Request) (*wunderdns.TokenSpec, bool) {
+	req := struct {
+		Token       string   `json:"token"`
+		Permissions []string `json:"permissions"`
+		Priority    int      `json:"priority"`
+		Children    int      `json:"children"`
+		AllowFrom   []string `json:"allow_from"`
+		Expires     string   `json:"expires"`
+	}{}
+	if e := json.NewDecoder(r.Body).Decode(&req); e != nil {
+		log.Print("Error decoding json: ", e.Error())
+		writeJsonE(w, r, 422, "json decoding error")
+		return nil, false
+	}
+	spec := &wunderdns.TokenSpec{
+		Token:       req.Token,
+		Permissions: req.Permissions,
+		Priority:    req.Priority,
+		Children:    req.Children,
+		AllowFrom:   req.AllowFrom,
+	}
+	if req.Expires != "" {
+		t, e := time.Parse(time.RFC3339, req.Expires)
+		if e != nil {
+			writeJsonE(w, r, 422, "expires is not RFC3339 time")
+			return nil, false
+		}
+		spec.Expires = t.Unix()
+	}
+	return spec, true
+}
+
+func apiTokenCommand(ctx context.Context, token, secret string, cmd wunderdns.Command, spec *wunderdns.TokenSpec) *wunderdns.WunderReply {
+	req := &wunderdns.WunderRequest{
+		Cmd: cmd,
+		Domain: &wunderdns.Domain{
+			Name: wunderdns.DomainNameAny,
+			View: wunderdns.DomainViewPublic,
+		},
+		TokenSpec: spec,
+	}
+	return signAndPush(ctx, req, token, secret)
+}
+
+func apiSecretCommand(ctx context.Context, token, secret string, cmd wunderdns.Command, spec *wunderdns.SecretSpec) *wunderdns.WunderReply {
+	req := &wunderdns.WunderRequest{
+		Cmd: cmd,
+		Domain: &wunderdns.Domain{
+			Name: wunderdns.DomainNameAny,
+			View: wunderdns.DomainViewPublic,
+		},
+		Secret: spec,
+	}
+	return signAndPush(ctx, req, token, secret)
+}
+
+func apiTokenInfo(ctx context.Context, token, secret string) *wunderdns.WunderReply {
+	req := &wunderdns.WunderRequest{
+		Cmd: wunderdns.CommandTokenInfo,
+		// the same for any view, a single one is asked
+		Domain: &wunderdns.Domain{
+			Name: wunderdns.DomainNameAny,
+			View: wunderdns.DomainViewPublic,
+		},
+	}
+	return signAndPush(ctx, req, token, secret)
+}
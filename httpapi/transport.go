@@ -0,0 +1,105 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/wgnet/wunderdns/wunderdns"
+	"gopkg.in/go-ini/ini.v1"
+	"log"
+	"time"
+)
+
+const (
+	transportAMQP  = "amqp"
+	transportLocal = "local"
+)
+
+// transport delivers signed requests to workers and brings their replies back
+type transport interface {
+	pushMessage(ctx context.Context, request *wunderdns.WunderRequest) *wunderdns.WunderReply
+	isConnected() bool
+}
+
+// localTransport hands requests to the worker running in the same process
+type localTransport struct {
+	timeout time.Duration
+}
+
+func newTransport(configFile string) transport {
+	f, e := ini.Load(configFile)
+	if e != nil {
+		log.Fatal("Can't load configuration file", e.Error())
+		return nil
+	}
+	kind := transportAMQP
+	if s, e := f.GetSection("producer"); e == nil && s.HasKey("transport") {
+		kind = s.Key("transport").String()
+	}
+	if s, e := f.GetSection("producer"); e == nil && s.HasKey("signature") {
+		switch s.Key("signature").String() {
+		case "v1":
+			signatureVersion = 1
+		case "v2":
+			signatureVersion = wunderdns.SignatureV2
+		default:
+			log.Fatal("producer.signature is not in (v1,v2)")
+			return nil
+		}
+	}
+	switch kind {
+	case transportAMQP:
+		if p := newProducer(configFile); p != nil {
+			return p
+		}
+		return nil
+	case transportPGQueue:
+		if t := newPGTransport(f); t != nil {
+			return t
+		}
+		return nil
+	case transportLocal:
+		log.Print("[producer] using in-process transport, requests are not sent to amqp")
+		ret := &localTransport{timeout: time.Minute}
+		if s, e := f.GetSection("timeout"); e == nil && s.HasKey("default") {
+			if d, e := s.Key("default").Duration(); e == nil && d > 0 {
+				ret.timeout = d
+			}
+		}
+		return ret
+	default:
+		log.Fatal("unknown producer transport: ", kind)
+		return nil
+	}
+}
+
+func (t *localTransport) pushMessage(ctx context.Context, request *wunderdns.WunderRequest) *wunderdns.WunderReply {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	// the worker alters requests it processes - give it a copy, just like the broker would
+	data, e := json.Marshal(request)
+	if e != nil {
+		return wunderdns.ReturnError("json marshal error: " + e.Error())
+	}
+	clone := new(wunderdns.WunderRequest)
+	if e := json.Unmarshal(data, clone); e != nil {
+		return wunderdns.ReturnError("json unmarshal error: " + e.Error())
+	}
+	return wunderdns.ProcessRequest(ctx, clone)
+}
+
+func (t *localTransport) isConnected() bool {
+	return true
+}
@@ -17,10 +17,34 @@ import (
 	"crypto"
 	"errors"
 	"fmt"
+	"net"
+	"path"
 	"strings"
 	"time"
 )
 
+// signedCommands aren't accepted with legacy signatures: they cover the domain, the command & records only
+var signedCommands = map[Command]bool{
+	CommandCheckReplicas: true,
+	CommandRepairReplica: true,
+	CommandStageSecret:   true,
+	CommandRetireSecret:  true,
+	CommandCreateToken:   true,
+	CommandRevokeToken:   true,
+	CommandListTokens:    true,
+
+	CommandAdminCreateToken: true,
+	CommandAdminUpdateToken: true,
+	CommandAdminRevokeToken: true,
+	CommandAdminListTokens:  true,
+}
+
+// explicitCommands have to be granted by name, `*` doesn't give them
+var explicitCommands = map[Command]bool{
+	CommandCheckReplicas: true,
+	CommandRepairReplica: true,
+}
+
 func securityProcessRequest(request *WunderRequest) error {
 	authDataLock.RLock()
 	defer authDataLock.RUnlock()
@@ -30,13 +54,83 @@ func securityProcessRequest(request *WunderRequest) error {
 	if !globalConfig.Auth.checkAuthentication(request) {
 		return errors.New(fmt.Sprintf("[auth] %s - invalid token/secret", request.Auth.Token))
 	}
-	if !globalConfig.Auth.isPermitted(request) {
-		return errors.New(fmt.Sprintf("[auth] %s @ %s -> %s/%s - permission denied", request.Auth.Token, request.Cmd, request.Domain.Name,
-			request.Domain.View))
+	if request.Asserted != nil {
+		// legacy signatures don't cover assertions
+		if v := (*globalConfig.Auth)[request.Auth.Token]; !v.Delegate || request.Auth.Version < SignatureV2 {
+			return errors.New(fmt.Sprintf("[auth] %s - not allowed to assert identities", request.Auth.Token))
+		}
+		if request.Asserted.Subject == "" {
+			return errors.New("[auth] asserted identity has no subject")
+		}
+	}
+	if signedCommands[request.Cmd] && request.Auth.Version < SignatureV2 {
+		return errors.New(fmt.Sprintf("[auth] %s - %s needs v2 signatures", request.Auth.Token, request.Cmd))
+	}
+	v := (*globalConfig.Auth)[request.Auth.Token]
+	ancestors, _ := globalConfig.Auth.ancestors(v)
+	for _, a := range append([]AuthData{v}, ancestors...) {
+		if e := a.checkOrigin(request); e != nil {
+			return errors.New(fmt.Sprintf("[auth] %s - %s", request.Auth.Token, e.Error()))
+		}
+	}
+	if ok, rule := globalConfig.Auth.checkPermission(request); !ok {
+		return errors.New(fmt.Sprintf("[auth] %s @ %s -> %s/%s - permission denied (%s)", request.Auth.Token, request.Cmd,
+			request.Domain.Name, request.Domain.View, rule))
+	} else {
+		logging.Debug(fmt.Sprintf("[auth] %s @ %s -> %s/%s - allowed (%s)", request.Auth.Token, request.Cmd,
+			request.Domain.Name, request.Domain.View, rule))
 	}
 	return nil
 }
 
+// checkOrigin checks the client address of tokens restricted to some networks; legacy signatures
+// don't cover the address, so they aren't accepted from such tokens
+func (a AuthData) checkOrigin(request *WunderRequest) error {
+	if len(a.AllowFrom) == 0 {
+		return nil
+	}
+	if request.Auth.Version < SignatureV2 {
+		return errors.New("network restricted tokens need v2 signatures")
+	}
+	ip := net.ParseIP(request.Origin)
+	if ip == nil {
+		return errors.New("client address is unknown")
+	}
+	for _, n := range a.AllowFrom {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return errors.New("not allowed from " + request.Origin)
+}
+
+// ParseNetworks parses comma separated CIDRs and addresses ( single host networks )
+func ParseNetworks(value string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.New("bad address " + v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(v)
+		if e != nil {
+			return nil, errors.New("bad network " + v)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
 func checkDomainMatch(one, other *Domain) bool {
 	viewOk := false
 	nameOk := false
@@ -53,25 +147,325 @@ func checkDomainMatch(one, other *Domain) bool {
 	return viewOk && nameOk
 }
 func (authDatabase *AuthDatabase) isPermitted(request *WunderRequest) bool {
+	ok, _ := authDatabase.checkPermission(request)
+	return ok
+}
+
+// checkPermission decides on the request and tells the rule which made the decision
+func (authDatabase *AuthDatabase) checkPermission(request *WunderRequest) (bool, string) {
 	v, ok := (*authDatabase)[request.Auth.Token]
 	if !ok {
-		return false
+		return false, "unknown token"
 	}
-	if request.Cmd == CommandListOwn { // commit changes
+	switch request.Cmd {
+	case CommandListOwn, CommandTokenInfo, CommandStageSecret, CommandRetireSecret, CommandCreateToken,
+		CommandRevokeToken, CommandListTokens, CommandAdminCreateToken, CommandAdminUpdateToken,
+		CommandAdminRevokeToken, CommandAdminListTokens: // commit changes
 		request.Auth.priority = v.Priority
+		return true, string(request.Cmd)
+	}
+	ok, rule := permissionsDecide(v.Permissions, request)
+	if !ok {
+		return false, describeRule(rule)
+	}
+	// child tokens are narrowed down to permissions of their parents
+	ancestors, ok := authDatabase.ancestors(v)
+	if !ok {
+		return false, "parent token is revoked"
+	}
+	for _, a := range ancestors {
+		if ok, r := permissionsDecide(a.Permissions, request); !ok {
+			return false, "parent " + a.Token + " " + describeRule(r)
+		}
+	}
+	// delegate's permissions narrowed down to the asserted ones
+	if request.Asserted != nil {
+		if ok, asserted := permissionsDecide(request.Asserted.Permissions, request); !ok {
+			return false, "asserted " + describeRule(asserted)
+		}
+	}
+	request.Auth.priority = v.Priority // commit changes
+	return true, describeRule(rule)
+}
+
+func describeRule(rule *Permission) string {
+	if rule == nil {
+		return "no matching rule"
+	}
+	return "rule " + rule.String()
+}
+
+// permissionsDecide checks the command on the domain and every record of the request.
+// For every record the most specific matching permission decides, deny beats allow of
+// the same specificity; nothing matching is a deny. The deciding rule is returned.
+func permissionsDecide(permissions []Permission, request *WunderRequest) (bool, *Permission) {
+	records := request.Record
+	if len(records) == 0 {
+		records = []*Record{nil}
+	}
+	var rule *Permission
+	for _, r := range records {
+		rule = nil
+		for i := range permissions {
+			p := &permissions[i]
+			if !p.allows(request, r) {
+				continue
+			}
+			if rule == nil || p.moreSpecific(rule, r != nil) || (p.Deny && !rule.Deny && !rule.moreSpecific(p, r != nil)) {
+				rule = p
+			}
+		}
+		if rule == nil || rule.Deny {
+			return false, rule
+		}
+	}
+	return true, rule
+}
+
+// allows tells if the permission matches the request & the record, whether it's a deny or not;
+// record scoped denies never match requests without records
+func (p *Permission) allows(request *WunderRequest, record *Record) bool {
+	if !p.validAt(time.Now()) || !checkDomainMatch(&p.Domain, request.Domain) {
+		return false
+	}
+	permitted := false
+	for _, c := range p.Permitted {
+		if c == request.Cmd || (c == CommandAny && !explicitCommands[request.Cmd]) {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		return false
+	}
+	if record == nil {
+		return !p.Deny || !p.scoped()
+	}
+	return p.allowsRecord(record)
+}
+
+// allowsRecord checks the record against name masks & types of the permission
+func (p *Permission) allowsRecord(record *Record) bool {
+	if len(p.Types) > 0 {
+		ok := false
+		for _, t := range p.Types {
+			if t == record.Type {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(p.Names) == 0 {
 		return true
 	}
-	for _, p := range v.Permissions {
-		if checkDomainMatch(&p.Domain, request.Domain) {
-			for _, c := range p.Permitted {
-				if c == request.Cmd || c == CommandAny {
-					request.Auth.priority = v.Priority // commit changes
-					return true
+	name := strings.ToLower(record.Name)
+	if name == "" || name == "." {
+		name = "@"
+	}
+	for _, n := range p.Names {
+		if ok, _ := path.Match(n, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Permission) scoped() bool {
+	return len(p.Names) > 0 || len(p.Types) > 0
+}
+
+// specificity ranks masks: exact domain name, longer `*suffix`, a view, record scopes ( for records only ),
+// listed commands
+func (p *Permission) specificity(records bool) [5]int {
+	var s [5]int
+	switch {
+	case p.Domain.Name == DomainNameAny:
+	case strings.HasPrefix(p.Domain.Name, "*"):
+		s[0] = 2 * (len(p.Domain.Name) - 1)
+	default:
+		s[0] = 2*len(p.Domain.Name) + 1
+	}
+	if p.Domain.View != DomainViewAny {
+		s[1] = 1
+	}
+	if records && len(p.Names) > 0 {
+		s[2] = 1
+	}
+	if records && len(p.Types) > 0 {
+		s[3] = 1
+	}
+	s[4] = 1
+	for _, c := range p.Permitted {
+		if c == CommandAny {
+			s[4] = 0
+		}
+	}
+	return s
+}
+
+func (p *Permission) moreSpecific(other *Permission, records bool) bool {
+	a, b := p.specificity(records), other.specificity(records)
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// String gives the permission back in the ACL syntax
+func (p *Permission) String() string {
+	cmds := make([]string, len(p.Permitted))
+	for i, c := range p.Permitted {
+		cmds[i] = string(c)
+	}
+	ret := fmt.Sprintf("%s,%s=", p.Domain.View, p.Domain.Name)
+	if p.Deny {
+		ret += permissionDenyPrefix
+	}
+	ret += strings.Join(cmds, ",")
+	if len(p.Names) > 0 {
+		ret += ";name=" + strings.Join(p.Names, ",")
+	}
+	if len(p.Types) > 0 {
+		types := make([]string, len(p.Types))
+		for i, t := range p.Types {
+			types[i] = string(t)
+		}
+		ret += ";type=" + strings.Join(types, ",")
+	}
+	if p.NotBefore != 0 {
+		ret += ";not_before=" + unixTime(p.NotBefore).UTC().Format(time.RFC3339)
+	}
+	if p.Expires != 0 {
+		ret += ";expires=" + unixTime(p.Expires).UTC().Format(time.RFC3339)
+	}
+	return ret
+}
+
+// LookupSecret gives the secret of a token to the api gateway running in the same process
+func LookupSecret(token string) (string, bool) {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return "", false
+	}
+	v, ok := (*globalConfig.Auth)[token]
+	if !ok {
+		return "", false
+	}
+	if secrets := v.activeSecrets(time.Now()); len(secrets) > 0 {
+		return secrets[0], true
+	}
+	return "", false
+}
+
+// ParsePermission parses an ACL line: `<view>,<domain mask>` or `<domain mask>` as the key
+// and comma separated commands, prefixed with `deny:` for denies, as the value, optionally scoped to records by
+// `;name=<mask>[,<mask>...]` ( relative record names, `@` is the domain itself ) and `;type=<type>[,<type>...]`
+// and limited in time by `;not_before=<time>` and `;expires=<time>`
+func ParsePermission(key, value string) (Permission, error) {
+	d := strings.Split(key, ",")
+	scopes := strings.Split(strings.TrimSpace(value), ";")
+	p := Permission{
+		Domain:    Domain{},
+		Permitted: make([]Command, 0),
+	}
+	if strings.HasPrefix(scopes[0], permissionDenyPrefix) {
+		p.Deny = true
+		scopes[0] = strings.TrimPrefix(scopes[0], permissionDenyPrefix)
+	}
+	c := strings.Split(scopes[0], ",")
+	if len(d) == 1 {
+		p.Domain.View = DomainViewAny
+		p.Domain.Name = d[0]
+	} else if len(d) == 2 {
+		p.Domain.View = DomainView(d[0])
+		p.Domain.Name = d[1]
+		if x, ok := domainViews[p.Domain.View]; !(ok && x) {
+			return p, errors.New("bad view " + d[0])
+		}
+	}
+	for _, v := range c {
+		if x, ok := commands[Command(strings.TrimSpace(v))]; ok && x {
+			p.Permitted = append(p.Permitted, Command(strings.TrimSpace(v)))
+		}
+	}
+	for _, scope := range scopes[1:] {
+		kv := strings.SplitN(strings.TrimSpace(scope), "=", 2)
+		if len(kv) != 2 {
+			return p, errors.New("bad record scope " + scope)
+		}
+		if kv[0] == "not_before" || kv[0] == "expires" {
+			notBefore, expires := unixTime(p.NotBefore), unixTime(p.Expires)
+			if e := setValidity(kv[0], strings.TrimSpace(kv[1]), &notBefore, &expires); e != nil {
+				return p, e
+			}
+			if !notBefore.IsZero() {
+				p.NotBefore = notBefore.Unix()
+			}
+			if !expires.IsZero() {
+				p.Expires = expires.Unix()
+			}
+			continue
+		}
+		for _, v := range strings.Split(kv[1], ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			switch kv[0] {
+			case "name":
+				v = strings.ToLower(v)
+				if _, e := path.Match(v, ""); e != nil {
+					return p, errors.New("bad record name mask " + v)
+				}
+				p.Names = append(p.Names, v)
+			case "type":
+				t := RecordType(strings.ToUpper(v))
+				if x, ok := recordTypes[t]; !(ok && x) {
+					return p, errors.New("bad record type " + v)
 				}
+				p.Types = append(p.Types, t)
+			default:
+				return p, errors.New("bad record scope " + kv[0])
 			}
 		}
 	}
-	return false
+	return p, nil
+}
+
+// parseCertificateNames splits `certificate` value: subjects & SANs separated by `;`
+// ( subject DNs contain commas )
+func parseCertificateNames(value string) []string {
+	ret := make([]string, 0)
+	for _, n := range strings.Split(value, ";") {
+		if n = strings.TrimSpace(n); n != "" {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// LookupCertificate finds the token a client certificate with any of the names is mapped to
+func LookupCertificate(names []string) (string, bool) {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return "", false
+	}
+	for token, v := range *globalConfig.Auth {
+		for _, c := range v.Certificates {
+			for _, n := range names {
+				if c == n {
+					return token, true
+				}
+			}
+		}
+	}
+	return "", false
 }
 
 /**
@@ -91,14 +485,37 @@ func (authDatabase *AuthDatabase) checkAuthentication(request *WunderRequest) bo
 	if v, ok := (*authDatabase)[request.Auth.Token]; !ok {
 		logging.Debug("[auth] token not found in database: ", request.Auth.Token)
 		return false
+	} else if !v.validAt(time.Now()) {
+		logging.Debug("[auth] token is expired or not valid yet: ", request.Auth.Token)
+		return false
+	} else if !authDatabase.ancestorsValid(v) {
+		logging.Debug("[auth] parent of the token is revoked or expired: ", request.Auth.Token)
+		return false
+	} else if len(v.PublicKey) > 0 || request.Auth.Version == SignatureEd25519 {
+		// tokens with a public key have no secret to check anything else against
+		if len(v.PublicKey) > 0 && request.Auth.Version == SignatureEd25519 &&
+			checkSignatureEd25519(request, v.PublicKey) {
+			return true
+		}
+	} else if request.Auth.Version == SignatureV2 {
+		if checkSignatureV2(request, v.activeSecrets(time.Now())) {
+			return true
+		}
+	} else if !globalConfig.security().AllowV1 {
+		logging.Debug("[auth] legacy signature is not allowed: ", request.Auth.Token)
+		return false
 	} else {
-		for shift := -900; shift <= 900; shift += 30 {
+		window := int(globalConfig.security().V1Skew.Seconds())
+		secrets := v.activeSecrets(time.Now())
+		for shift := -window; shift <= window; shift += 30 {
 			h := createVariodicHash(request, shift)
-			x := crypto.SHA256.New()
-			x.Write([]byte(fmt.Sprintf("%s@%s", v.Secret, h)))
-			x2 := fmt.Sprintf("%0x", x.Sum(nil))
-			if x2 == request.Auth.Sum {
-				return true
+			for _, secret := range secrets {
+				x := crypto.SHA256.New()
+				x.Write([]byte(fmt.Sprintf("%s@%s", secret, h)))
+				x2 := fmt.Sprintf("%0x", x.Sum(nil))
+				if x2 == request.Auth.Sum {
+					return true
+				}
 			}
 		}
 	}
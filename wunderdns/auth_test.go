@@ -13,7 +13,12 @@
 // limitations under the License.
 package wunderdns
 
-import "testing"
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
 
 var authdb = &AuthDatabase{
 	"test": {
@@ -176,3 +181,397 @@ func TestIsPermitted(t *testing.T) {
 	}
 
 }
+
+func TestLookupCertificate(t *testing.T) {
+	names := parseCertificateNames("CN=svc.example.com,O=Example; svc.example.com ;;spiffe://example.com/svc")
+	if len(names) != 3 || names[0] != "CN=svc.example.com,O=Example" || names[1] != "svc.example.com" {
+		t.Fatalf("certificate names are parsed wrong: %v", names)
+	}
+	globalConfig.Auth = &AuthDatabase{
+		"svc": {Token: "svc", Secret: "svc", Certificates: names},
+	}
+	defer func() { globalConfig.Auth = authdb }()
+	if token, ok := LookupCertificate([]string{"CN=other", "spiffe://example.com/svc"}); !ok || token != "svc" {
+		t.Errorf("certificate is not mapped to svc: %s", token)
+	}
+	if _, ok := LookupCertificate([]string{"CN=other"}); ok {
+		t.Error("unknown certificate is mapped")
+	}
+	if secret, ok := LookupSecret("svc"); !ok || secret != "svc" {
+		t.Error("secret of svc is not found")
+	}
+}
+
+func TestAssertedPermissions(t *testing.T) {
+	db := &AuthDatabase{
+		"delegate": {
+			Token:    "delegate",
+			Secret:   "delegate",
+			Delegate: true,
+			Permissions: []Permission{
+				{Domain: Domain{Name: "*.example.com", View: DomainViewAny}, Permitted: []Command{CommandAny}},
+			},
+		},
+	}
+	asserted := &Assertion{
+		Subject: "alice",
+		Permissions: []Permission{
+			{Domain: Domain{Name: "*", View: DomainViewPublic}, Permitted: []Command{CommandCreateRecord}},
+		},
+	}
+	cases := []struct {
+		cmd      Command
+		domain   Domain
+		expected bool
+	}{
+		{CommandCreateRecord, Domain{Name: "a.example.com", View: DomainViewPublic}, true},
+		{CommandDeleteRecord, Domain{Name: "a.example.com", View: DomainViewPublic}, false},  // not asserted
+		{CommandCreateRecord, Domain{Name: "a.example.com", View: DomainViewPrivate}, false}, // not asserted
+		{CommandCreateRecord, Domain{Name: "a.example.net", View: DomainViewPublic}, false},  // not delegated
+	}
+	for i, c := range cases {
+		domain := c.domain
+		req := &WunderRequest{Auth: &AuthHeader{Token: "delegate"}, Cmd: c.cmd, Domain: &domain, Asserted: asserted}
+		if db.isPermitted(req) != c.expected {
+			t.Errorf("case %d: expected %v", i, c.expected)
+		}
+	}
+	req := &WunderRequest{Auth: &AuthHeader{Token: "delegate"}, Asserted: asserted}
+	if req.owner() != "oidc:alice" {
+		t.Errorf("owner of asserted request is %s", req.owner())
+	}
+
+	// only delegates may assert identities, with v2 signatures only
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	(*db)["plain"] = AuthData{Token: "plain", Secret: "plain", Permissions: (*db)["delegate"].Permissions}
+	for token, expected := range map[string]bool{"delegate": true, "plain": false} {
+		req := &WunderRequest{
+			Cmd:    CommandCreateRecord,
+			Domain: &Domain{Name: "a.example.com", View: DomainViewPublic},
+		}
+		req.Asserted = asserted
+		if e := SignRequest(req, token, token); e != nil {
+			t.Fatal(e)
+		}
+		if e := securityProcessRequest(req); (e == nil) != expected {
+			t.Errorf("assertion of %s: %v", token, e)
+		}
+	}
+}
+
+func TestAssertedRecordWrites(t *testing.T) {
+	db := &AuthDatabase{
+		"delegate": {
+			Token:    "delegate",
+			Secret:   "delegate",
+			Delegate: true,
+			Permissions: []Permission{
+				{Domain: Domain{Name: "*", View: DomainViewAny}, Permitted: []Command{CommandAny}},
+			},
+		},
+	}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	asserted := &Assertion{
+		Subject: "alice",
+		Permissions: []Permission{
+			{Domain: Domain{Name: "*", View: DomainViewPublic}, Permitted: []Command{CommandCreateRecord}},
+		},
+	}
+	cases := []struct {
+		cmd      Command
+		asserted *Assertion
+		expected bool
+	}{
+		{CommandCreateRecord, asserted, true},
+		{CommandReplaceRecord, asserted, false},
+		{CommandDeleteRecord, asserted, false},
+		// the delegate itself may do anything
+		{CommandReplaceRecord, nil, true},
+		{CommandDeleteRecord, nil, true},
+	}
+	for i, c := range cases {
+		req := &WunderRequest{
+			Cmd:      c.cmd,
+			Domain:   &Domain{Name: "example.com", View: DomainViewPublic},
+			Record:   []*Record{{Name: "www", Type: RecordTypeA, Data: []string{"10.0.0.1"}}},
+			Asserted: c.asserted,
+		}
+		if e := SignRequest(req, "delegate", "delegate"); e != nil {
+			t.Fatal(e)
+		}
+		if e := securityProcessRequest(req); (e == nil) != c.expected {
+			t.Errorf("case %d: %v", i, e)
+		}
+	}
+}
+
+func TestRecordScopedPermissions(t *testing.T) {
+	acme, e := ParsePermission("public,*", "create_record,delete_record;name=_acme-challenge,_acme-challenge.*;type=txt")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(acme.Names) != 2 || len(acme.Types) != 1 || acme.Types[0] != RecordTypeTXT {
+		t.Fatalf("record scope is parsed wrong: %v", acme)
+	}
+	for _, bad := range []string{"create_record;type=XYZ", "create_record;name=[", "create_record;owner=x"} {
+		if _, e := ParsePermission("*", bad); e == nil {
+			t.Errorf("%s is accepted", bad)
+		}
+	}
+	list, _ := ParsePermission("public,*", "list_records")
+	db := &AuthDatabase{"acme": {Token: "acme", Secret: "acme", Permissions: []Permission{acme, list}}}
+	cases := []struct {
+		cmd      Command
+		records  []*Record
+		expected bool
+	}{
+		{CommandCreateRecord, []*Record{{Name: "_acme-challenge.www", Type: RecordTypeTXT}}, true},
+		{CommandCreateRecord, []*Record{{Name: "_acme-challenge", Type: RecordTypeTXT}}, true},
+		{CommandCreateRecord, []*Record{{Name: "_ACME-challenge.a.b", Type: RecordTypeTXT}}, true},
+		{CommandCreateRecord, []*Record{{Name: "www", Type: RecordTypeTXT}}, false},
+		{CommandCreateRecord, []*Record{{Name: "_acme-challenge.www", Type: RecordTypeA}}, false},
+		// every record is checked
+		{CommandDeleteRecord, []*Record{
+			{Name: "_acme-challenge.www", Type: RecordTypeTXT},
+			{Name: "@", Type: RecordTypeTXT},
+		}, false},
+		{CommandReplaceRecord, []*Record{{Name: "_acme-challenge", Type: RecordTypeTXT}}, false},
+		{CommandListRecords, nil, true},
+	}
+	for i, c := range cases {
+		req := &WunderRequest{
+			Auth:   &AuthHeader{Token: "acme"},
+			Cmd:    c.cmd,
+			Domain: &Domain{Name: "example.com", View: DomainViewPublic},
+			Record: c.records,
+		}
+		if db.isPermitted(req) != c.expected {
+			t.Errorf("case %d: expected %v", i, c.expected)
+		}
+	}
+}
+
+func TestDenyPermissions(t *testing.T) {
+	acl := [][2]string{
+		{"*,*.company.net", "*"},
+		{"*,payments.company.net", "deny:*"},
+		{"public,*.payments.company.net", "deny:create_record"},
+		{"public,pay.payments.company.net", "create_record"},
+		{"*,*.company.net", "deny:delete_record;type=NS"},
+		{"*,*.company.net", "delete_record;name=ns*;type=NS"},
+		{"*,*.company.net", "deny:replace_record"},
+		{"*,*.company.net", "replace_record"},
+	}
+	permissions := make([]Permission, 0)
+	for _, l := range acl {
+		p, e := ParsePermission(l[0], l[1])
+		if e != nil {
+			t.Fatal(e)
+		}
+		permissions = append(permissions, p)
+	}
+	if !permissions[1].Deny || permissions[1].String() != "*,payments.company.net=deny:*" {
+		t.Errorf("deny is parsed wrong: %s", permissions[1].String())
+	}
+	db := &AuthDatabase{"t": {Token: "t", Secret: "t", Permissions: permissions}}
+	cases := []struct {
+		cmd      Command
+		domain   string
+		view     DomainView
+		records  []*Record
+		expected bool
+		rule     string
+	}{
+		{CommandCreateRecord, "www.company.net", DomainViewPublic, nil, true, "rule *,*.company.net=*"},
+		{CommandCreateRecord, "payments.company.net", DomainViewPublic, nil, false, "rule *,payments.company.net=deny:*"},
+		{CommandCreateRecord, "a.payments.company.net", DomainViewPublic, nil, false,
+			"rule public,*.payments.company.net=deny:create_record"},
+		{CommandCreateRecord, "a.payments.company.net", DomainViewPrivate, nil, true, "rule *,*.company.net=*"},
+		{CommandCreateRecord, "pay.payments.company.net", DomainViewPublic, nil, true,
+			"rule public,pay.payments.company.net=create_record"},
+		{CommandDeleteRecord, "www.company.net", DomainViewPublic, []*Record{{Name: "www", Type: RecordTypeNS}}, false,
+			"rule *,*.company.net=deny:delete_record;type=NS"},
+		{CommandDeleteRecord, "www.company.net", DomainViewPublic, []*Record{{Name: "ns1", Type: RecordTypeNS}}, true,
+			"rule *,*.company.net=delete_record;name=ns*;type=NS"},
+		{CommandDeleteRecord, "www.company.net", DomainViewPublic, []*Record{{Name: "www", Type: RecordTypeA}}, true,
+			"rule *,*.company.net=*"},
+		// record scoped denies don't apply to requests without records
+		{CommandDeleteRecord, "www.company.net", DomainViewPublic, nil, true,
+			"rule *,*.company.net=delete_record;name=ns*;type=NS"},
+		// deny beats allow of the same specificity
+		{CommandReplaceRecord, "www.company.net", DomainViewPublic, nil, false, "rule *,*.company.net=deny:replace_record"},
+		{CommandCreateRecord, "company.org", DomainViewPublic, nil, false, "no matching rule"},
+	}
+	for i, c := range cases {
+		req := &WunderRequest{
+			Auth:   &AuthHeader{Token: "t"},
+			Cmd:    c.cmd,
+			Domain: &Domain{Name: c.domain, View: c.view},
+			Record: c.records,
+		}
+		if ok, rule := db.checkPermission(req); ok != c.expected || rule != c.rule {
+			t.Errorf("case %d: %v (%s), expected %v (%s)", i, ok, rule, c.expected, c.rule)
+		}
+	}
+}
+
+func TestValidity(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour).UTC().Format(time.RFC3339), now.Add(time.Hour).UTC().Format(time.RFC3339)
+	expired, e := ParsePermission("*", "create_record;expires="+past)
+	if e != nil {
+		t.Fatal(e)
+	}
+	soon, e := ParsePermission("*", "delete_record;not_before=2020-01-01;expires="+future)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := ParsePermission("*", "create_record;not_before=2021-01-01;expires=2020-01-01"); e == nil {
+		t.Error("not_before after expires is accepted")
+	}
+	if _, e := ParsePermission("*", "create_record;expires=tomorrow"); e == nil {
+		t.Error("bad time is accepted")
+	}
+	db := &AuthDatabase{
+		"t": {Token: "t", Secret: "t", Permissions: []Permission{expired, soon}},
+		"old": {Token: "old", Secret: "old", Expires: now.Add(-time.Minute),
+			Permissions: []Permission{{Domain: Domain{Name: "*", View: DomainViewAny}, Permitted: []Command{CommandAny}}}},
+	}
+	for cmd, expected := range map[Command]bool{CommandCreateRecord: false, CommandDeleteRecord: true} {
+		req := &WunderRequest{Auth: &AuthHeader{Token: "t"}, Cmd: cmd, Domain: &Domain{Name: "a.com", View: DomainViewPublic}}
+		if db.isPermitted(req) != expected {
+			t.Errorf("%s: expected %v", cmd, expected)
+		}
+	}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	req := &WunderRequest{Cmd: CommandListDomains, Domain: &Domain{Name: "*", View: DomainViewPublic}}
+	if e := SignRequest(req, "old", "old"); e != nil {
+		t.Fatal(e)
+	}
+	if db.checkAuthentication(req) {
+		t.Error("expired token is authenticated")
+	}
+	if warnings := db.expiringSoon(now, 2*time.Hour); len(warnings) != 1 {
+		t.Errorf("expiring permission isn't reported: %v", warnings)
+	}
+	info, e := getTokenInfo(&WunderRequest{Auth: &AuthHeader{Token: "t"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(info.Permissions) != 2 || info.Permissions[0].Valid || !info.Permissions[1].Valid {
+		t.Errorf("token info is wrong: %v", info.Permissions)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	if _, e := ParseNetworks("10.0.0.0/8, bad"); e == nil {
+		t.Error("bad network is accepted")
+	}
+	networks, e := ParseNetworks("10.0.0.0/8, 192.168.1.10,2001:db8::/32")
+	if e != nil || len(networks) != 3 {
+		t.Fatalf("networks are parsed wrong: %v %v", networks, e)
+	}
+	a := AuthData{Token: "net", Secret: "net", AllowFrom: networks}
+	cases := []struct {
+		origin   string
+		version  int
+		expected bool
+	}{
+		{"10.1.2.3", SignatureV2, true},
+		{"192.168.1.10", SignatureV2, true},
+		{"192.168.1.11", SignatureV2, false},
+		{"2001:db8::1", SignatureEd25519, true},
+		{"", SignatureV2, false},
+		{"10.1.2.3", 0, false}, // legacy signatures don't cover the address
+	}
+	for i, c := range cases {
+		req := &WunderRequest{Auth: &AuthHeader{Token: "net", Version: c.version}, Origin: c.origin}
+		if e := a.checkOrigin(req); (e == nil) != c.expected {
+			t.Errorf("case %d: %v", i, e)
+		}
+	}
+	if e := (AuthData{}).checkOrigin(&WunderRequest{Auth: &AuthHeader{}}); e != nil {
+		t.Errorf("unrestricted token: %v", e)
+	}
+}
+
+func TestAllowFromRecordWrites(t *testing.T) {
+	networks, _ := ParseNetworks("192.0.2.0/24")
+	globalConfig.Auth = &AuthDatabase{
+		"net": {
+			Token:     "net",
+			Secret:    "net",
+			AllowFrom: networks,
+			Permissions: []Permission{
+				{Domain: Domain{Name: "*", View: DomainViewAny}, Permitted: []Command{CommandAny}},
+			},
+		},
+	}
+	defer func() { globalConfig.Auth = authdb }()
+	for _, cmd := range []Command{CommandCreateRecord, CommandReplaceRecord, CommandDeleteRecord} {
+		for origin, expected := range map[string]bool{"192.0.2.10": true, "198.51.100.10": false, "": false} {
+			req := &WunderRequest{
+				Cmd:    cmd,
+				Domain: &Domain{Name: "example.com", View: DomainViewPublic},
+				Record: []*Record{{Name: "www", Type: RecordTypeA, Data: []string{"10.0.0.1"}}},
+				Origin: origin,
+			}
+			if e := SignRequest(req, "net", "net"); e != nil {
+				t.Fatal(e)
+			}
+			if e := securityProcessRequest(req); (e == nil) != expected {
+				t.Errorf("%s from %q: %v", cmd, origin, e)
+			}
+		}
+	}
+}
+
+// signV1 sets a legacy signature of the producer on the request
+func signV1(req *WunderRequest, token, secret string) {
+	x := sha256.Sum256([]byte(secret + "@" + createVariodicHash(req, 0)))
+	req.Auth = &AuthHeader{Token: token, Sum: fmt.Sprintf("%0x", x)}
+}
+
+func TestExplicitCommands(t *testing.T) {
+	all := Permission{Domain: Domain{Name: "*", View: DomainViewAny}, Permitted: []Command{CommandAny}}
+	replicas := Permission{Domain: Domain{Name: "*", View: DomainViewAny},
+		Permitted: []Command{CommandCheckReplicas, CommandRepairReplica}}
+	db := &AuthDatabase{
+		"root": {Token: "root", Secret: "root", Permissions: []Permission{all}},
+		"ops":  {Token: "ops", Secret: "ops", Permissions: []Permission{replicas}},
+	}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	for _, cmd := range []Command{CommandCheckReplicas, CommandRepairReplica} {
+		request := func() *WunderRequest {
+			return &WunderRequest{Cmd: cmd, Domain: &Domain{Name: "example.com", View: DomainViewPublic}}
+		}
+		// `*` doesn't give replica commands
+		req := request()
+		if e := SignRequest(req, "root", "root"); e != nil {
+			t.Fatal(e)
+		}
+		if e := securityProcessRequest(req); e == nil {
+			t.Errorf("%s is allowed by *", cmd)
+		}
+		req = request()
+		if e := SignRequest(req, "ops", "ops"); e != nil {
+			t.Fatal(e)
+		}
+		if e := securityProcessRequest(req); e != nil {
+			t.Errorf("%s: %v", cmd, e)
+		}
+		// a legacy signature is good, the command is refused anyway
+		req = request()
+		signV1(req, "ops", "ops")
+		if !db.checkAuthentication(req) {
+			t.Fatalf("%s: v1 signature is rejected", cmd)
+		}
+		if e := securityProcessRequest(req); e == nil {
+			t.Errorf("%s is allowed with a v1 signature", cmd)
+		}
+	}
+}
@@ -14,32 +14,56 @@
 package wunderdns
 
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/go-ini/ini.v1"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var globalConfig = new(Config)
 
+// loadingConfig is the one sections are parsed to: globalConfig at start, a new one on reload
+var loadingConfig = globalConfig
+
+// configPath is the main configuration file, loadedFiles - it & its includes with modification times
+var configPath string
+var loadedFiles = make(map[string]time.Time)
+
+// includeErrors are errors of included files, a reload fails on them
+var includeErrors []error
+
 var configMap = map[string]func(*ini.Section){
 	"amqp":             amqpSection,
 	"auth":             authSection,
+	"health":           healthSection,
+	"pgqueue":          pgqueueSection,
+	"scheduler":        schedulerSection,
 	"psql":             psqlSection,
+	"reconcile":        reconcileSection,
+	"security":         securitySection,
+	"tokenstore":       tokenStoreSection,
 	"vault":            vaultSection,
+	"reload":           reloadSection,
 	ini.DefaultSection: defaultSection,
 }
 
 func NewConfig(configFile string) {
 	configMap["include"] = includeSection
+	configPath = configFile
 	if e := parseConfigFile(configFile); e != nil {
 		logging.Fatal("Can't load configuration file: ", e.Error())
 	}
 }
 
 func parseConfigFile(configFile string) error {
-	if globalConfig == nil {
-		globalConfig = new(Config)
+	if loadingConfig == nil {
+		loadingConfig = new(Config)
+	}
+	if st, e := os.Stat(configFile); e == nil {
+		loadedFiles[configFile] = st.ModTime()
 	}
 	if f, e := ini.Load(configFile); e == nil {
 		for k, fu := range configMap {
@@ -61,6 +85,7 @@ func includeSection(s *ini.Section) {
 			logging.Debug("Including new filename: ", fileName)
 			if e := parseConfigFile(fileName); e != nil {
 				logging.Error("Can't load (included) configuration file: ", e.Error())
+				includeErrors = append(includeErrors, errors.New(fileName+": "+e.Error()))
 			}
 		}
 	}
@@ -68,8 +93,8 @@ func includeSection(s *ini.Section) {
 
 // config sample
 func vaultSection(s *ini.Section) {
-	if globalConfig.Vault == nil {
-		globalConfig.Vault = &VaultData{
+	if loadingConfig.Vault == nil {
+		loadingConfig.Vault = &VaultData{
 			Enabled: false,
 			URL:     "",
 			Token:   "",
@@ -80,23 +105,171 @@ func vaultSection(s *ini.Section) {
 		return
 	}
 	if k, e := s.GetKey("enable"); e == nil {
-		if globalConfig.Vault.Enabled, e = k.Bool(); e == nil && globalConfig.Vault.Enabled {
+		if loadingConfig.Vault.Enabled, e = k.Bool(); e == nil && loadingConfig.Vault.Enabled {
 			logging.Debug("[vault] vault auth integration have been enabled")
 		}
 	}
 	if k, e := s.GetKey("url"); e == nil {
-		globalConfig.Vault.URL = k.String()
+		loadingConfig.Vault.URL = k.String()
 	}
 	if k, e := s.GetKey("token"); e == nil {
-		globalConfig.Vault.Token = k.String()
+		loadingConfig.Vault.Token = k.String()
 	}
 	if k, e := s.GetKey("ttl"); e == nil {
-		if globalConfig.Vault.TTL, e = k.Duration(); e != nil {
-			globalConfig.Vault.TTL = 10 * time.Minute
+		if loadingConfig.Vault.TTL, e = k.Duration(); e != nil {
+			loadingConfig.Vault.TTL = 10 * time.Minute
+		}
+		logging.Debug("[vault] vault refresh time is set to ", loadingConfig.Vault.TTL.Seconds(), " seconds")
+	}
+	v := loadingConfig.Vault
+	if k, e := s.GetKey("kv_version"); e == nil {
+		if i, e := k.Int(); e == nil && (i == 1 || i == 2) {
+			v.KVVersion = i
+		} else {
+			logging.Warning("[vault] kv_version must be 1 or 2")
+		}
+	}
+	if k, e := s.GetKey("mount"); e == nil {
+		v.Mount = k.String()
+	}
+	if k, e := s.GetKey("auth"); e == nil {
+		switch k.String() {
+		case vaultAuthToken, vaultAuthAppRole, vaultAuthKubernetes:
+			v.Auth = k.String()
+		default:
+			logging.Warning("[vault] unknown auth ", k.String(), ", token is used")
+		}
+	}
+	if k, e := s.GetKey("auth_path"); e == nil {
+		v.AuthPath = k.String()
+	}
+	if k, e := s.GetKey("role_id"); e == nil {
+		v.RoleId = k.String()
+	}
+	if k, e := s.GetKey("secret_id"); e == nil {
+		v.SecretId = k.String()
+	}
+	if k, e := s.GetKey("role"); e == nil {
+		v.Role = k.String()
+	}
+	if k, e := s.GetKey("jwt_file"); e == nil {
+		v.JWTFile = k.String()
+	}
+	if k, e := s.GetKey("ca_file"); e == nil {
+		v.CAFile = k.String()
+	}
+	if k, e := s.GetKey("insecure"); e == nil {
+		if v.Insecure = k.MustBool(false); v.Insecure {
+			logging.Warning("[vault] tls certificate of vault is not verified")
 		}
-		logging.Debug("[vault] vault refresh time is set to ", globalConfig.Vault.TTL.Seconds(), " seconds")
 	}
+}
 
+func schedulerSection(s *ini.Section) {
+	if loadingConfig.Scheduler == nil {
+		loadingConfig.Scheduler = &SchedulerConfig{
+			Workers: defaultSchedulerWorkers,
+			Limits:  make(map[int]int),
+		}
+	}
+	for _, k := range s.Keys() {
+		if k.Name() == "workers" {
+			if i, e := k.Int(); e == nil && i > 0 {
+				loadingConfig.Scheduler.Workers = i
+			}
+			continue
+		}
+		// limit.<priority>=<max concurrent requests>
+		if strings.HasPrefix(k.Name(), "limit.") {
+			p, e1 := strconv.Atoi(strings.TrimPrefix(k.Name(), "limit."))
+			i, e2 := k.Int()
+			if e1 != nil || e2 != nil || i < 1 {
+				logging.Warning("[scheduler] invalid limit ", k.Name(), "=", k.String())
+				continue
+			}
+			loadingConfig.Scheduler.Limits[p] = i
+		}
+	}
+}
+
+func reconcileSection(s *ini.Section) {
+	if loadingConfig.Reconcile == nil { // included files add to it
+		loadingConfig.Reconcile = &ReconcileConfig{
+			Sources: make(map[DomainView]string),
+		}
+	}
+	if k, e := s.GetKey("interval"); e == nil {
+		if d, e := k.Duration(); e == nil {
+			loadingConfig.Reconcile.Interval = d
+		}
+	}
+	// source.<view>=<psql section name>
+	for _, k := range s.Keys() {
+		if strings.HasPrefix(k.Name(), "source.") {
+			loadingConfig.Reconcile.Sources[DomainView(strings.TrimPrefix(k.Name(), "source."))] = k.String()
+		}
+	}
+}
+
+func securitySection(s *ini.Section) {
+	c := defaultSecurityConfig
+	if loadingConfig.Security != nil { // included files add to it
+		c = *loadingConfig.Security
+	}
+	if k, e := s.GetKey("allow_v1"); e == nil {
+		if x, e := k.Bool(); e == nil {
+			c.AllowV1 = x
+		}
+	}
+	if k, e := s.GetKey("v1_skew"); e == nil {
+		if d, e := k.Duration(); e == nil && d >= 0 {
+			c.V1Skew = d
+		}
+	}
+	if k, e := s.GetKey("clock_skew"); e == nil {
+		if d, e := k.Duration(); e == nil && d > 0 {
+			c.ClockSkew = d
+		}
+	}
+	if k, e := s.GetKey("expiry_warning"); e == nil {
+		if d, e := k.Duration(); e == nil && d >= 0 {
+			c.ExpiryWarning = d
+		}
+	}
+	if k, e := s.GetKey("nonce_database"); e == nil {
+		c.NonceDatabase = k.String()
+	}
+	loadingConfig.Security = &c
+}
+
+func tokenStoreSection(s *ini.Section) {
+	if !s.HasKey("database") {
+		return
+	}
+	c := &TokenStoreConfig{
+		Database: s.Key("database").String(),
+		Refresh:  time.Minute,
+	}
+	if k, e := s.GetKey("refresh"); e == nil {
+		if d, e := k.Duration(); e == nil && d > 0 {
+			c.Refresh = d
+		}
+	}
+	loadingConfig.TokenStore = c
+}
+
+func reloadSection(s *ini.Section) {
+	if k, e := s.GetKey("watch"); e == nil {
+		if d, e := k.Duration(); e == nil && d >= 0 {
+			loadingConfig.ReloadWatch = d
+		}
+	}
+}
+
+func healthSection(s *ini.Section) {
+	if k, e := s.GetKey("listen"); e == nil {
+		loadingConfig.Health = k.String()
+	}
 }
 
 func defaultSection(s *ini.Section) {
@@ -114,9 +287,9 @@ func defaultSection(s *ini.Section) {
 func authSection(s *ini.Section) {
 	authDataLock.Lock()
 	defer authDataLock.Unlock()
-	if globalConfig.Auth == nil {
+	if loadingConfig.Auth == nil {
 		v := make(AuthDatabase)
-		globalConfig.Auth = &v
+		loadingConfig.Auth = &v
 	}
 	for _, sub := range s.ChildSections() {
 		a := AuthData{
@@ -124,10 +297,67 @@ func authSection(s *ini.Section) {
 			Permissions: make([]Permission, 0),
 			isVault:     false,
 		}
+		if sub.HasKey("public_key") {
+			k, e := parsePublicKey(sub.Key("public_key").String())
+			if e != nil {
+				logging.Warning("[auth] ", a.Token, ": ", e.Error())
+				continue
+			}
+			a.PublicKey = k
+			sub.DeleteKey("public_key")
+		}
+		if sub.HasKey("certificate") {
+			a.Certificates = parseCertificateNames(sub.Key("certificate").String())
+			sub.DeleteKey("certificate")
+		}
+		if sub.HasKey("delegate") {
+			a.Delegate = sub.Key("delegate").MustBool(false)
+			sub.DeleteKey("delegate")
+		}
+		if sub.HasKey("admin") {
+			a.Admin = sub.Key("admin").MustBool(false)
+			sub.DeleteKey("admin")
+		}
+		if sub.HasKey("allow_from") {
+			n, e := ParseNetworks(sub.Key("allow_from").String())
+			if e != nil || len(n) == 0 {
+				// never open a restricted token to everyone
+				logging.Warning("[auth] ", a.Token, ": allow_from has no valid networks, the token is skipped")
+				continue
+			}
+			a.AllowFrom = n
+			sub.DeleteKey("allow_from")
+		}
+		valid := true
+		for _, k := range []string{"not_before", "expires"} {
+			if sub.HasKey(k) {
+				if e := setValidity(k, sub.Key(k).String(), &a.NotBefore, &a.Expires); e != nil {
+					logging.Warning("[auth] ", a.Token, ": ", e.Error())
+					valid = false
+				}
+				sub.DeleteKey(k)
+			}
+		}
+		if !valid {
+			continue
+		}
 		if sub.HasKey("secret") {
 			a.Secret = sub.Key("secret").String()
 			sub.DeleteKey("secret")
-		} else {
+		}
+		// more secrets, accepted during rotation
+		for _, k := range sub.Keys() {
+			if !strings.HasPrefix(k.Name(), "secret.") {
+				continue
+			}
+			if secret, e := ParseSecret(k.String()); e != nil {
+				logging.Warning("[auth] ", a.Token, ": ", k.Name(), ": ", e.Error())
+			} else {
+				a.addSecret(secret)
+			}
+			sub.DeleteKey(k.Name())
+		}
+		if a.Secret == "" && len(a.Secrets) == 0 && a.PublicKey == nil {
 			continue
 		}
 		if sub.HasKey("priority") {
@@ -136,40 +366,34 @@ func authSection(s *ini.Section) {
 				continue
 			}
 		}
+		if sub.HasKey("children") {
+			a.Children = sub.Key("children").MustInt(0)
+			sub.DeleteKey("children")
+		}
 		for _, k := range sub.Keys() {
-			d := strings.Split(k.Name(), ",")
-			c := strings.Split(k.String(), ",")
-			p := Permission{
-				Domain:    Domain{},
-				Permitted: make([]Command, 0),
-			}
-			if len(d) == 1 {
-				p.Domain.View = DomainViewAny
-				p.Domain.Name = d[0]
-			} else if len(d) == 2 {
-				p.Domain.View = DomainView(d[0])
-				p.Domain.Name = d[1]
-				if x, ok := domainViews[p.Domain.View]; !(ok && x) {
-					continue // bad type
-				}
-			}
-			for _, v := range c {
-				if x, ok := commands[Command(v)]; ok && x {
-					p.Permitted = append(p.Permitted, Command(v))
-				}
+			if p, e := ParsePermission(k.Name(), k.String()); e == nil {
+				a.Permissions = append(a.Permissions, p)
+			} else {
+				logging.Warning("[auth] ", a.Token, ": ", e.Error())
 			}
-			a.Permissions = append(a.Permissions, p)
 		}
-		(*globalConfig.Auth)[a.Token] = a
+		applyStoredSecrets(&a)
+		(*loadingConfig.Auth)[a.Token] = a
 	}
 }
 
 func amqpSection(s *ini.Section) {
-	if globalConfig.AMQPConfigs == nil {
-		globalConfig.AMQPConfigs = make([]*AMQPConfig, 0)
+	if loadingConfig.AMQPConfigs == nil {
+		loadingConfig.AMQPConfigs = make([]*AMQPConfig, 0)
 	}
 	for _, sub := range s.ChildSections() {
-		a := AMQPConfig{}
+		a := AMQPConfig{
+			Name:              sub.Name(),
+			MaxRetries:        3,
+			RetryDelay:        5 * time.Second,
+			ReconnectMinDelay: time.Second,
+			ReconnectMaxDelay: time.Minute,
+		}
 		if sub.HasKey("url") {
 			a.URL = sub.Key("url").String()
 		} else {
@@ -180,16 +404,124 @@ func amqpSection(s *ini.Section) {
 		} else {
 			continue // no exchange - no amqp
 		}
-		globalConfig.AMQPConfigs = append(globalConfig.AMQPConfigs, &a)
+		if sub.HasKey("queue") {
+			a.Queue = sub.Key("queue").String()
+		}
+		if k, e := sub.GetKey("prefetch"); e == nil {
+			if i, e := k.Int(); e == nil && i > 0 {
+				a.Prefetch = i
+			}
+		}
+		if k, e := sub.GetKey("max_retries"); e == nil {
+			if i, e := k.Int(); e == nil && i >= 0 {
+				a.MaxRetries = i
+			}
+		}
+		if k, e := sub.GetKey("retry_delay"); e == nil {
+			if d, e := k.Duration(); e == nil {
+				a.RetryDelay = d
+			}
+		}
+		if sub.HasKey("dead_letter_exchange") {
+			a.DeadLetterExchange = sub.Key("dead_letter_exchange").String()
+		}
+		reconnectPolicy(sub, &a.ReconnectAttempts, &a.ReconnectMinDelay, &a.ReconnectMaxDelay)
+		if k, e := sub.GetKey("max_priority"); e == nil {
+			if i, e := k.Int(); e == nil && i >= 0 && i <= 255 {
+				a.MaxPriority = i
+			}
+		}
+		loadingConfig.AMQPConfigs = append(loadingConfig.AMQPConfigs, &a)
+	}
+}
+
+// reconnectPolicy reads reconnect_* keys of a consumer section, defaults are kept
+func reconnectPolicy(sub *ini.Section, attempts *int, minDelay, maxDelay *time.Duration) {
+	if k, e := sub.GetKey("reconnect_attempts"); e == nil {
+		if i, e := k.Int(); e == nil && i >= 0 {
+			*attempts = i
+		}
+	}
+	if k, e := sub.GetKey("reconnect_min_delay"); e == nil {
+		if d, e := k.Duration(); e == nil && d > 0 {
+			*minDelay = d
+		}
+	}
+	if k, e := sub.GetKey("reconnect_max_delay"); e == nil {
+		if d, e := k.Duration(); e == nil && d > 0 {
+			*maxDelay = d
+		}
+	}
+	if *maxDelay < *minDelay {
+		*maxDelay = *minDelay
+	}
+}
+
+func pgqueueSection(s *ini.Section) {
+	if loadingConfig.PGQueues == nil {
+		loadingConfig.PGQueues = make([]*PGQueueConfig, 0)
+	}
+	for _, sub := range s.ChildSections() {
+		a := PGQueueConfig{
+			Name:              sub.Name(),
+			Table:             "wunderdns_queue",
+			Channel:           "wunderdns",
+			Workers:           4,
+			PollInterval:      5 * time.Second,
+			StaleTimeout:      5 * time.Minute,
+			MaxRetries:        3,
+			RetryDelay:        5 * time.Second,
+			ReconnectMinDelay: time.Second,
+			ReconnectMaxDelay: time.Minute,
+		}
+		if sub.HasKey("url") {
+			a.URL = sub.Key("url").String()
+		} else {
+			logging.Warning(sub.Name(), " has no `url` - skipping")
+			continue
+		}
+		if sub.HasKey("table") {
+			a.Table = sub.Key("table").String()
+		}
+		if sub.HasKey("channel") {
+			a.Channel = sub.Key("channel").String()
+		}
+		if k, e := sub.GetKey("workers"); e == nil {
+			if i, e := k.Int(); e == nil && i > 0 {
+				a.Workers = i
+			}
+		}
+		if k, e := sub.GetKey("poll"); e == nil {
+			if d, e := k.Duration(); e == nil && d > 0 {
+				a.PollInterval = d
+			}
+		}
+		if k, e := sub.GetKey("stale"); e == nil {
+			if d, e := k.Duration(); e == nil && d > 0 {
+				a.StaleTimeout = d
+			}
+		}
+		if k, e := sub.GetKey("max_retries"); e == nil {
+			if i, e := k.Int(); e == nil && i >= 0 {
+				a.MaxRetries = i
+			}
+		}
+		if k, e := sub.GetKey("retry_delay"); e == nil {
+			if d, e := k.Duration(); e == nil {
+				a.RetryDelay = d
+			}
+		}
+		reconnectPolicy(sub, &a.ReconnectAttempts, &a.ReconnectMinDelay, &a.ReconnectMaxDelay)
+		loadingConfig.PGQueues = append(loadingConfig.PGQueues, &a)
 	}
 }
 
 func psqlSection(s *ini.Section) {
-	if globalConfig.PSQLConfigs == nil {
-		globalConfig.PSQLConfigs = make([]*PSQLConfig, 0)
+	if loadingConfig.PSQLConfigs == nil {
+		loadingConfig.PSQLConfigs = make([]*PSQLConfig, 0)
 	}
 	for _, sub := range s.ChildSections() {
-		a := PSQLConfig{SSL: false}
+		a := PSQLConfig{SSL: false, Name: strings.TrimPrefix(sub.Name(), s.Name()+".")}
 		if k, e := sub.GetKey("host"); e == nil {
 			a.Host = k.String()
 		} else {
@@ -243,7 +575,7 @@ func psqlSection(s *ini.Section) {
 				a.SSL = x
 			}
 		}
-		globalConfig.PSQLConfigs = append(globalConfig.PSQLConfigs, &a)
+		loadingConfig.PSQLConfigs = append(loadingConfig.PSQLConfigs, &a)
 	}
 
 }
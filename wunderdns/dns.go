@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"github.com/asaskevich/govalidator"
 	"net"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -32,6 +34,7 @@ var checkers = map[RecordType]func(*Record) error{
 	RecordTypeNS:    checkRecordTypeNS,
 	RecordTypeSOA:   checkRecordTypeSOA,
 	RecordTypePTR:   checkRecordTypePTR,
+	RecordTypeCAA:   checkRecordTypeCAA,
 }
 
 func (d *Domain) record2dns(r *Record) string {
@@ -278,3 +281,140 @@ func checkRecordTypePTR(r *Record) error {
 	}
 	return nil
 }
+
+const (
+	caaFlagCritical = 128
+	caaTagIssue     = "issue"
+	caaTagIssueWild = "issuewild"
+	caaTagIodef     = "iodef"
+)
+
+var (
+	caaTagRegexp       = regexp.MustCompile(`^[A-Za-z0-9]{1,15}$`)
+	caaIssuerRegexp    = regexp.MustCompile(`^[A-Za-z0-9](-*[A-Za-z0-9])*(\.[A-Za-z0-9](-*[A-Za-z0-9])*)*$`)
+	caaParameterRegexp = regexp.MustCompile(`^[A-Za-z0-9]+[ \t]*=[ \t]*[\x21-\x3A\x3C-\x7E]*$`)
+)
+
+// checkRecordTypeCAA validates `<flags> <tag> "<value>"` ( RFC 8659 ) and brings data to the form
+// PowerDNS keeps: single spaces, lowercase tag & quoted value ( quotes & backslashes escaped )
+func checkRecordTypeCAA(r *Record) error {
+	if len(r.Data) == 0 {
+		return errors.New("CAA record must have at least one argument")
+	}
+	for i, d := range r.Data {
+		parts := strings.Fields(d)
+		if len(parts) < 3 {
+			return errors.New("CAA record data must match `flags tag \"value\"` pattern")
+		}
+		// only the issuer critical flag is defined, reserved bits must be clear
+		flags, e := strconv.Atoi(parts[0])
+		if e != nil || flags != 0 && flags != caaFlagCritical {
+			return errors.New("CAA record data(flags) must be 0 or 128")
+		}
+		if !caaTagRegexp.MatchString(parts[1]) {
+			return errors.New("CAA record data(tag) must be 1-15 letters & digits")
+		}
+		tag := strings.ToLower(parts[1])
+		// the value is the rest, as is: whitespace inside quotes is a part of it
+		value := strings.TrimSpace(d)
+		value = strings.TrimSpace(value[len(parts[0]):])
+		value = strings.TrimSpace(value[len(parts[1]):])
+		if strings.HasPrefix(value, "\"") {
+			if value, e = unquoteCAAValue(value); e != nil {
+				return e
+			}
+		} else if strings.ContainsAny(value, " \t") {
+			return errors.New("CAA record data(value) must be quoted if it has spaces")
+		} else if strings.ContainsAny(value, "\"\\") {
+			return errors.New("CAA record data(value) must be quoted if it has quotes or backslashes")
+		}
+		if !govalidator.IsPrintableASCII(value) {
+			return errors.New("CAA record data(value) must be printable ascii")
+		}
+		switch tag {
+		case caaTagIssue, caaTagIssueWild:
+			e = checkCAAIssueValue(value)
+		case caaTagIodef:
+			e = checkCAAIodefValue(value)
+		} // other tags are allowed with any value, CAs must ignore them unless they're critical
+		if e != nil {
+			return e
+		}
+		r.Data[i] = fmt.Sprintf("%d %s \"%s\"", flags, tag, caaValueEscaper.Replace(value))
+	}
+	return nil
+}
+
+var caaValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+// unquoteCAAValue takes the value out of quotes: `\X` is X, `\DDD` is the octet of decimal DDD ( RFC 1035 )
+func unquoteCAAValue(quoted string) (string, error) {
+	ret := new(strings.Builder)
+	for i := 1; i < len(quoted); i++ {
+		switch c := quoted[i]; c {
+		case '"':
+			if strings.TrimSpace(quoted[i+1:]) != "" {
+				return "", errors.New("CAA record data(value) has data after the closing quote")
+			}
+			return ret.String(), nil
+		case '\\':
+			if i++; i == len(quoted) {
+				return "", errors.New("CAA record data(value) has no closing quote")
+			}
+			if quoted[i] >= '0' && quoted[i] <= '9' {
+				if i+3 > len(quoted) {
+					return "", errors.New("CAA record data(value) has a bad \\DDD escape")
+				}
+				n, e := strconv.Atoi(quoted[i : i+3])
+				if e != nil || n > 255 {
+					return "", errors.New("CAA record data(value) has a bad \\DDD escape")
+				}
+				ret.WriteByte(byte(n))
+				i += 2
+			} else {
+				ret.WriteByte(quoted[i])
+			}
+		default:
+			ret.WriteByte(c)
+		}
+	}
+	return "", errors.New("CAA record data(value) has no closing quote")
+}
+
+// checkCAAIssueValue validates `[issuer-domain-name][; parameter=value[; ...]]`, an empty issuer forbids issuance
+func checkCAAIssueValue(value string) error {
+	parts := strings.Split(value, ";")
+	if issuer := strings.Trim(parts[0], " \t"); issuer != "" && !caaIssuerRegexp.MatchString(issuer) {
+		return errors.New(fmt.Sprintf("CAA record data(value): %s is not a valid issuer domain name", issuer))
+	}
+	if len(parts) == 2 && strings.Trim(parts[1], " \t") == "" {
+		return nil // `issuer;`
+	}
+	for _, p := range parts[1:] {
+		if !caaParameterRegexp.MatchString(strings.Trim(p, " \t")) {
+			return errors.New(fmt.Sprintf("CAA record data(value): `%s` is not a valid parameter", p))
+		}
+	}
+	return nil
+}
+
+// checkCAAIodefValue validates the url incident reports are sent to: mailto, http or https
+func checkCAAIodefValue(value string) error {
+	u, e := url.Parse(value)
+	if e != nil {
+		return errors.New("CAA record data(value) must be an url: " + e.Error())
+	}
+	switch u.Scheme {
+	case "mailto":
+		if !govalidator.IsEmail(u.Opaque) {
+			return errors.New("CAA record data(value) must be a valid mailto: url")
+		}
+	case "http", "https":
+		if u.Host == "" {
+			return errors.New("CAA record data(value) must be a valid http(s) url")
+		}
+	default:
+		return errors.New("CAA record data(value) must be a mailto:, http: or https: url")
+	}
+	return nil
+}
@@ -205,6 +205,71 @@ func TestCheckRecordTypeTXT(t *testing.T) {
 	}
 }
 
+func TestCheckRecordTypeCAA(t *testing.T) {
+	valid := map[string]string{
+		`0 issue "letsencrypt.org"`:                                 `0 issue "letsencrypt.org"`,
+		`0 ISSUE letsencrypt.org`:                                   `0 issue "letsencrypt.org"`,
+		`128 issuewild ";"`:                                         `128 issuewild ";"`,
+		`0 issue "ca.example.net; account=230123; policy=ev"`:       `0 issue "ca.example.net; account=230123; policy=ev"`,
+		`0 issue "ca.example.net;"`:                                 `0 issue "ca.example.net;"`,
+		`0 iodef "mailto:security@example.com"`:                     `0 iodef "mailto:security@example.com"`,
+		`0 iodef "https://iodef.example.com/"`:                      `0 iodef "https://iodef.example.com/"`,
+		`0 contactemail "domain@example.com"`:                       `0 contactemail "domain@example.com"`,
+		`0 tbs "Unknown tags are allowed with any printable value"`: `0 tbs "Unknown tags are allowed with any printable value"`,
+		// repeated whitespace between fields, kept inside the value
+		`0  issue   "letsencrypt.org"`:     `0 issue "letsencrypt.org"`,
+		"128\tissue\t\"letsencrypt.org\" ": `128 issue "letsencrypt.org"`,
+		` 0 tbs "two  spaces"`:             `0 tbs "two  spaces"`,
+		`0 issue  letsencrypt.org`:         `0 issue "letsencrypt.org"`,
+		// escapes inside the quoted value
+		`0 tbs "with \"quotes\""`: `0 tbs "with \"quotes\""`,
+		`0 tbs "back\\slash"`:     `0 tbs "back\\slash"`,
+		`0 tbs "\065\066C"`:       `0 tbs "ABC"`,
+	}
+	for d, expected := range valid {
+		r := &Record{Type: "CAA", Data: []string{d}}
+		if e := checkRecordTypeCAA(r); e != nil || r.Data[0] != expected {
+			t.Errorf("%s checker failed on %s: %v, %s", r.Type, d, e, r.Data[0])
+		}
+	}
+	invalid := []string{
+		`0 issue`,
+		`256 issue "ca.example.net"`,
+		`1 issue "ca.example.net"`,
+		`x issue "ca.example.net"`,
+		`0 is-sue "ca.example.net"`,
+		`0 verylongtagname16 "ca.example.net"`,
+		`0 issue "ca.example.net`,
+		`0 issue ca.example.net; policy=ev`,
+		`0 issue "ca..example.net"`,
+		`0 issue "-ca.example.net"`,
+		`0 issue "ca.example.net; policy"`,
+		`0 issue "ca.example.net; policy=e;v"`,
+		`0 issue "ca.example.net; policy=ev;"`,
+		`0 issue "ca.example.net; pol-icy=ev"`,
+		`0 iodef "security@example.com"`,
+		`0 iodef "mailto:security"`,
+		`0 iodef "ftp://iodef.example.com/"`,
+		`0 iodef "https:///path"`,
+		`0 tbs "non-ascii значение"`,
+		`0 tbs "unterminated \"`,
+		`0 tbs "after" quote`,
+		`0 tbs with"quote`,
+		`0 tbs "bad \06 escape"`,
+		`0 tbs "bad \256 escape"`,
+		`0 tbs "control \009 octet"`,
+		`0 issue "\"letsencrypt.org\""`,
+	}
+	for _, d := range invalid {
+		if e := checkRecordTypeCAA(&Record{Type: "CAA", Data: []string{d}}); e == nil {
+			t.Errorf("CAA checker failed on %s", d)
+		}
+	}
+	if e := checkRecordTypeCAA(&Record{Type: "CAA", Data: []string{}}); e == nil {
+		t.Error("CAA checker failed on empty data")
+	}
+}
+
 func TestCheckRecordTypeSRV(t *testing.T) {
 	// TODO
 }
@@ -0,0 +1,209 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// tokens & permission lines may be valid for a period only: `not_before` & `expires`
+// are RFC3339 times or dates ( midnight UTC )
+
+func parseValidityTime(s string) (time.Time, error) {
+	if t, e := time.Parse(time.RFC3339, s); e == nil {
+		return t, nil
+	}
+	if t, e := time.Parse("2006-01-02", s); e == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("bad time " + s + ", RFC3339 or YYYY-MM-DD expected")
+}
+
+func unixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+func validAt(notBefore, expires, now time.Time) bool {
+	if !notBefore.IsZero() && now.Before(notBefore) {
+		return false
+	}
+	return expires.IsZero() || now.Before(expires)
+}
+
+func (a *AuthData) validAt(now time.Time) bool {
+	return validAt(a.NotBefore, a.Expires, now)
+}
+
+func (p *Permission) validAt(now time.Time) bool {
+	return validAt(unixTime(p.NotBefore), unixTime(p.Expires), now)
+}
+
+// setValidity applies `not_before` or `expires` value to the pair
+func setValidity(key, value string, notBefore, expires *time.Time) error {
+	t, e := parseValidityTime(value)
+	if e != nil {
+		return errors.New(key + ": " + e.Error())
+	}
+	if key == "not_before" {
+		*notBefore = t
+	} else {
+		*expires = t
+	}
+	if !notBefore.IsZero() && !expires.IsZero() && !notBefore.Before(*expires) {
+		return errors.New("not_before must be before expires")
+	}
+	return nil
+}
+
+type permissionInfo struct {
+	Rule      string     `json:"rule"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Valid     bool       `json:"valid"`
+}
+
+type secretInfo struct {
+	Id      string     `json:"id"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Active  bool       `json:"active"`
+}
+
+type tokenInfo struct {
+	Token       string           `json:"token"`
+	Subject     string           `json:"subject,omitempty"` // asserted identity
+	NotBefore   *time.Time       `json:"not_before,omitempty"`
+	Expires     *time.Time       `json:"expires,omitempty"`
+	ExpiresIn   string           `json:"expires_in,omitempty"`
+	Delegate    bool             `json:"delegate,omitempty"`
+	Priority    int              `json:"priority"`
+	AllowFrom   []string         `json:"allow_from,omitempty"`
+	Secrets     []secretInfo     `json:"secrets,omitempty"`
+	Permissions []permissionInfo `json:"permissions"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func describePermissions(permissions []Permission, now time.Time) []permissionInfo {
+	ret := make([]permissionInfo, 0, len(permissions))
+	for i := range permissions {
+		p := &permissions[i]
+		ret = append(ret, permissionInfo{
+			Rule:      p.String(),
+			NotBefore: timeOrNil(unixTime(p.NotBefore)),
+			Expires:   timeOrNil(unixTime(p.Expires)),
+			Valid:     p.validAt(now),
+		})
+	}
+	return ret
+}
+
+// getTokenInfo describes the token of the request, asserted identity's permissions instead of delegate's
+func getTokenInfo(request *WunderRequest) (*tokenInfo, error) {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return nil, errors.New("unknown token")
+	}
+	v, ok := (*globalConfig.Auth)[request.Auth.Token]
+	if !ok {
+		return nil, errors.New("unknown token")
+	}
+	now := time.Now()
+	info := &tokenInfo{
+		Token:     v.Token,
+		NotBefore: timeOrNil(v.NotBefore),
+		Expires:   timeOrNil(v.Expires),
+		Delegate:  v.Delegate,
+		Priority:  v.Priority,
+	}
+	for _, n := range v.AllowFrom {
+		info.AllowFrom = append(info.AllowFrom, n.String())
+	}
+	if !v.Expires.IsZero() {
+		info.ExpiresIn = v.Expires.Sub(now).Truncate(time.Second).String()
+	}
+	if request.Asserted != nil {
+		info.Subject = request.Asserted.Subject
+		info.Permissions = describePermissions(request.Asserted.Permissions, now)
+		return info, nil
+	}
+	info.Permissions = describePermissions(v.Permissions, now)
+	for _, s := range v.allSecrets() {
+		if s.Value != "" {
+			info.Secrets = append(info.Secrets, secretInfo{
+				Id:      s.Id,
+				Expires: timeOrNil(s.Expires),
+				Active:  s.Expires.IsZero() || now.Before(s.Expires),
+			})
+		}
+	}
+	return info, nil
+}
+
+// expiringSoon lists tokens & permission lines expiring within the warning period
+func (authDatabase *AuthDatabase) expiringSoon(now time.Time, within time.Duration) []string {
+	ret := make([]string, 0)
+	for token, v := range *authDatabase {
+		if !v.Expires.IsZero() && v.Expires.After(now) && v.Expires.Sub(now) <= within {
+			ret = append(ret, fmt.Sprintf("token %s expires at %s", token, v.Expires.Format(time.RFC3339)))
+		}
+		for _, s := range v.Secrets {
+			if !s.Expires.IsZero() && s.Expires.After(now) && s.Expires.Sub(now) <= within {
+				ret = append(ret, fmt.Sprintf("token %s: secret %s expires at %s", token, s.Id,
+					s.Expires.Format(time.RFC3339)))
+			}
+		}
+		for i := range v.Permissions {
+			p := &v.Permissions[i]
+			expires := unixTime(p.Expires)
+			if !expires.IsZero() && expires.After(now) && expires.Sub(now) <= within {
+				ret = append(ret, fmt.Sprintf("token %s: %s expires at %s", token, p.String(),
+					expires.Format(time.RFC3339)))
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func warnExpiring() {
+	authDataLock.RLock()
+	within := globalConfig.security().ExpiryWarning
+	soon := make([]string, 0)
+	if globalConfig.Auth != nil && within > 0 {
+		soon = globalConfig.Auth.expiringSoon(time.Now(), within)
+	}
+	authDataLock.RUnlock()
+	for _, s := range soon {
+		logging.Warning("[auth] ", s)
+	}
+}
+
+func startExpiryWarnings() {
+	for {
+		warnExpiring()
+		time.Sleep(time.Hour)
+	}
+}
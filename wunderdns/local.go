@@ -0,0 +1,71 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// set once databases are initialized and requests can be processed
+var running int32
+
+const (
+	localMaxRetries = 3
+	localRetryDelay = time.Second
+)
+
+// ProcessRequest runs a signed request through the same pipeline as amqp deliveries
+// ( security, rfc & orm ) in the current process, bypassing any broker; it waits for its turn
+// in the scheduler by priority of the token, like deliveries do
+func ProcessRequest(ctx context.Context, request *WunderRequest) *WunderReply {
+	if atomic.LoadInt32(&running) == 0 {
+		return ReturnError("wunderdns worker is not running in this process")
+	}
+	priority := 0
+	if request.Auth != nil {
+		priority = tokenPriority(request.Auth.Token)
+	}
+	done := make(chan *WunderReply, 1)
+	var attempt func(retries int)
+	attempt = func(retries int) {
+		if ctx.Err() != nil { // nobody waits for it anymore
+			done <- ReturnError("request cancelled")
+			return
+		}
+		reply, result, stage, reason := executeWunderRequest(request)
+		if result != deliveryRetry || retries >= localMaxRetries {
+			done <- reply
+			return
+		}
+		logging.Warning(fmt.Sprintf("[local] transient %s error, retry %d/%d: %s", stage, retries+1,
+			localMaxRetries, reason.Error()))
+		// the retry waits for its turn again, without holding a scheduler worker meanwhile
+		time.AfterFunc(localRetryDelay*time.Duration(retries+1), func() {
+			schedulePriority(priority, func() { attempt(retries + 1) })
+		})
+	}
+	schedulePriority(priority, func() { attempt(0) })
+	select {
+	case reply := <-done:
+		return reply
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ReturnError("request timeout")
+		}
+		return ReturnError("request cancelled")
+	}
+}
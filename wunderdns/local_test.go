@@ -0,0 +1,49 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessRequest(t *testing.T) {
+	req := &WunderRequest{
+		Auth: &AuthHeader{
+			Token: "test",
+			Sum:   "x",
+		},
+		Cmd: CommandListRecords,
+		Domain: &Domain{
+			Name: "test.com",
+			View: DomainViewPublic,
+		},
+	}
+	atomic.StoreInt32(&running, 0)
+	if r := ProcessRequest(context.Background(), req); r.Status != "ERROR" {
+		t.Error("request is processed while worker is not running")
+	}
+	globalConfig.Auth = authdb
+	atomic.StoreInt32(&running, 1)
+	defer atomic.StoreInt32(&running, 0)
+	r := ProcessRequest(context.Background(), req)
+	if r.Status != "ERROR" {
+		t.Error("request with invalid signature is processed")
+	}
+	if m, ok := r.Data.(map[string]string); !ok || !strings.HasPrefix(m["error"], "security:") {
+		t.Errorf("unexpected reply: %v", r.Data)
+	}
+}
@@ -14,12 +14,16 @@
 package wunderdns
 
 import (
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"io"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type domainTable struct {
@@ -78,10 +82,12 @@ type orm struct {
 	config    *PSQLConfig
 	db        *gorm.DB
 	lastError error
+	twoPhase  bool // prepared transactions are available
 }
 
 func ormApplyCommandData(tx *gorm.DB, view DomainView, request *WunderRequest) (data []interface{}, e error) {
 	data = make([]interface{}, 0)
+	owner := request.owner()
 	switch request.Cmd {
 	case CommandListDomains:
 		var domains []domainTable
@@ -152,7 +158,7 @@ func ormApplyCommandData(tx *gorm.DB, view DomainView, request *WunderRequest) (
 	case CommandListRecords, CommandListOwn:
 		var records []RecordsApiTable
 		if request.Cmd == CommandListOwn {
-			tx.Where("owner = ?", request.Auth.Token).Find(&records)
+			tx.Where("owner = ?", request.owner()).Find(&records)
 		} else {
 			var r []RecordsTable
 			var d domainTable
@@ -172,7 +178,7 @@ func ormApplyCommandData(tx *gorm.DB, view DomainView, request *WunderRequest) (
 					Disabled:   _r.Disabled,
 					Ordername:  _r.Ordername,
 					Auth:       _r.Auth,
-					Owner:      &request.Auth.Token,
+					Owner:      &owner,
 				}
 			}
 		}
@@ -247,6 +253,7 @@ func ormApplyCommandData(tx *gorm.DB, view DomainView, request *WunderRequest) (
 }
 
 func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (n int, e error) {
+	owner := request.owner()
 
 	switch request.Cmd {
 	case CommandReplaceOwner:
@@ -269,7 +276,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 			}
 			var recs []RecordsApiTable
 			tx.Where("domain_id = ? and type = ? and name = ? and owner = ?", d.Id, r.Type,
-				recordName, request.Auth.Token).Find(&recs)
+				recordName, request.owner()).Find(&recs)
 			if len(recs) == 0 {
 				return 0, errors.New("replace_owner: record not found")
 			}
@@ -345,7 +352,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 					Prio:     &prio,
 					Disabled: &_disabled,
 					Auth:     &_auth,
-					Owner:    &request.Auth.Token,
+					Owner:    &owner,
 				}).RowsAffected)
 			}
 		}
@@ -369,7 +376,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 			}
 			if r.Data == nil || len(r.Data) == 0 {
 				n += int(tx.Where("domain_id = ? and type = ? and name = ? and owner = ?", d.Id, r.Type,
-					recordName, request.Auth.Token).Delete(&RecordsApiTable{}).RowsAffected)
+					recordName, request.owner()).Delete(&RecordsApiTable{}).RowsAffected)
 			} else {
 				for i := range r.Data {
 					prio := 0
@@ -387,7 +394,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 						Name:     recordName,
 						Type:     string(r.Type),
 						Content:  r.Data[i],
-						Owner:    &request.Auth.Token,
+						Owner:    &owner,
 					}
 					if r.TTL != 0 {
 						dr.Ttl = &r.TTL
@@ -425,7 +432,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 				return 0, errors.New("replace_record: data is empty")
 			}
 			_n := int(tx.Where("domain_id = ? and type = ? and name = ? and owner = ?", d.Id, r.Type,
-				recordName, request.Auth.Token).Delete(&RecordsApiTable{}).RowsAffected)
+				recordName, request.owner()).Delete(&RecordsApiTable{}).RowsAffected)
 			if _n == 0 {
 				return 0, errors.New("replace_record: no such record; create new record instead")
 			} else {
@@ -455,7 +462,7 @@ func ormApplyCommandExec(tx *gorm.DB, view DomainView, request *WunderRequest) (
 						Prio:     &prio,
 						Disabled: &_disabled,
 						Auth:     &_auth,
-						Owner:    &request.Auth.Token,
+						Owner:    &owner,
 					}).RowsAffected)
 				}
 
@@ -492,19 +499,39 @@ func ormUpdateSOA(tx *gorm.DB, domainId uint) error {
 }
 
 var orms = make([]*orm, 0)
+var ormsLock = sync.RWMutex{}
+
+// currentOrms gives databases to work with, the list is replaced on reload
+func currentOrms() []*orm {
+	ormsLock.RLock()
+	defer ormsLock.RUnlock()
+	return orms
+}
+
+func openORM(c *PSQLConfig) (*orm, error) {
+	db, e := gorm.Open(postgres.Open(c.connString()), &gorm.Config{
+		SkipDefaultTransaction: true,
+	})
+	if e != nil {
+		return nil, e
+	}
+	d := &orm{
+		config: c,
+		db:     db,
+	}
+	d.setupTwoPhase()
+	return d, nil
+}
 
 func initORMs() error {
 	for _, c := range globalConfig.PSQLConfigs {
-		db, e := gorm.Open(postgres.Open(c.connString()), &gorm.Config{
-			SkipDefaultTransaction: true,
-		})
+		d, e := openORM(c)
 		if e != nil {
 			return e
 		}
-		orms = append(orms, &orm{
-			config: c,
-			db:     db,
-		})
+		ormsLock.Lock()
+		orms = append(orms, d)
+		ormsLock.Unlock()
 		logging.Info("Found database: ", c.Host)
 	}
 	return nil
@@ -513,7 +540,7 @@ func initORMs() error {
 func ormApplyCommandMerge(request *WunderRequest) (re map[DomainView][]interface{}, e error) {
 	logging.Info("[ormApplyCommandMerge]", request.toString())
 	re = make(map[DomainView][]interface{})
-	for _, d := range orms {
+	for _, d := range currentOrms() {
 		if d.config.View != request.Domain.View && request.Domain.View != DomainViewAny {
 			continue // skip
 		}
@@ -536,21 +563,53 @@ func ormApplyCommandMerge(request *WunderRequest) (re map[DomainView][]interface
 
 func ormApplyCommand(request *WunderRequest) (n int, e error) {
 	logging.Info("[ormApplyCommand]", request.toString())
-	n = 0
-	for _, d := range orms {
+	participants := make([]*orm, 0)
+	twoPhase := true
+	for _, d := range currentOrms() {
 		if d.config.View != request.Domain.View && request.Domain.View != DomainViewAny {
 			continue // skip
 		}
-		e = d.db.Transaction(func(tx *gorm.DB) error {
-			_n, e := ormApplyCommandExec(tx, d.config.View, request)
-			if e == nil {
-				n += _n
-			}
+		participants = append(participants, d)
+		twoPhase = twoPhase && d.twoPhase
+	}
+	switch {
+	case len(participants) == 1:
+		e = participants[0].db.Transaction(func(tx *gorm.DB) error {
+			var e error
+			n, e = ormApplyCommandExec(tx, participants[0].config.View, request)
 			return e
 		})
-		if e != nil {
-			return
-		}
+	case len(participants) > 1 && twoPhase:
+		n, e = ormApplyTwoPhase(participants, request)
+	case len(participants) > 1:
+		n, e = ormApplyCompensating(participants, request)
 	}
 	return
 }
+
+// isTransientError tells if an error is worth retrying ( lost connection, deadlock, etc. )
+// rather than being a definitive answer to the request
+func isTransientError(e error) bool {
+	if e == nil {
+		return false
+	}
+	if errors.Is(e, driver.ErrBadConn) || errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(e, &netErr) {
+		return true
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(e, &pgErr) {
+		switch state := pgErr.SQLState(); {
+		case strings.HasPrefix(state, "08"), // connection exception
+			strings.HasPrefix(state, "40"),  // transaction rollback ( deadlock, serialization )
+			strings.HasPrefix(state, "53"),  // insufficient resources
+			strings.HasPrefix(state, "57P"), // operator intervention ( shutdown )
+			strings.HasPrefix(state, "58"):  // system error
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testSQLStateError string
+
+func (e testSQLStateError) Error() string    { return "sql state " + string(e) }
+func (e testSQLStateError) SQLState() string { return string(e) }
+
+func TestIsTransientError(t *testing.T) {
+	cases := map[error]bool{
+		nil:                            false,
+		errors.New("domain not found"): false,
+		driver.ErrBadConn:              true,
+		fmt.Errorf("begin: %w", driver.ErrBadConn): true,
+		testSQLStateError("40P01"):                 true,  // deadlock
+		testSQLStateError("08006"):                 true,  // connection failure
+		testSQLStateError("23505"):                 false, // unique violation
+	}
+	for e, expected := range cases {
+		if isTransientError(e) != expected {
+			t.Errorf("isTransientError(%v) != %v", e, expected)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// requests are rows of a queue table; workers are woken up by NOTIFY <channel>, id
+// and tell the producer a reply is ready by NOTIFY <channel>_reply, id
+const pgQueueSchema = `CREATE TABLE IF NOT EXISTS %s (
+	id BIGSERIAL PRIMARY KEY,
+	request TEXT NOT NULL,
+	reply TEXT,
+	state VARCHAR(16) NOT NULL DEFAULT 'new',
+	retries INT NOT NULL DEFAULT 0,
+	error TEXT,
+	taken_by VARCHAR(255),
+	created TIMESTAMP NOT NULL DEFAULT now(),
+	updated TIMESTAMP NOT NULL DEFAULT now(),
+	expires TIMESTAMP,
+	lease TIMESTAMP,
+	run_after TIMESTAMP,
+	priority INT NOT NULL DEFAULT 0
+)`
+
+// columns added after the first release, for tables created by it
+var pgQueueMigrations = []string{
+	"ALTER TABLE %s ADD COLUMN IF NOT EXISTS lease TIMESTAMP",
+	"ALTER TABLE %s ADD COLUMN IF NOT EXISTS run_after TIMESTAMP",
+	"ALTER TABLE %s ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0",
+}
+
+const (
+	pgStateNew    = "new"
+	pgStateTaken  = "taken"
+	pgStateDone   = "done"
+	pgStateFailed = "failed"
+)
+
+var pgIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// pgqueue consumers, reported along with amqp ones
+var pgqueues = make(map[string]*pgconsumer)
+
+// pgconsumer is a supervised pgqueue consumer, it outlives connections
+type pgconsumer struct {
+	state       ConsumerState
+	exitChannel chan bool
+	jobs        sync.WaitGroup // scheduled requests, they're finished before the consumer stops
+}
+
+type pgqueue struct {
+	config   *PGQueueConfig
+	db       *sql.DB
+	listener *pq.Listener
+	worker   string
+	slots    chan bool
+	wake     chan bool // a slot is free again
+	consumer *pgconsumer
+}
+
+// setState must be called with queuesLock held
+func (c *pgconsumer) setState(state string, e error) {
+	c.state.set(state, e)
+}
+
+// newPGConsumer registers the consumer before it's started, so it's counted right away
+func newPGConsumer(config *PGQueueConfig) *pgconsumer {
+	c := &pgconsumer{
+		exitChannel: make(chan bool, 2),
+		state: ConsumerState{
+			Name:     config.Name,
+			Exchange: config.Channel,
+			Queue:    config.Table,
+		},
+	}
+	queuesLock.Lock()
+	c.setState(ConsumerConnecting, nil)
+	pgqueues[config.Name] = c
+	queuesLock.Unlock()
+	return c
+}
+
+func runPGConsumer(config *PGQueueConfig) {
+	c := newPGConsumer(config)
+	go func() {
+		if e := supervisePGQueue(config, c); e != nil {
+			logging.Error(fmt.Sprintf("[%s] consumer error: %s", config.Name, e.Error()))
+		}
+	}()
+}
+
+// supervisePGQueue keeps a pgqueue consumer running until it's stopped or the reconnect policy gives up
+func supervisePGQueue(config *PGQueueConfig, c *pgconsumer) error {
+	defer func() {
+		queuesLock.Lock()
+		finishedConsumers[config.Name] = c.state
+		if pgqueues[config.Name] == c {
+			delete(pgqueues, config.Name)
+		}
+		queuesLock.Unlock()
+		checkChannel <- true
+	}()
+	if !pgIdentifier.MatchString(config.Table) {
+		return errors.New("pgqueue: invalid table name " + config.Table)
+	}
+	return supervise(config.Name, config.ReconnectAttempts, config.ReconnectMinDelay, config.ReconnectMaxDelay,
+		&c.state, c.setState, c.exitChannel, func() (bool, error) { return startPGQueue(config, c) })
+}
+
+// pgWorkerId tells workers apart in taken_by: host & pid are the same in every container
+func pgWorkerId() string {
+	host, _ := os.Hostname()
+	suffix, _ := randomHex(8)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), suffix)
+}
+
+// startPGQueue prepares the table & consumes until it's stopped; the listener reconnects by itself,
+// so connected tells if it has got that far
+func startPGQueue(config *PGQueueConfig, c *pgconsumer) (connected bool, err error) {
+	db, e := sql.Open("postgres", config.URL)
+	if e != nil {
+		return false, errors.New("pgqueue open error: " + e.Error())
+	}
+	defer db.Close()
+	if _, e = db.Exec(fmt.Sprintf(pgQueueSchema, config.Table)); e != nil {
+		return false, errors.New("pgqueue schema error: " + e.Error())
+	}
+	for _, m := range pgQueueMigrations {
+		if _, e = db.Exec(fmt.Sprintf(m, config.Table)); e != nil {
+			return false, errors.New("pgqueue schema error: " + e.Error())
+		}
+	}
+	listener := pq.NewListener(config.URL, time.Second, time.Minute, func(ev pq.ListenerEventType, e error) {
+		queuesLock.Lock()
+		defer queuesLock.Unlock()
+		switch ev {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			c.setState(ConsumerConnected, e)
+		default:
+			c.setState(ConsumerReconnecting, e)
+			c.state.Failures++
+		}
+		if e != nil {
+			logging.Warning(fmt.Sprintf("[%s] listener: %s", config.Name, e.Error()))
+		}
+	})
+	defer listener.Close()
+	if e = listener.Listen(config.Channel); e != nil {
+		return false, errors.New("pgqueue listen error: " + e.Error())
+	}
+	queuesLock.Lock()
+	c.setState(ConsumerConnected, nil)
+	queuesLock.Unlock()
+	q := &pgqueue{
+		config:   config,
+		db:       db,
+		listener: listener,
+		worker:   pgWorkerId(),
+		slots:    make(chan bool, config.Workers),
+		wake:     make(chan bool, 1),
+		consumer: c,
+	}
+	logging.Info(fmt.Sprintf("[%s] consuming from table %s ( channel %s ) as %s", config.Name, config.Table,
+		config.Channel, q.worker))
+	ticker := time.NewTicker(config.PollInterval)
+	defer ticker.Stop()
+	for {
+		q.drain()
+		select {
+		case <-listener.Notify: // nil after reconnect - drain anyway, we could miss something
+		case <-q.wake:
+		case <-ticker.C:
+			q.requeueStale()
+			q.purge()
+		case <-c.exitChannel:
+			// taken requests are finished while the database is still there
+			c.jobs.Wait()
+			return true, errConsumerStopped
+		}
+	}
+}
+
+// drain takes & processes requests while there are any and we have free slots;
+// with every slot busy it returns at once, a finished request wakes the loop up
+func (q *pgqueue) drain() {
+	for {
+		select {
+		case q.slots <- true:
+		default:
+			return
+		}
+		id, body, retries, priority, e := q.claim()
+		if e != nil {
+			<-q.slots
+			if e != sql.ErrNoRows {
+				logging.Warning(fmt.Sprintf("[%s] claim error: %s", q.config.Name, e.Error()))
+			}
+			return
+		}
+		q.consumer.jobs.Add(1)
+		// priority of the token is set by the gateway, the body isn't authenticated yet
+		schedulePriority(priority, func() {
+			defer q.consumer.jobs.Done()
+			defer q.release()
+			q.process(id, body, retries)
+		})
+	}
+}
+
+func (q *pgqueue) release() {
+	<-q.slots
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+func (q *pgqueue) claim() (id int64, body string, retries, priority int, e error) {
+	e = q.db.QueryRow(fmt.Sprintf(`UPDATE %[1]s SET state = $1, taken_by = $2, updated = now(),
+		lease = now() + $4::interval
+		WHERE id = (SELECT id FROM %[1]s WHERE state = $3 AND (expires IS NULL OR expires > now())
+		AND (run_after IS NULL OR run_after <= now())
+		ORDER BY priority DESC, id FOR UPDATE SKIP LOCKED LIMIT 1) RETURNING id, request, retries, priority`,
+		q.config.Table), pgStateTaken, q.worker, pgStateNew, q.leaseInterval()).Scan(&id, &body, &retries, &priority)
+	return
+}
+
+// leaseInterval is how long a taken request is ours without a heartbeat
+func (q *pgqueue) leaseInterval() string {
+	return fmt.Sprintf("%d milliseconds", int64(q.config.StaleTimeout/time.Millisecond))
+}
+
+// heartbeat extends the lease of a request while it's processed, until stop is closed
+func (q *pgqueue) heartbeat(id int64, stop chan bool) {
+	ticker := time.NewTicker(q.config.StaleTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, e := q.db.Exec(fmt.Sprintf(`UPDATE %s SET lease = now() + $1::interval
+				WHERE id = $2 AND state = $3 AND taken_by = $4`, q.config.Table),
+				q.leaseInterval(), id, pgStateTaken, q.worker); e != nil {
+				logging.Warning(fmt.Sprintf("[%s] can't extend lease of %d: %s", q.config.Name, id, e.Error()))
+			}
+		}
+	}
+}
+
+// requeueStale gives back requests whose worker has stopped extending the lease ( it's dead ),
+// requests which have been given back max_retries times already fail: they may be killing workers
+func (q *pgqueue) requeueStale() {
+	lost, _ := json.Marshal(ReturnError("worker processing the request is lost"))
+	r, e := q.db.Exec(fmt.Sprintf(`UPDATE %s SET state = $1, reply = $2, error = $3, updated = now()
+		WHERE state = $4 AND lease < now() AND retries >= $5`, q.config.Table),
+		pgStateFailed, string(lost), "lost: worker stopped extending the lease", pgStateTaken, q.config.MaxRetries)
+	if e != nil {
+		logging.Warning(fmt.Sprintf("[%s] requeue error: %s", q.config.Name, e.Error()))
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		logging.Warning(fmt.Sprintf("[%s] %d stale requests failed after %d retries", q.config.Name, n,
+			q.config.MaxRetries))
+	}
+	r, e = q.db.Exec(fmt.Sprintf(`UPDATE %s SET state = $1, retries = retries + 1, updated = now()
+		WHERE state = $2 AND lease < now()`, q.config.Table), pgStateNew, pgStateTaken)
+	if e != nil {
+		logging.Warning(fmt.Sprintf("[%s] requeue error: %s", q.config.Name, e.Error()))
+		return
+	}
+	if n, _ := r.RowsAffected(); n > 0 {
+		logging.Warning(fmt.Sprintf("[%s] %d stale requests requeued", q.config.Name, n))
+	}
+}
+
+// purge removes expired requests nobody waits for: never taken ones & replies never picked up
+func (q *pgqueue) purge() {
+	if _, e := q.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE state IN ($1, $2) AND expires < now()`, q.config.Table),
+		pgStateNew, pgStateDone); e != nil {
+		logging.Warning(fmt.Sprintf("[%s] purge error: %s", q.config.Name, e.Error()))
+	}
+}
+
+func (q *pgqueue) process(id int64, body string, retries int) {
+	stop := make(chan bool)
+	go q.heartbeat(id, stop)
+	reply, result, stage, reason := executeRequest([]byte(body))
+	close(stop)
+	if result == deliveryRetry {
+		if retries < q.config.MaxRetries {
+			logging.Warning(fmt.Sprintf("[%s] transient %s error, retry %d/%d: %s", q.config.Name, stage, retries+1,
+				q.config.MaxRetries, reason.Error()))
+			// it's claimed again after the delay, by polling workers
+			delay := q.config.RetryDelay * time.Duration(retries+1)
+			if _, e := q.db.Exec(fmt.Sprintf(`UPDATE %s SET state = $1, retries = retries + 1, updated = now(),
+				run_after = now() + $2::interval WHERE id = $3 AND state = $4 AND taken_by = $5`, q.config.Table),
+				pgStateNew, fmt.Sprintf("%d milliseconds", int64(delay/time.Millisecond)), id, pgStateTaken,
+				q.worker); e != nil {
+				logging.Error(fmt.Sprintf("[%s] can't requeue %d: %s", q.config.Name, id, e.Error()))
+			}
+			return
+		}
+		result = deliveryDeadLetter
+	}
+	state, errText := pgStateDone, sql.NullString{}
+	if result == deliveryDeadLetter {
+		// failed requests stay in the table with the reason for investigation
+		state, errText = pgStateFailed, sql.NullString{String: stage + ": " + reason.Error(), Valid: true}
+		logging.Warning(fmt.Sprintf("[%s] request %d failed: %s", q.config.Name, id, errText.String))
+	}
+	j, e := json.Marshal(reply)
+	if e != nil {
+		j, _ = json.Marshal(ReturnError("json: ", e.Error()))
+	}
+	if _, e = q.db.Exec(fmt.Sprintf(`UPDATE %s SET state = $1, reply = $2, error = $3, updated = now()
+		WHERE id = $4 AND state = $5 AND taken_by = $6`, q.config.Table), state, string(j), errText, id, pgStateTaken,
+		q.worker); e != nil {
+		logging.Error(fmt.Sprintf("[%s] can't store reply for %d: %s", q.config.Name, id, e.Error()))
+		return
+	}
+	if _, e = q.db.Exec("SELECT pg_notify($1, $2)", q.config.Channel+"_reply", fmt.Sprintf("%d", id)); e != nil {
+		logging.Warning(fmt.Sprintf("[%s] can't notify reply for %d: %s", q.config.Name, id, e.Error()))
+	}
+}
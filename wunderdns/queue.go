@@ -20,29 +20,76 @@ import (
 	"github.com/streadway/amqp"
 	"log"
 	"strings"
+	"sync"
+	"time"
 )
 
 type amqpqueue struct {
 	conn        *amqp.Connection
 	channel     *amqp.Channel
+	queue       string
+	retryQueues []string // delay queue per retry attempt
 	exitChannel chan bool
+	state       ConsumerState
+	// retries & dead letters go through a confirm mode channel, one at a time
+	publisher   *amqp.Channel
+	confirms    chan amqp.Confirmation
+	published   uint64
+	publishLock sync.Mutex
+	// scheduled jobs ack on the channel, it's closed only after them on stop
+	jobs sync.WaitGroup
 }
 
+type deliveryResult int
+
+const (
+	deliveryDone       deliveryResult = iota // processed or definitively rejected - ack it
+	deliveryRetry                            // transient failure - try again later
+	deliveryDeadLetter                       // poison message - park it with the reason
+)
+
+const (
+	headerRetries  = "x-wunder-retries"
+	headerError    = "x-wunder-error"
+	headerStage    = "x-wunder-stage"
+	headerConsumer = "x-wunder-consumer"
+	headerExchange = "x-wunder-exchange"
+)
+
 var queues = make(map[string]*amqpqueue)
+var queuesLock = sync.RWMutex{}
+
+var errConsumerStopped = errors.New("consumer stopped")
+
+// the broker has this long to confirm a retried or dead-lettered message
+const publishConfirmTimeout = 30 * time.Second
 
-func startAMQPQueue(config *AMQPConfig) error {
+// getChannel gives the consumer channel of the queue, taken under the lock: it's gone on reconnects
+func getChannel(key string) (*amqp.Channel, bool) {
+	queuesLock.RLock()
+	defer queuesLock.RUnlock()
+	v, ok := queues[key]
+	if !ok || v.channel == nil {
+		return nil, false
+	}
+	return v.channel, true
+}
+
+// startAMQPQueue declares topology & consumes until the connection or channel dies;
+// connected tells if it has got that far, so the supervisor can reset its backoff
+func startAMQPQueue(config *AMQPConfig, aq *amqpqueue) (connected bool, err error) {
 	url := config.URL
 	if !strings.HasPrefix(url, "amqp://") {
 		url = "amqp://" + url
 	}
 	conn, e := amqp.Dial(url)
 	if e != nil {
-		return errors.New("amqp connection error: " + e.Error())
+		return false, errors.New("amqp connection error: " + e.Error())
 	}
 	defer conn.Close()
 	ch, e := conn.Channel()
 	if e != nil {
-		return errors.New("amqp channel error: " + e.Error())
+		return false, errors.New("amqp channel error: " + e.Error())
 	}
 	defer ch.Close()
 	e = ch.ExchangeDeclare(
@@ -55,18 +102,42 @@ func startAMQPQueue(config *AMQPConfig) error {
 		nil,
 	)
 	if e != nil {
-		return errors.New("amqp exchangeDeclare error: " + e.Error())
+		return false, errors.New("amqp exchangeDeclare error: " + e.Error())
+	}
+	if config.DeadLetterExchange != "" {
+		e = ch.ExchangeDeclare(
+			config.DeadLetterExchange,
+			amqp.ExchangeFanout,
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if e != nil {
+			return false, errors.New("amqp dead letter exchangeDeclare error: " + e.Error())
+		}
+	}
+	// fanout mode: every worker gets its own exclusive queue and every message
+	// shared mode: workers of one deployment compete for messages of one durable queue
+	durable, exclusive := false, true
+	if config.Queue != "" {
+		durable, exclusive = true, false
+	}
+	var args amqp.Table
+	if config.MaxPriority > 0 {
+		args = amqp.Table{"x-max-priority": int32(config.MaxPriority)}
 	}
 	q, e := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
+		config.Queue, // name ( server-named if empty )
+		durable,      // durable
+		false,        // delete when unused
+		exclusive,    // exclusive
+		false,        // no-wait
+		args,         // arguments
 	)
 	if e != nil {
-		return errors.New("amqp queueDeclare error: " + e.Error())
+		return false, errors.New("amqp queueDeclare error: " + e.Error())
 	}
 	e = ch.QueueBind(
 		q.Name,          // queue name
@@ -75,64 +146,114 @@ func startAMQPQueue(config *AMQPConfig) error {
 		false,
 		nil)
 	if e != nil {
-		return errors.New("amqp queueBind error: " + e.Error())
+		return false, errors.New("amqp queueBind error: " + e.Error())
 	}
-	msgs, e := ch.Consume(q.Name, "", true, false, false, false, nil)
+	// a retried message waits in the delay queue of its attempt and expires back to the work queue
+	retryQueues := make([]string, 0, config.MaxRetries)
+	if config.RetryDelay > 0 {
+		for i := 1; i <= config.MaxRetries; i++ {
+			delay := config.RetryDelay * time.Duration(i)
+			name := ""
+			if config.Queue != "" {
+				// the delay is a part of the name: arguments of an existing queue can't be changed
+				name = fmt.Sprintf("%s.retry.%d", config.Queue, int64(delay/time.Millisecond))
+			}
+			rq, e := ch.QueueDeclare(name, durable, false, exclusive, false, amqp.Table{
+				"x-message-ttl":             int64(delay / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": q.Name,
+			})
+			if e != nil {
+				return false, errors.New("amqp retry queueDeclare error: " + e.Error())
+			}
+			retryQueues = append(retryQueues, rq.Name)
+		}
+	}
+	pub, e := conn.Channel()
 	if e != nil {
-		return errors.New("amqp consume error: " + e.Error())
+		return false, errors.New("amqp channel error: " + e.Error())
+	}
+	defer pub.Close()
+	if e = pub.Confirm(false); e != nil {
+		return false, errors.New("amqp confirm error: " + e.Error())
 	}
-	v := make(chan bool, 2)
-	queues[q.Name] = &amqpqueue{
-		conn:        conn,
-		channel:     ch,
-		exitChannel: v,
+	// late confirms of timed out publishes are skipped, there's room for a few of them
+	confirms := pub.NotifyPublish(make(chan amqp.Confirmation, 16))
+	if e = ch.Qos(config.prefetch(), 0, false); e != nil {
+		return false, errors.New("amqp qos error: " + e.Error())
 	}
+	// manual ack: a message is acknowledged only once its fate is known
+	tag, _ := randomHex(8)
+	tag = config.Name + "-" + tag
+	msgs, e := ch.Consume(q.Name, tag, false, false, false, false, nil)
+	if e != nil {
+		return false, errors.New("amqp consume error: " + e.Error())
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	queuesLock.Lock()
+	aq.conn = conn
+	aq.channel = ch
+	aq.queue = q.Name
+	aq.retryQueues = retryQueues
+	aq.setState(ConsumerConnected, nil)
+	queuesLock.Unlock()
+	aq.publishLock.Lock()
+	aq.publisher, aq.confirms, aq.published = pub, confirms, 0
+	aq.publishLock.Unlock()
 	defer func() {
-		delete(queues, q.Name)
-		checkChannel <- true
+		queuesLock.Lock()
+		aq.conn = nil
+		aq.channel = nil
+		queuesLock.Unlock()
+		aq.publishLock.Lock()
+		aq.publisher = nil
+		aq.publishLock.Unlock()
 	}()
+	logging.Info(fmt.Sprintf("[%s] consuming from %s ( shared: %v )", config.Name, q.Name, config.Queue != ""))
 	for {
 		select {
-		case msg := <-msgs:
-			go processMessage(&msg, q.Name)
-		case <-v:
+		case msg, ok := <-msgs:
+			if !ok {
+				return true, errors.New("amqp delivery channel closed")
+			}
+			aq.jobs.Add(1)
+			// priority of the token is set by the gateway, the body isn't authenticated yet
+			schedulePriority(int(msg.Priority), func() {
+				defer aq.jobs.Done()
+				processMessage(&msg, config)
+			})
+		case e := <-connClosed:
+			return true, fmt.Errorf("amqp connection closed: %v", e)
+		case e := <-chClosed:
+			return true, fmt.Errorf("amqp channel closed: %v", e)
+		case <-aq.exitChannel:
 			log.Printf("Got quit signal!")
-			return nil
+			aq.stop(func() error { return ch.Cancel(tag, false) })
+			return true, errConsumerStopped
 		}
 	}
 }
 
-func replyError(message *amqp.Delivery, key string, data ...interface{}) {
-	log.Print(append([]interface{}{"ERROR:"}, data...)...)
-	if message.ReplyTo != "" && message.CorrelationId != "" {
-		if j, e := json.Marshal(ReturnError(data...)); e == nil {
-			re := amqp.Publishing{
-				ContentType:   "application/json",
-				Body:          j,
-				CorrelationId: message.CorrelationId,
-			}
-			if v, ok := queues[key]; ok {
-				e := v.channel.Publish("", message.ReplyTo, false, false, re)
-				if e != nil {
-					logging.Warning(fmt.Sprintf("Error sending reply to %s/%s: %s", message.ReplyTo, message.CorrelationId, e.Error()))
-				} else {
-					logging.Trace(fmt.Sprintf("Sent reply to %s/%s: %d", message.ReplyTo, message.CorrelationId, len(j)))
-				}
-			}
-		}
+// stop cancels the consumer and waits for its scheduled jobs; deliveries not taken yet
+// go back to the queue when the channel is closed
+func (aq *amqpqueue) stop(cancel func() error) {
+	if e := cancel(); e != nil {
+		logging.Warning(fmt.Sprintf("[%s] can't cancel consumer: %s", aq.state.Name, e.Error()))
 	}
+	aq.jobs.Wait()
 }
 
-func replySuccessData(message *amqp.Delivery, key string, data interface{}) {
+func replyMessage(message *amqp.Delivery, key string, reply *WunderReply) {
 	if message.ReplyTo != "" && message.CorrelationId != "" {
-		if j, e := json.Marshal(ReturnSuccess(data)); e == nil {
+		if j, e := json.Marshal(reply); e == nil {
 			re := amqp.Publishing{
 				ContentType:   "application/json",
 				Body:          j,
 				CorrelationId: message.CorrelationId,
 			}
-			if v, ok := queues[key]; ok {
-				e := v.channel.Publish("", message.ReplyTo, false, false, re)
+			if ch, ok := getChannel(key); ok {
+				e := ch.Publish("", message.ReplyTo, false, false, re)
 				if e != nil {
 					logging.Warning(fmt.Sprintf("Error sending reply to %s/%s: %s", message.ReplyTo, message.CorrelationId, e.Error()))
 				} else {
@@ -159,47 +280,276 @@ func ReturnSuccess(data interface{}) *WunderReply {
 	}
 }
 
-func processMessage(message *amqp.Delivery, key string) {
+func processMessage(message *amqp.Delivery, config *AMQPConfig) {
+	key := config.Name
+	reply, result, stage, reason := executeRequest(message.Body)
+	if result == deliveryRetry {
+		retries := deliveryRetries(message)
+		if retries < config.MaxRetries {
+			logging.Warning(fmt.Sprintf("[%s] transient %s error, retry %d/%d: %s", key, stage, retries+1,
+				config.MaxRetries, reason.Error()))
+			// the original is acked only once the broker has the retry
+			if e := republishMessage(message, key, retries+1); e != nil {
+				logging.Error(fmt.Sprintf("[%s] can't republish %s: %s", key, message.CorrelationId, e.Error()))
+				_ = message.Nack(false, true) // give it back to the broker
+				return
+			}
+			_ = message.Ack(false)
+			return
+		}
+		result = deliveryDeadLetter
+	}
+	if reply.Status == "ERROR" {
+		log.Print("ERROR: ", stage, ": ", reason.Error())
+	}
+	replyMessage(message, key, reply)
+	if result == deliveryDeadLetter {
+		if e := deadLetterMessage(message, config, stage, reason); e != nil {
+			logging.Error(fmt.Sprintf("[%s] can't dead-letter %s: %s", key, message.CorrelationId, e.Error()))
+			_ = message.Nack(false, true)
+			return
+		}
+	}
+	_ = message.Ack(false)
+}
+
+// executeRequest runs a raw request through security, rfc & orm stages
+// and tells what to do with the delivery it came from
+func executeRequest(body []byte) (reply *WunderReply, result deliveryResult, stage string, reason error) {
 	req := new(WunderRequest)
-	if e := json.Unmarshal(message.Body, req); e != nil {
-		replyError(message, key, "json: ", e.Error())
-		return
+	if e := json.Unmarshal(body, req); e != nil {
+		return ReturnError("json: ", e.Error()), deliveryDeadLetter, "json", e
 	}
+	return executeWunderRequest(req)
+}
+
+func executeWunderRequest(req *WunderRequest) (reply *WunderReply, result deliveryResult, stage string, reason error) {
 	if e := securityProcessRequest(req); e != nil {
-		replyError(message, key, "security: ", e.Error())
-		return
+		return ReturnError("security: ", e.Error()), deliveryDone, "security", e
 	}
+	defer func() {
+		if result == deliveryRetry { // the same request comes again
+			releaseNonce(req)
+		}
+	}()
 	switch req.Cmd {
-	case CommandReplaceOwner:
+	case CommandReplaceOwner, CommandCheckReplicas, CommandRepairReplica, CommandTokenInfo, CommandStageSecret,
+		CommandRetireSecret, CommandCreateToken, CommandRevokeToken, CommandListTokens, CommandAdminCreateToken,
+		CommandAdminUpdateToken, CommandAdminRevokeToken, CommandAdminListTokens:
 
 	default:
 		if e := checkRFCRequest(req); e != nil {
-			replyError(message, key, "rfc1034: ", e.Error())
-			return
+			return ReturnError("rfc1034: ", e.Error()), deliveryDone, "rfc1034", e
 		}
 	}
 
-	logging.Trace(fmt.Sprintf("Got request (%s) from %s/%s", req.Cmd, message.ReplyTo, message.CorrelationId))
+	logging.Trace(fmt.Sprintf("Got request (%s) from %s", req.Cmd, req.Auth.toString()))
+	result = deliveryDone
 	switch req.Cmd {
 	case CommandListRecords, CommandListDomains, CommandListOwn, CommandSearchRecord:
-		var data map[DomainView][]interface{}
+		data, e := ormApplyCommandMerge(req)
+		if e != nil {
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("sql: ", e.Error()), result, "sql", e
+		}
+		return ReturnSuccess(data), result, "", nil
+	case CommandTokenInfo:
+		info, e := getTokenInfo(req)
+		if e != nil {
+			return ReturnError("auth: ", e.Error()), result, "auth", e
+		}
+		return ReturnSuccess(info), result, "", nil
+	case CommandStageSecret:
+		secret, e := stageSecret(req)
+		if e != nil {
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("tokenstore: ", e.Error()), result, "tokenstore", e
+		}
+		return ReturnSuccess(secret), result, "", nil
+	case CommandRetireSecret:
+		retired, e := retireSecret(req)
+		if e != nil {
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("tokenstore: ", e.Error()), result, "tokenstore", e
+		}
+		return ReturnSuccess(retired), result, "", nil
+	case CommandCreateToken, CommandRevokeToken, CommandListTokens, CommandAdminCreateToken, CommandAdminUpdateToken,
+		CommandAdminRevokeToken, CommandAdminListTokens:
+		var data interface{}
 		var e error
-		data, e = ormApplyCommandMerge(req)
+		switch req.Cmd {
+		case CommandCreateToken:
+			data, e = createToken(req)
+		case CommandRevokeToken:
+			data, e = revokeToken(req)
+		case CommandAdminCreateToken:
+			data, e = adminCreateToken(req)
+		case CommandAdminUpdateToken:
+			data, e = adminUpdateToken(req)
+		case CommandAdminRevokeToken:
+			data, e = adminRevokeToken(req)
+		case CommandAdminListTokens:
+			data, e = adminListTokens(req)
+		default:
+			data, e = listTokens(req)
+		}
 		if e != nil {
-			replyError(message, key, "sql: ", e.Error())
-		} else {
-			replySuccessData(message, key, data)
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("tokenstore: ", e.Error()), result, "tokenstore", e
+		}
+		return ReturnSuccess(data), result, "", nil
+	case CommandCheckReplicas:
+		reports, e := checkReplicas(req)
+		if e != nil {
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("reconcile: ", e.Error()), result, "reconcile", e
+		}
+		return ReturnSuccess(reports), result, "", nil
+	case CommandRepairReplica:
+		n, report, e := repairReplica(req)
+		if e != nil {
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("reconcile: ", e.Error()), result, "reconcile", e
 		}
-		break
+		return ReturnSuccess(map[string]interface{}{"rows": n, "repaired": report}), result, "", nil
 	default:
-		var n int
-		var e error
-		n, e = ormApplyCommand(req)
+		n, e := ormApplyCommand(req)
 		if e != nil {
-			replyError(message, key, "sql: ", e.Error())
-			return
-		} else {
-			replySuccessData(message, key, map[string]interface{}{"rows": n})
+			if isTransientError(e) {
+				result = deliveryRetry
+			}
+			return ReturnError("sql: ", e.Error()), result, "sql", e
 		}
+		return ReturnSuccess(map[string]interface{}{"rows": n}), result, "", nil
+	}
+}
+
+func deliveryRetries(message *amqp.Delivery) int {
+	if message.Headers == nil {
+		return 0
+	}
+	switch v := message.Headers[headerRetries].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func copyHeaders(message *amqp.Delivery) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// publishConfirmed sends a message on the confirm mode channel of the consumer
+// and waits for the broker to take it
+func publishConfirmed(key, exchange, routingKey string, msg amqp.Publishing) error {
+	queuesLock.RLock()
+	v, ok := queues[key]
+	queuesLock.RUnlock()
+	if !ok {
+		return errors.New("consumer is gone")
+	}
+	v.publishLock.Lock()
+	defer v.publishLock.Unlock()
+	if v.publisher == nil {
+		return errors.New("consumer is gone")
+	}
+	if e := v.publisher.Publish(exchange, routingKey, false, false, msg); e != nil {
+		return e
+	}
+	v.published++
+	timeout := time.NewTimer(publishConfirmTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case c, ok := <-v.confirms:
+			if !ok {
+				return errors.New("amqp channel closed")
+			}
+			if c.DeliveryTag < v.published {
+				continue // late confirm of a publish we've given up on
+			}
+			if !c.Ack {
+				return errors.New("message is not accepted by broker")
+			}
+			return nil
+		case <-timeout.C:
+			return errors.New("publish confirm timeout")
+		}
+	}
+}
+
+// republishMessage puts a message to the delay queue of the retry, or straight back to the tail
+// of its own queue if there's no delay, with increased retry counter
+func republishMessage(message *amqp.Delivery, key string, retries int) error {
+	queuesLock.RLock()
+	v, ok := queues[key]
+	routingKey := ""
+	if ok {
+		routingKey = v.queue
+		if retries <= len(v.retryQueues) {
+			routingKey = v.retryQueues[retries-1]
+		}
+	}
+	queuesLock.RUnlock()
+	if !ok {
+		return errors.New("consumer is gone")
+	}
+	headers := copyHeaders(message)
+	headers[headerRetries] = int32(retries)
+	// no per-message expiration: it would take the message out of the delay queue early
+	return publishConfirmed(key, "", routingKey, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   message.ContentType,
+		DeliveryMode:  message.DeliveryMode,
+		Priority:      message.Priority,
+		CorrelationId: message.CorrelationId,
+		ReplyTo:       message.ReplyTo,
+		Body:          message.Body,
+	})
+}
+
+// deadLetterMessage parks a message we failed to process with the failure reason in headers
+func deadLetterMessage(message *amqp.Delivery, config *AMQPConfig, stage string, reason error) error {
+	if config.DeadLetterExchange == "" {
+		logging.Error(fmt.Sprintf("[%s] dropping message %s ( no dead letter exchange ), %s: %s; body: %s",
+			config.Name, message.CorrelationId, stage, reason.Error(), string(message.Body)))
+		return nil
 	}
+	headers := copyHeaders(message)
+	headers[headerRetries] = int32(deliveryRetries(message))
+	headers[headerError] = reason.Error()
+	headers[headerStage] = stage
+	headers[headerConsumer] = config.Name
+	headers[headerExchange] = message.Exchange
+	logging.Warning(fmt.Sprintf("[%s] dead-lettering message %s to %s: %s", config.Name, message.CorrelationId,
+		config.DeadLetterExchange, reason.Error()))
+	return publishConfirmed(config.Name, config.DeadLetterExchange, message.RoutingKey, amqp.Publishing{
+		Headers:       headers,
+		ContentType:   message.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: message.CorrelationId,
+		ReplyTo:       message.ReplyTo,
+		Timestamp:     time.Now(),
+		Body:          message.Body,
+	})
 }
@@ -0,0 +1,355 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configuration is parsed again on SIGHUP or, with [reload] watch, when one of its files is changed:
+// auth.ini tokens & [security] are swapped at once, [psql.*] databases, [amqp.*] & [pgqueue.*] consumers
+// are opened, closed or restarted as needed; other sections are reported only, they're applied on restart.
+// A configuration failing to parse is not applied at all.
+var reloadLock = sync.Mutex{}
+
+// databases are closed a while after they're replaced, so requests using them can finish
+const ormCloseDelay = time.Minute
+
+func handleReloadSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logging.Info("[reload] SIGHUP received")
+		if e := reloadConfig(); e != nil {
+			logging.Error("[reload] configuration is kept: ", e.Error())
+		}
+	}
+}
+
+func watchConfigFiles(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if f := changedConfigFile(); f != "" {
+			logging.Info("[reload] ", f, " is changed")
+			if e := reloadConfig(); e != nil {
+				logging.Error("[reload] configuration is kept: ", e.Error())
+			}
+		}
+	}
+}
+
+// changedConfigFile gives a loaded file modified since, files gone missing are not reloaded
+func changedConfigFile() string {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	for f, t := range loadedFiles {
+		if st, e := os.Stat(f); e == nil && !st.ModTime().Equal(t) {
+			return f
+		}
+	}
+	return ""
+}
+
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	previous := loadedFiles
+	loadedFiles = make(map[string]time.Time)
+	loadingConfig, includeErrors = new(Config), nil
+	defer func() { loadingConfig = globalConfig }()
+	e := parseConfigFile(configPath)
+	if e == nil && len(includeErrors) > 0 {
+		e = includeErrors[0]
+	}
+	if e != nil {
+		// the same broken files aren't reloaded again until they're changed
+		for f, t := range previous {
+			if _, ok := loadedFiles[f]; !ok {
+				loadedFiles[f] = t
+			}
+		}
+		return e
+	}
+	c := loadingConfig
+	removed := reloadAuth(c)
+	reloadDatabases(c.PSQLConfigs)
+	revokeOrphans(removed)
+	reloadConsumers(c.AMQPConfigs)
+	reloadPGConsumers(c.PGQueues)
+	reportRestartRequired(c)
+	warnReplayProtection(globalConfig)
+	logging.Info("[reload] configuration is reloaded")
+	return nil
+}
+
+// sameAuth compares tokens, times may differ in locations only
+func sameAuth(a, b AuthData) bool {
+	for _, v := range []*AuthData{&a, &b} {
+		v.NotBefore, v.Expires = v.NotBefore.UTC(), v.Expires.UTC()
+		secrets := make([]TokenSecret, len(v.Secrets))
+		for i, s := range v.Secrets {
+			s.Expires = s.Expires.UTC()
+			secrets[i] = s
+		}
+		v.Secrets = secrets
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// diffAuth tells what has changed in configured tokens, vault & token store ones are not compared
+func diffAuth(old, configured AuthDatabase) (added, removed, changed []string) {
+	for k, v := range old {
+		if v.isVault || v.isStore {
+			continue
+		}
+		if n, ok := configured[k]; !ok {
+			removed = append(removed, k)
+		} else if !sameAuth(v, n) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range configured {
+		if v, ok := old[k]; !ok || v.isVault || v.isStore {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
+
+// reloadAuth swaps configured tokens, vault & token store ones stay until their next sync;
+// removed tokens are given back
+func reloadAuth(c *Config) []string {
+	configured := make(AuthDatabase)
+	if c.Auth != nil {
+		configured = *c.Auth
+	}
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	if globalConfig.Auth == nil {
+		v := make(AuthDatabase)
+		globalConfig.Auth = &v
+	}
+	added, removed, changed := diffAuth(*globalConfig.Auth, configured)
+	merged := make(AuthDatabase, len(configured))
+	for k, v := range configured {
+		merged[k] = v
+	}
+	for k, v := range *globalConfig.Auth {
+		if _, ok := merged[k]; !ok && (v.isVault || v.isStore) {
+			merged[k] = v
+		}
+	}
+	*globalConfig.Auth = merged
+	if !reflect.DeepEqual(globalConfig.Security, c.Security) {
+		logging.Info("[reload] [security] is changed")
+	}
+	securityLock.Lock()
+	globalConfig.Security = c.Security
+	securityLock.Unlock()
+	for _, d := range []struct {
+		what   string
+		tokens []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(d.tokens) > 0 {
+			logging.Info("[reload] tokens ", d.what, ": ", strings.Join(d.tokens, ", "))
+		}
+	}
+	return removed
+}
+
+// reloadDatabases opens added & changed databases and closes removed ones; a database failing
+// to open keeps the old connection if there's one
+func reloadDatabases(configs []*PSQLConfig) {
+	current := currentOrms()
+	byName := make(map[string]*orm)
+	for _, d := range current {
+		byName[d.config.Name] = d
+	}
+	next := make([]*orm, 0, len(configs))
+	closing := make([]*orm, 0)
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		seen[c.Name] = true
+		d, ok := byName[c.Name]
+		if ok && reflect.DeepEqual(*d.config, *c) {
+			next = append(next, d)
+			continue
+		}
+		n, e := openORM(c)
+		if e != nil {
+			logging.Error("[reload] database ", c.Name, ": ", e.Error())
+			if ok {
+				next = append(next, d)
+			}
+			continue
+		}
+		if ok {
+			logging.Info("[reload] database ", c.Name, " is changed")
+			closing = append(closing, d)
+		} else {
+			logging.Info("[reload] database ", c.Name, " is added")
+		}
+		next = append(next, n)
+	}
+	for _, d := range current {
+		if !seen[d.config.Name] {
+			logging.Info("[reload] database ", d.config.Name, " is removed")
+			closing = append(closing, d)
+		}
+	}
+	psqlConfigs := make([]*PSQLConfig, 0, len(next))
+	for _, d := range next {
+		psqlConfigs = append(psqlConfigs, d.config)
+	}
+	ormsLock.Lock()
+	orms = next
+	globalConfig.PSQLConfigs = psqlConfigs
+	ormsLock.Unlock()
+	for _, d := range closing {
+		d := d
+		time.AfterFunc(ormCloseDelay, func() {
+			if db, e := d.db.DB(); e == nil {
+				_ = db.Close()
+			}
+		})
+	}
+}
+
+// reloadConsumers starts added consumers, stops removed ones & restarts changed ones
+func reloadConsumers(configs []*AMQPConfig) {
+	old := make(map[string]*AMQPConfig)
+	for _, c := range globalConfig.AMQPConfigs {
+		old[c.Name] = c
+	}
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		seen[c.Name] = true
+		o, ok := old[c.Name]
+		if ok && reflect.DeepEqual(*o, *c) {
+			continue
+		}
+		if ok {
+			logging.Info("[reload] amqp consumer ", c.Name, " is changed, restarting")
+			stopAMQPConsumer(c.Name)
+		} else {
+			logging.Info("[reload] amqp consumer ", c.Name, " is added")
+		}
+		runAMQPConsumer(c)
+	}
+	for name := range old {
+		if !seen[name] {
+			logging.Info("[reload] amqp consumer ", name, " is removed")
+			stopAMQPConsumer(name)
+		}
+	}
+	globalConfig.AMQPConfigs = configs
+}
+
+// reloadPGConsumers does the same for pgqueue consumers
+func reloadPGConsumers(configs []*PGQueueConfig) {
+	old := make(map[string]*PGQueueConfig)
+	for _, c := range globalConfig.PGQueues {
+		old[c.Name] = c
+	}
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		seen[c.Name] = true
+		o, ok := old[c.Name]
+		if ok && reflect.DeepEqual(*o, *c) {
+			continue
+		}
+		if ok {
+			logging.Info("[reload] pgqueue consumer ", c.Name, " is changed, restarting")
+			stopPGConsumer(c.Name)
+		} else {
+			logging.Info("[reload] pgqueue consumer ", c.Name, " is added")
+		}
+		runPGConsumer(c)
+	}
+	for name := range old {
+		if !seen[name] {
+			logging.Info("[reload] pgqueue consumer ", name, " is removed")
+			stopPGConsumer(name)
+		}
+	}
+	globalConfig.PGQueues = configs
+}
+
+// stopAMQPConsumer stops the consumer and waits for it to be gone ( it finishes requests taken already )
+func stopAMQPConsumer(name string) {
+	queuesLock.RLock()
+	aq, ok := queues[name]
+	queuesLock.RUnlock()
+	if !ok {
+		return
+	}
+	stopConsumer("amqp", name, aq.exitChannel, func() bool { return queues[name] != aq })
+}
+
+func stopPGConsumer(name string) {
+	queuesLock.RLock()
+	c, ok := pgqueues[name]
+	queuesLock.RUnlock()
+	if !ok {
+		return
+	}
+	stopConsumer("pgqueue", name, c.exitChannel, func() bool { return pgqueues[name] != c })
+}
+
+// stopConsumer signals the exit and polls gone ( called with queuesLock held ) for up to 30s
+func stopConsumer(kind, name string, exit chan bool, gone func() bool) {
+	select {
+	case exit <- true:
+	default: // it's stopping already
+	}
+	for i := 0; i < 300; i++ {
+		queuesLock.RLock()
+		done := gone()
+		queuesLock.RUnlock()
+		if done {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logging.Warning("[reload] ", kind, " consumer ", name, " is still stopping")
+}
+
+// reportRestartRequired warns about changes applied on restart only
+func reportRestartRequired(c *Config) {
+	for _, s := range []struct {
+		section string
+		changed bool
+	}{
+		{"[vault]", !reflect.DeepEqual(globalConfig.Vault, c.Vault)},
+		{"[health]", globalConfig.Health != c.Health},
+		{"[scheduler]", !reflect.DeepEqual(globalConfig.Scheduler, c.Scheduler)},
+		{"[reconcile]", !reflect.DeepEqual(globalConfig.Reconcile, c.Reconcile)},
+		{"[tokenstore]", !reflect.DeepEqual(globalConfig.TokenStore, c.TokenStore)},
+		{"[reload]", globalConfig.ReloadWatch != c.ReloadWatch},
+	} {
+		if s.changed {
+			logging.Warning("[reload] ", s.section, " is changed, it's applied on restart")
+		}
+	}
+}
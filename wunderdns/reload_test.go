@@ -0,0 +1,247 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, e := ioutil.TempDir("", "wunderdns")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	mainFile, auth := filepath.Join(dir, "wunderdns.ini"), filepath.Join(dir, "auth.ini")
+	write := func(name, content string) {
+		if e := ioutil.WriteFile(name, []byte(content), 0600); e != nil {
+			t.Fatal(e)
+		}
+	}
+	write(mainFile, "[security]\nclock_skew=1m\n[include.auth]\nfile="+auth+"\n")
+	write(auth, "[auth.kept]\nsecret=kept\npublic,*=list_domains\n"+
+		"[auth.changed]\nsecret=new\npublic,*=*\n"+
+		"[auth.added]\nsecret=added\npublic,*=list_records\n")
+
+	savedPath, savedFiles, saved := configPath, loadedFiles, *globalConfig
+	defer func() {
+		configPath, loadedFiles = savedPath, savedFiles
+		globalConfig.Auth, globalConfig.Security = authdb, saved.Security
+		globalConfig.PSQLConfigs, globalConfig.AMQPConfigs = saved.PSQLConfigs, saved.AMQPConfigs
+	}()
+	kept, _ := parseACL([]string{"public,*=list_domains"})
+	globalConfig.Auth = &AuthDatabase{
+		"kept":    {Token: "kept", Secret: "kept", Permissions: kept},
+		"changed": {Token: "changed", Secret: "old", Permissions: kept},
+		"removed": {Token: "removed", Secret: "removed"},
+		"vault":   {Token: "vault", Secret: "vault", isVault: true},
+		"stored":  {Token: "stored", Secret: "stored", isStore: true},
+	}
+	configMap["include"] = includeSection
+	configPath = mainFile
+	if e := reloadConfig(); e != nil {
+		t.Fatal(e)
+	}
+	db := *globalConfig.Auth
+	for token, expected := range map[string]bool{
+		"kept": true, "changed": true, "added": true, "removed": false, "vault": true, "stored": true,
+	} {
+		if _, ok := db[token]; ok != expected {
+			t.Errorf("%s is in the auth database: expected %v", token, expected)
+		}
+	}
+	if db["changed"].Secret != "new" || len(db["added"].Permissions) != 1 {
+		t.Errorf("tokens are not reloaded: %+v", db)
+	}
+	if globalConfig.security().ClockSkew != time.Minute {
+		t.Error("[security] is not reloaded")
+	}
+	if _, ok := loadedFiles[auth]; !ok {
+		t.Errorf("included file is not watched: %v", loadedFiles)
+	}
+
+	// a broken configuration is not applied
+	write(mainFile, "[include.auth]\nfile="+filepath.Join(dir, "missing.ini")+"\n")
+	if e := reloadConfig(); e == nil {
+		t.Error("configuration with a missing include is reloaded")
+	}
+	if _, ok := (*globalConfig.Auth)["added"]; !ok {
+		t.Error("tokens are dropped by a failed reload")
+	}
+
+	// changes are noticed by modification times
+	if f := changedConfigFile(); f != "" {
+		t.Errorf("%s is changed", f)
+	}
+	later := time.Now().Add(time.Minute)
+	if e := os.Chtimes(auth, later, later); e != nil {
+		t.Fatal(e)
+	}
+	if f := changedConfigFile(); f != auth {
+		t.Errorf("change of %s is not noticed: %q", auth, f)
+	}
+}
+
+func TestDiffAuth(t *testing.T) {
+	expires, _ := time.Parse(time.RFC3339, "2030-01-01T03:00:00+03:00")
+	old := AuthDatabase{
+		"same":    {Token: "same", Expires: expires},
+		"changed": {Token: "changed", Priority: 1},
+		"gone":    {Token: "gone"},
+		"vault":   {Token: "vault", isVault: true},
+	}
+	configured := AuthDatabase{
+		"same":    {Token: "same", Expires: expires.UTC()},
+		"changed": {Token: "changed", Priority: 2},
+		"new":     {Token: "new"},
+		"vault":   {Token: "vault"}, // configured takes over
+	}
+	added, removed, changed := diffAuth(old, configured)
+	if !reflect.DeepEqual(added, []string{"new", "vault"}) || !reflect.DeepEqual(removed, []string{"gone"}) ||
+		!reflect.DeepEqual(changed, []string{"changed"}) {
+		t.Errorf("added %v, removed %v, changed %v", added, removed, changed)
+	}
+}
+
+func TestStopConsumerWaitsForJobs(t *testing.T) {
+	aq := &amqpqueue{state: ConsumerState{Name: "test"}}
+	finish := make(chan bool)
+	aq.jobs.Add(1)
+	schedulePriority(0, func() {
+		defer aq.jobs.Done()
+		<-finish
+	})
+	cancelled := make(chan bool, 1)
+	stopped := make(chan bool)
+	go func() {
+		aq.stop(func() error {
+			cancelled <- true
+			return nil
+		})
+		close(stopped)
+	}()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("consumer is not cancelled")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the job is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("not stopped after the job is done")
+	}
+}
+
+func TestSuperviseRetriesFirstConnect(t *testing.T) {
+	state := &ConsumerState{Name: "test"}
+	set := func(s string, e error) { state.set(s, e) }
+	calls := 0
+	// never connected: failures add up, the consumer is given up after attempts
+	e := supervise("test", 2, time.Millisecond, time.Millisecond, state, set, make(chan bool, 1),
+		func() (bool, error) {
+			calls++
+			return false, errors.New("connection refused")
+		})
+	if e == nil || calls != 3 || state.State != ConsumerFailed || state.LastError != "connection refused" {
+		t.Errorf("%d calls, %s: %v", calls, state.State, e)
+	}
+	// the first connect fails, the second one gets through until it's stopped
+	state, calls = &ConsumerState{Name: "test"}, 0
+	e = supervise("test", 1, time.Millisecond, time.Millisecond, state, set, make(chan bool, 1),
+		func() (bool, error) {
+			if calls++; calls == 1 {
+				return false, errors.New("connection refused")
+			}
+			return true, errConsumerStopped
+		})
+	if e != nil || calls != 2 || state.State != ConsumerStopped {
+		t.Errorf("%d calls, %s: %v", calls, state.State, e)
+	}
+}
+
+func TestReloadPGConsumers(t *testing.T) {
+	saved := globalConfig.PGQueues
+	defer func() { globalConfig.PGQueues = saved }()
+	// a running consumer, gone once it's told to exit
+	running := func(name string) *pgconsumer {
+		c := &pgconsumer{exitChannel: make(chan bool, 2), state: ConsumerState{Name: name}}
+		queuesLock.Lock()
+		pgqueues[name] = c
+		queuesLock.Unlock()
+		go func() {
+			<-c.exitChannel
+			queuesLock.Lock()
+			delete(pgqueues, name)
+			queuesLock.Unlock()
+		}()
+		return c
+	}
+	globalConfig.PGQueues = []*PGQueueConfig{
+		{Name: "kept", Table: "queue"}, {Name: "changed", Table: "queue"}, {Name: "removed", Table: "queue"},
+	}
+	kept, changed := running("kept"), running("changed")
+	running("removed")
+	defer stopPGConsumer("kept")
+	// the changed one is restarted and fails at once, its table is invalid
+	configs := []*PGQueueConfig{{Name: "kept", Table: "queue"}, {Name: "changed", Table: "bad table"}}
+	reloadPGConsumers(configs)
+	queuesLock.RLock()
+	k, c, r := pgqueues["kept"], pgqueues["changed"], pgqueues["removed"]
+	queuesLock.RUnlock()
+	if k != kept || c == changed || r != nil {
+		t.Errorf("consumers are reloaded wrong: %v %v %v", k == kept, c == changed, r != nil)
+	}
+	if !reflect.DeepEqual(globalConfig.PGQueues, configs) {
+		t.Error("pgqueue configs are not replaced")
+	}
+	stopPGConsumer("changed")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-checkChannel:
+		default:
+		}
+	}
+}
+
+func TestSecuritySwap(t *testing.T) {
+	saved := globalConfig.Security
+	defer func() { globalConfig.Security = saved }()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = globalConfig.security().ClockSkew
+		}
+	}()
+	// readers don't race with reloads ( go test -race )
+	for i := 0; i < 100; i++ {
+		reloadAuth(&Config{Auth: globalConfig.Auth, Security: &SecurityConfig{ClockSkew: time.Duration(i)}})
+	}
+	<-done
+	if globalConfig.security().ClockSkew != 99 {
+		t.Error("[security] is not swapped")
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databases of the same view are replicas of each other: same domains, records_api rows, owners;
+// SOA serial of a replica must not lag behind. Drift is reported against a source of truth
+// and a replica can be repaired from it.
+
+type replicaDrift struct {
+	Domain        string   `json:"domain"`
+	Replica       string   `json:"replica"`
+	MissingDomain bool     `json:"missing_domain,omitempty"`
+	ExtraDomain   bool     `json:"extra_domain,omitempty"`
+	Missing       []string `json:"missing,omitempty"` // records of source absent in replica
+	Extra         []string `json:"extra,omitempty"`   // records of replica absent in source
+	Owners        []string `json:"owners,omitempty"`  // records with different owners
+	SourceSerial  string   `json:"source_serial,omitempty"`
+	ReplicaSerial string   `json:"replica_serial,omitempty"`
+}
+
+type replicaReport struct {
+	View     DomainView     `json:"view"`
+	Source   string         `json:"source"`
+	Replicas []string       `json:"replicas"`
+	Checked  time.Time      `json:"checked"`
+	Drift    []replicaDrift `json:"drift"`
+}
+
+type replicaDomain struct {
+	domain  domainTable
+	records map[string]RecordsApiTable // by recordKey
+	soa     *RecordsTable
+}
+
+func recordKey(r *RecordsApiTable) string {
+	ttl, prio := 0, 0
+	if r.Ttl != nil {
+		ttl = *r.Ttl
+	}
+	if r.Prio != nil {
+		prio = *r.Prio
+	}
+	return fmt.Sprintf("%s %s %s ( ttl %d, prio %d )", r.Name, r.Type, r.Content, ttl, prio)
+}
+
+func soaSerial(soa *RecordsTable) string {
+	if soa == nil {
+		return ""
+	}
+	parts := strings.Fields(soa.Content)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+// serialBehind tells if the replica lags behind the source; a replica ahead is fine,
+// its serial is bumped on repair
+func serialBehind(source, replica *RecordsTable) bool {
+	if source == nil {
+		return false
+	}
+	if replica == nil {
+		return true
+	}
+	s, _ := strconv.Atoi(soaSerial(source))
+	r, _ := strconv.Atoi(soaSerial(replica))
+	return r < s
+}
+
+func setSOASerial(soa *RecordsTable, serial string) {
+	parts := strings.Fields(soa.Content)
+	if len(parts) < 3 {
+		return
+	}
+	parts[2] = serial
+	soa.Content = strings.Join(parts, " ")
+}
+
+func ownerOf(r *RecordsApiTable) string {
+	if r.Owner == nil {
+		return ""
+	}
+	return *r.Owner
+}
+
+// loadReplica reads domains ( all or the one named ) with their records & SOA
+func (d *orm) loadReplica(name string) (map[string]*replicaDomain, error) {
+	var domains []domainTable
+	q := d.db
+	if name != "" && name != DomainNameAny {
+		q = q.Where("name = ?", name)
+	}
+	if e := q.Find(&domains).Error; e != nil {
+		return nil, e
+	}
+	ret := make(map[string]*replicaDomain)
+	byId := make(map[uint]*replicaDomain)
+	ids := make([]uint, 0, len(domains))
+	for _, dom := range domains {
+		rd := &replicaDomain{domain: dom, records: make(map[string]RecordsApiTable)}
+		ret[dom.Name] = rd
+		byId[dom.Id] = rd
+		ids = append(ids, dom.Id)
+	}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	var records []RecordsApiTable
+	if e := d.db.Where("domain_id IN ?", ids).Find(&records).Error; e != nil {
+		return nil, e
+	}
+	for _, r := range records {
+		if rd, ok := byId[r.DomainId]; ok {
+			rd.records[recordKey(&r)] = r
+		}
+	}
+	var soas []RecordsTable
+	if e := d.db.Where("domain_id IN ? AND type = ?", ids, "SOA").Find(&soas).Error; e != nil {
+		return nil, e
+	}
+	for i := range soas {
+		if rd, ok := byId[soas[i].DomainId]; ok {
+			rd.soa = &soas[i]
+		}
+	}
+	return ret, nil
+}
+
+func compareReplicas(replica string, source, target map[string]*replicaDomain) []replicaDrift {
+	ret := make([]replicaDrift, 0)
+	names := make(map[string]bool)
+	for n := range source {
+		names[n] = true
+	}
+	for n := range target {
+		names[n] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	for _, n := range sorted {
+		s, t := source[n], target[n]
+		drift := replicaDrift{Domain: n, Replica: replica}
+		switch {
+		case t == nil:
+			drift.MissingDomain = true
+			drift.SourceSerial = soaSerial(s.soa)
+		case s == nil:
+			drift.ExtraDomain = true
+			drift.ReplicaSerial = soaSerial(t.soa)
+		default:
+			for k, r := range s.records {
+				if tr, ok := t.records[k]; !ok {
+					drift.Missing = append(drift.Missing, k)
+				} else if ownerOf(&r) != ownerOf(&tr) {
+					drift.Owners = append(drift.Owners, fmt.Sprintf("%s: %s != %s", k, ownerOf(&r), ownerOf(&tr)))
+				}
+			}
+			for k := range t.records {
+				if _, ok := s.records[k]; !ok {
+					drift.Extra = append(drift.Extra, k)
+				}
+			}
+			if len(drift.Missing) == 0 && len(drift.Extra) == 0 && len(drift.Owners) == 0 &&
+				!serialBehind(s.soa, t.soa) {
+				continue // in sync
+			}
+			sort.Strings(drift.Missing)
+			sort.Strings(drift.Extra)
+			sort.Strings(drift.Owners)
+			drift.SourceSerial, drift.ReplicaSerial = soaSerial(s.soa), soaSerial(t.soa)
+		}
+		ret = append(ret, drift)
+	}
+	return ret
+}
+
+func replicaOrms(view DomainView) []*orm {
+	ret := make([]*orm, 0)
+	for _, d := range currentOrms() {
+		if d.config.View == view {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+func findReplica(view DomainView, name string) (*orm, error) {
+	for _, d := range replicaOrms(view) {
+		if d.config.Name == name {
+			return d, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("database %s not found in view %s", name, view))
+}
+
+// replicaSource is the requested source, the configured one or the first database of the view
+func replicaSource(view DomainView, spec *ReplicaSpec) (*orm, error) {
+	if spec != nil && spec.Source != "" {
+		return findReplica(view, spec.Source)
+	}
+	if globalConfig.Reconcile != nil {
+		if name, ok := globalConfig.Reconcile.Sources[view]; ok {
+			return findReplica(view, name)
+		}
+	}
+	replicas := replicaOrms(view)
+	if len(replicas) == 0 {
+		return nil, errors.New(fmt.Sprintf("no databases in view %s", view))
+	}
+	return replicas[0], nil
+}
+
+func checkView(view DomainView, name string, spec *ReplicaSpec) (*replicaReport, error) {
+	source, e := replicaSource(view, spec)
+	if e != nil {
+		return nil, e
+	}
+	report := &replicaReport{
+		View:     view,
+		Source:   source.config.Name,
+		Replicas: make([]string, 0),
+		Checked:  time.Now(),
+		Drift:    make([]replicaDrift, 0),
+	}
+	src, e := source.loadReplica(name)
+	if e != nil {
+		return nil, errors.New(source.config.Name + ": " + e.Error())
+	}
+	for _, d := range replicaOrms(view) {
+		if d == source {
+			continue
+		}
+		report.Replicas = append(report.Replicas, d.config.Name)
+		dst, e := d.loadReplica(name)
+		if e != nil {
+			return nil, errors.New(d.config.Name + ": " + e.Error())
+		}
+		report.Drift = append(report.Drift, compareReplicas(d.config.Name, src, dst)...)
+	}
+	return report, nil
+}
+
+// checkReplicas reports drift per view, keyed by view so replies of several workers can be merged
+func checkReplicas(request *WunderRequest) (map[DomainView]*replicaReport, error) {
+	views := []DomainView{request.Domain.View}
+	if request.Domain.View == DomainViewAny {
+		views = []DomainView{DomainViewPublic, DomainViewPrivate}
+	}
+	ret := make(map[DomainView]*replicaReport)
+	for _, view := range views {
+		if len(replicaOrms(view)) == 0 {
+			continue
+		}
+		report, e := checkView(view, request.Domain.Name, request.Replica)
+		if e != nil {
+			return nil, e
+		}
+		ret[view] = report
+	}
+	return ret, nil
+}
+
+// repairReplica makes the target replica identical to the source for every drifted domain
+func repairReplica(request *WunderRequest) (n int, report *replicaReport, e error) {
+	view := request.Domain.View
+	if view == DomainViewAny {
+		return 0, nil, errors.New("repair_replica: view must be set")
+	}
+	if request.Replica == nil || request.Replica.Target == "" {
+		return 0, nil, errors.New("repair_replica: target is not set")
+	}
+	source, e := replicaSource(view, request.Replica)
+	if e != nil {
+		return 0, nil, e
+	}
+	target, e := findReplica(view, request.Replica.Target)
+	if e != nil {
+		return 0, nil, e
+	}
+	if source == target {
+		return 0, nil, errors.New("repair_replica: source and target are the same database")
+	}
+	src, e := source.loadReplica(request.Domain.Name)
+	if e != nil {
+		return 0, nil, errors.New(source.config.Name + ": " + e.Error())
+	}
+	dst, e := target.loadReplica(request.Domain.Name)
+	if e != nil {
+		return 0, nil, errors.New(target.config.Name + ": " + e.Error())
+	}
+	report = &replicaReport{
+		View:     view,
+		Source:   source.config.Name,
+		Replicas: []string{target.config.Name},
+		Checked:  time.Now(),
+		Drift:    compareReplicas(target.config.Name, src, dst),
+	}
+	for _, drift := range report.Drift {
+		var _n int
+		e = target.db.Transaction(func(tx *gorm.DB) error {
+			var e error
+			_n, e = repairDomain(tx, src[drift.Domain], dst[drift.Domain])
+			return e
+		})
+		if e != nil {
+			return n, report, errors.New(fmt.Sprintf("repair_replica: %s: %s", drift.Domain, e.Error()))
+		}
+		n += _n
+		logging.Warning(fmt.Sprintf("[reconcile] %s/%s repaired from %s: %d rows", target.config.Name,
+			drift.Domain, source.config.Name, _n))
+	}
+	return
+}
+
+func repairDomain(tx *gorm.DB, source, target *replicaDomain) (n int, e error) {
+	if source == nil { // extra domain - drop it
+		if e = tx.Where("domain_id = ?", target.domain.Id).Delete(&RecordsApiTable{}).Error; e != nil {
+			return
+		}
+		if e = tx.Where("domain_id = ?", target.domain.Id).Delete(&RecordsTable{}).Error; e != nil {
+			return
+		}
+		r := tx.Delete(&domainTable{}, target.domain.Id)
+		return int(r.RowsAffected), r.Error
+	}
+	if target == nil { // missing domain - create it empty
+		d := domainTable{Name: source.domain.Name, Type: source.domain.Type}
+		if e = tx.Create(&d).Error; e != nil {
+			return
+		}
+		n++
+		target = &replicaDomain{domain: d, records: make(map[string]RecordsApiTable)}
+	}
+	for k, r := range target.records {
+		if _, ok := source.records[k]; !ok {
+			if e = tx.Delete(&RecordsApiTable{}, r.Id).Error; e != nil {
+				return
+			}
+			n++
+		}
+	}
+	for k, r := range source.records {
+		tr, ok := target.records[k]
+		if !ok {
+			r.Id = 0
+			r.DomainId = target.domain.Id
+			if e = tx.Create(&r).Error; e != nil {
+				return
+			}
+			n++
+		} else if ownerOf(&r) != ownerOf(&tr) {
+			if e = tx.Model(&tr).Update("owner", r.Owner).Error; e != nil {
+				return
+			}
+			n++
+		}
+	}
+	switch {
+	case source.soa == nil:
+	case target.soa == nil:
+		soa := *source.soa
+		soa.Id = 0
+		soa.DomainId = target.domain.Id
+		if e = tx.Create(&soa).Error; e != nil {
+			return
+		}
+		n++
+	default:
+		// serial never goes back: take the source one if it's ahead, bump ours otherwise
+		if serialBehind(source.soa, target.soa) {
+			setSOASerial(target.soa, soaSerial(source.soa))
+			if e = tx.Save(target.soa).Error; e != nil {
+				return
+			}
+		} else if n > 0 {
+			e = ormUpdateSOA(tx, target.domain.Id)
+		}
+	}
+	return
+}
+
+// startReconciler checks replicas of every view periodically and logs the drift
+func startReconciler(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, view := range []DomainView{DomainViewPublic, DomainViewPrivate} {
+			if len(replicaOrms(view)) < 2 {
+				continue
+			}
+			report, e := checkView(view, DomainNameAny, nil)
+			if e != nil {
+				logging.Warning(fmt.Sprintf("[reconcile] %s check error: %s", view, e.Error()))
+				continue
+			}
+			for _, d := range report.Drift {
+				logging.Warning(fmt.Sprintf("[reconcile] %s/%s: %s differs from %s: missing domain %v, extra domain %v, "+
+					"missing %d, extra %d, owners %d, serial %s/%s", view, d.Domain, d.Replica, report.Source,
+					d.MissingDomain, d.ExtraDomain, len(d.Missing), len(d.Extra), len(d.Owners), d.SourceSerial,
+					d.ReplicaSerial))
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"testing"
+)
+
+func testReplicaDomain(name, serial string, records ...RecordsApiTable) *replicaDomain {
+	d := &replicaDomain{
+		domain:  domainTable{Name: name},
+		records: make(map[string]RecordsApiTable),
+		soa:     &RecordsTable{Type: "SOA", Content: "ns1.example.com admins.example.com " + serial + " 900 600 86400 600"},
+	}
+	for _, r := range records {
+		d.records[recordKey(&r)] = r
+	}
+	return d
+}
+
+func TestCompareReplicas(t *testing.T) {
+	ttl, alice, bob := 600, "alice", "bob"
+	a := RecordsApiTable{Name: "a.example.com", Type: "A", Content: "10.0.0.1", Ttl: &ttl, Owner: &alice}
+	b := RecordsApiTable{Name: "b.example.com", Type: "A", Content: "10.0.0.2", Ttl: &ttl, Owner: &alice}
+	bByBob := b
+	bByBob.Owner = &bob
+	c := RecordsApiTable{Name: "c.example.com", Type: "TXT", Content: "x", Ttl: &ttl, Owner: &alice}
+
+	source := map[string]*replicaDomain{
+		"example.com": testReplicaDomain("example.com", "2023010101", a, b),
+		"synced.com":  testReplicaDomain("synced.com", "2023010101", a),
+		"ahead.com":   testReplicaDomain("ahead.com", "2023010101", a),
+		"missing.com": testReplicaDomain("missing.com", "2023010101"),
+	}
+	target := map[string]*replicaDomain{
+		"example.com": testReplicaDomain("example.com", "2023010100", bByBob, c),
+		"synced.com":  testReplicaDomain("synced.com", "2023010101", a),
+		"ahead.com":   testReplicaDomain("ahead.com", "2023010102", a),
+		"extra.com":   testReplicaDomain("extra.com", "2023010101"),
+	}
+	drift := compareReplicas("public2", source, target)
+	if len(drift) != 3 {
+		t.Fatalf("expected 3 drifted domains, got %+v", drift)
+	}
+	// sorted by domain name
+	if d := drift[0]; d.Domain != "example.com" || len(d.Missing) != 1 || len(d.Extra) != 1 || len(d.Owners) != 1 ||
+		d.SourceSerial != "2023010101" || d.ReplicaSerial != "2023010100" || d.Replica != "public2" {
+		t.Errorf("wrong drift of example.com: %+v", d)
+	}
+	if d := drift[1]; d.Domain != "extra.com" || !d.ExtraDomain {
+		t.Errorf("wrong drift of extra.com: %+v", d)
+	}
+	if d := drift[2]; d.Domain != "missing.com" || !d.MissingDomain {
+		t.Errorf("wrong drift of missing.com: %+v", d)
+	}
+}
+
+func TestSetSOASerial(t *testing.T) {
+	soa := &RecordsTable{Content: "ns1.example.com admins.example.com 2023010101 900 600 86400 600"}
+	setSOASerial(soa, "2023010105")
+	if soaSerial(soa) != "2023010105" || soa.Content != "ns1.example.com admins.example.com 2023010105 900 600 86400 600" {
+		t.Errorf("serial is not updated: %s", soa.Content)
+	}
+	if serialBehind(soa, soa) || !serialBehind(soa, nil) || serialBehind(nil, soa) {
+		t.Errorf("serialBehind is wrong")
+	}
+}
@@ -13,7 +13,12 @@
 // limitations under the License.
 package wunderdns
 
-import "time"
+import (
+	"fmt"
+	"gopkg.in/go-ini/ini.v1"
+	"sync/atomic"
+	"time"
+)
 
 var checkChannel = make(chan bool, 2)
 
@@ -43,21 +48,45 @@ func Run() {
 	if err != nil {
 		logging.Fatal("initORMs error: ", err.Error())
 	}
+	startTwoPhase()
+	warnReplayProtection(globalConfig)
+	if globalConfig.Reconcile != nil && globalConfig.Reconcile.Interval > 0 {
+		go startReconciler(globalConfig.Reconcile.Interval)
+	}
+	go startExpiryWarnings()
+	if globalConfig.TokenStore != nil {
+		go startTokenStore()
+	}
+	if globalConfig.Scheduler == nil {
+		schedulerSection(ini.Empty().Section(""))
+	}
+	globalScheduler = newScheduler(globalConfig.Scheduler.Workers, globalConfig.Scheduler.Limits)
+	atomic.StoreInt32(&running, 1)
+	if globalConfig.Health != "" {
+		go startHealthServer(globalConfig.Health)
+	}
 	i := 1
 	for _, c := range globalConfig.AMQPConfigs {
-		go func() {
-			e := startAMQPQueue(c)
-			if e != nil {
-				checkChannel <- true
-				logging.Fatal("startAMQPQueue error: ", e.Error())
-			}
-		}()
+		runAMQPConsumer(c)
 		logging.Info("Running amqp consumer #", i)
 		i++
 	}
+	for _, c := range globalConfig.PGQueues {
+		runPGConsumer(c)
+		logging.Info("Running pgqueue consumer ", c.Name)
+	}
+	go handleReloadSignals()
+	if globalConfig.ReloadWatch > 0 {
+		go watchConfigFiles(globalConfig.ReloadWatch)
+	}
 	for {
 		<-checkChannel
-		if len(queues) == 0 {
+		reloadLock.Lock() // consumers are replaced on reload
+		queuesLock.RLock()
+		left := len(queues) + len(pgqueues)
+		queuesLock.RUnlock()
+		reloadLock.Unlock()
+		if left == 0 {
 			logging.Info("Zero queues left - exiting")
 			return
 		}
@@ -65,6 +94,15 @@ func Run() {
 
 }
 
+func runAMQPConsumer(c *AMQPConfig) {
+	aq := newAMQPQueue(c)
+	go func() {
+		if e := superviseAMQPQueue(c, aq); e != nil {
+			logging.Error(fmt.Sprintf("[%s] consumer error: %s", c.Name, e.Error()))
+		}
+	}()
+}
+
 func EnableOrm() {
 	ormOrSql = true
 }
@@ -0,0 +1,171 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"container/heap"
+	"sync"
+)
+
+type schedulerJob struct {
+	priority int
+	seq      uint64
+	run      func()
+}
+
+// jobHeap pops the highest priority first, FIFO within the same priority
+type jobHeap []*schedulerJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h *jobHeap) Push(x interface{}) {
+	*h = append(*h, x.(*schedulerJob))
+}
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// scheduler runs jobs on a bounded pool of workers, highest priority first,
+// while keeping every priority within its concurrency limit
+type scheduler struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	jobs    jobHeap
+	seq     uint64
+	running map[int]int
+	limits  map[int]int
+}
+
+var globalScheduler *scheduler
+
+const defaultSchedulerWorkers = 16
+
+// prefetchPerWorker is how many amqp deliveries are held per scheduler worker unless prefetch is set:
+// the scheduler needs a backlog of requests to run the urgent ones first
+const prefetchPerWorker = 4
+
+// prefetch is the configured one, or derived from the scheduler pool size
+func (c *AMQPConfig) prefetch() int {
+	if c.Prefetch > 0 {
+		return c.Prefetch
+	}
+	workers := defaultSchedulerWorkers
+	if globalConfig.Scheduler != nil {
+		workers = globalConfig.Scheduler.Workers
+	}
+	return workers * prefetchPerWorker
+}
+
+func newScheduler(workers int, limits map[int]int) *scheduler {
+	s := &scheduler{
+		jobs:    make(jobHeap, 0),
+		running: make(map[int]int),
+		limits:  limits,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *scheduler) submit(priority int, run func()) {
+	s.lock.Lock()
+	s.seq++
+	heap.Push(&s.jobs, &schedulerJob{priority: priority, seq: s.seq, run: run})
+	s.lock.Unlock()
+	s.cond.Signal()
+}
+
+// next must be called with lock held; returns nil if every queued job is over its limit
+func (s *scheduler) next() *schedulerJob {
+	skipped := make([]*schedulerJob, 0)
+	var job *schedulerJob
+	for s.jobs.Len() > 0 {
+		j := heap.Pop(&s.jobs).(*schedulerJob)
+		if limit, ok := s.limits[j.priority]; ok && s.running[j.priority] >= limit {
+			skipped = append(skipped, j)
+			continue
+		}
+		job = j
+		break
+	}
+	for _, j := range skipped {
+		heap.Push(&s.jobs, j)
+	}
+	return job
+}
+
+func (s *scheduler) worker() {
+	for {
+		s.lock.Lock()
+		job := s.next()
+		for job == nil {
+			s.cond.Wait()
+			job = s.next()
+		}
+		s.running[job.priority]++
+		s.lock.Unlock()
+
+		job.run()
+
+		s.lock.Lock()
+		s.running[job.priority]--
+		s.lock.Unlock()
+		s.cond.Broadcast() // a job over its limit may be runnable now
+	}
+}
+
+func tokenPriority(token string) int {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return 0
+	}
+	if v, ok := (*globalConfig.Auth)[token]; ok {
+		return v.Priority
+	}
+	return 0
+}
+
+// LookupPriority gives the priority of a token known to this process
+func LookupPriority(token string) (int, bool) {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return 0, false
+	}
+	v, ok := (*globalConfig.Auth)[token]
+	return v.Priority, ok
+}
+
+// schedulePriority runs a job through the global scheduler, or right away if there is none
+func schedulePriority(priority int, run func()) {
+	if globalScheduler == nil {
+		go run()
+		return
+	}
+	globalScheduler.submit(priority, run)
+}
@@ -0,0 +1,134 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler(0, map[int]int{}) // no workers yet - just queue
+	order := make([]int, 0)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i, p := range []int{0, 5, 0, 10, 5} {
+		i, p := i, p
+		wg.Add(1)
+		s.submit(p, func() {
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			wg.Done()
+		})
+	}
+	go s.worker() // single worker - strict order
+	wg.Wait()
+	expected := []int{3, 1, 4, 0, 2}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("wrong order: %v, expected %v", order, expected)
+		}
+	}
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	s := newScheduler(0, map[int]int{0: 1})
+	block := make(chan bool)
+	started := make(chan int, 3)
+	for i, p := range []int{0, 0, 1} {
+		i := i
+		s.submit(p, func() {
+			started <- i
+			<-block
+		})
+	}
+	for i := 0; i < 3; i++ {
+		go s.worker()
+	}
+	// priority 1 and a single priority 0 job may run, the second one waits for the limit
+	first, second := <-started, <-started
+	if first+second != 2 {
+		t.Fatalf("unexpected jobs started: %d, %d", first, second)
+	}
+	select {
+	case i := <-started:
+		t.Fatalf("job %d started over the limit", i)
+	default:
+	}
+	close(block)
+	if i := <-started; i != 1 {
+		t.Fatalf("unexpected job %d started", i)
+	}
+}
+
+func TestTokenPriority(t *testing.T) {
+	globalConfig.Auth = &AuthDatabase{
+		"urgent": {Token: "urgent", Priority: 10},
+	}
+	defer func() {
+		globalConfig.Auth = authdb
+	}()
+	if p := tokenPriority("urgent"); p != 10 {
+		t.Errorf("priority of urgent token is %d", p)
+	}
+	if p := tokenPriority("unknown"); p != 0 {
+		t.Errorf("priority of unknown token is %d", p)
+	}
+}
+
+// with default prefetch the broker hands over more requests than there are workers,
+// so the ones waiting are run by priority
+func TestSchedulerDefaultPrefetch(t *testing.T) {
+	globalConfig.Scheduler = nil
+	prefetch := (&AMQPConfig{}).prefetch()
+	workers := defaultSchedulerWorkers
+	backlog := prefetch - workers
+	if backlog < workers {
+		t.Fatalf("prefetch %d leaves no backlog for %d workers", prefetch, workers)
+	}
+	s := newScheduler(workers, map[int]int{})
+	started := make(chan int, prefetch)
+	gate := make(chan bool)
+	job := func(i int) func() {
+		return func() {
+			started <- i
+			<-gate
+		}
+	}
+	// every worker is busy with early low priority requests
+	for i := 0; i < workers; i++ {
+		s.submit(0, job(i))
+	}
+	for i := 0; i < workers; i++ {
+		<-started
+	}
+	// the rest of the prefetch window: low priority ones arrive before urgent ones
+	for i := workers; i < prefetch; i++ {
+		p := 0
+		if i >= workers+backlog/2 {
+			p = 10
+		}
+		s.submit(p, job(i))
+	}
+	// free one worker at a time, it takes the next job
+	for n := 0; n < backlog; n++ {
+		gate <- true
+		i := <-started
+		if urgent := i >= workers+backlog/2; urgent != (n < backlog-backlog/2) {
+			t.Fatalf("job %d is run as #%d of the backlog", i, n)
+		}
+	}
+	close(gate)
+}
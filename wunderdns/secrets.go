@@ -0,0 +1,316 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a token may have a few secrets, each of them is accepted until it expires: a new secret is staged,
+// clients move to it and the old one is retired. Secrets come from auth.ini / vault ( `secret.<name>` )
+// and from the token store - a table in one of [psql.*] databases shared by workers:
+// staged secrets are rows with values, retired auth.ini / vault secrets are rows with expiry only
+const tokenStoreSecretsSchema = `CREATE TABLE IF NOT EXISTS wunderdns_secrets (
+	token VARCHAR(255) NOT NULL,
+	id VARCHAR(64) NOT NULL,
+	secret VARCHAR(255) NOT NULL DEFAULT '',
+	expires TIMESTAMP WITH TIME ZONE NULL,
+	created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	PRIMARY KEY (token, id))`
+
+func secretId(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ParseSecret parses `secret.<name>` value: `<secret>[;expires=<time>]`
+func ParseSecret(value string) (TokenSecret, error) {
+	s := TokenSecret{Value: value}
+	if i := strings.LastIndex(value, ";expires="); i >= 0 {
+		t, e := parseValidityTime(strings.TrimSpace(value[i+len(";expires="):]))
+		if e != nil {
+			return s, e
+		}
+		s.Value, s.Expires = value[:i], t
+	}
+	if s.Value == "" {
+		return s, errors.New("empty secret")
+	}
+	s.Id = secretId(s.Value)
+	return s, nil
+}
+
+// activeSecrets lists secrets accepted now, Secret goes first
+func (a *AuthData) activeSecrets(now time.Time) []string {
+	ret := make([]string, 0, len(a.Secrets)+1)
+	for _, s := range a.allSecrets() {
+		if s.Value != "" && (s.Expires.IsZero() || now.Before(s.Expires)) {
+			if s.Value == a.Secret {
+				ret = append([]string{s.Value}, ret...)
+			} else {
+				ret = append(ret, s.Value)
+			}
+		}
+	}
+	return ret
+}
+
+// allSecrets gives Secrets, made of Secret if the token has the only one
+func (a *AuthData) allSecrets() []TokenSecret {
+	if len(a.Secrets) == 0 && a.Secret != "" {
+		return []TokenSecret{{Id: secretId(a.Secret), Value: a.Secret}}
+	}
+	return a.Secrets
+}
+
+// addSecret sets the secret or its expiry, secrets with ids only are retirements of known ones
+func (a *AuthData) addSecret(s TokenSecret) {
+	a.Secrets = a.allSecrets()
+	for i := range a.Secrets {
+		if a.Secrets[i].Id == s.Id {
+			a.Secrets[i].Expires = s.Expires
+			if s.Value != "" {
+				a.Secrets[i].Value = s.Value
+			}
+			return
+		}
+	}
+	if s.Value != "" {
+		a.Secrets = append(a.Secrets, s)
+	}
+}
+
+// storedSecrets is the last known content of the token store, it's applied to tokens
+// every time they're loaded
+var storedSecrets = struct {
+	lock    sync.RWMutex
+	secrets map[string][]TokenSecret
+}{secrets: make(map[string][]TokenSecret)}
+
+func applyStoredSecrets(a *AuthData) {
+	storedSecrets.lock.RLock()
+	defer storedSecrets.lock.RUnlock()
+	for _, s := range storedSecrets.secrets[a.Token] {
+		a.addSecret(s)
+	}
+}
+
+func tokenStore() (*orm, error) {
+	if globalConfig.TokenStore == nil {
+		return nil, errors.New("token store is not configured")
+	}
+	for _, d := range currentOrms() {
+		if d.config.Name == globalConfig.TokenStore.Database {
+			return d, nil
+		}
+	}
+	return nil, errors.New("token store database " + globalConfig.TokenStore.Database + " is not found")
+}
+
+func setupTokenStore() error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	if e := d.db.Exec(tokenStoreSecretsSchema).Error; e != nil {
+		return e
+	}
+	return setupTokenStoreTokens(d)
+}
+
+// refreshStoredSecrets loads the token store and applies it to the auth database
+func refreshStoredSecrets() error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	rows, e := d.db.Raw("SELECT token, id, secret, expires FROM wunderdns_secrets ORDER BY created").Rows()
+	if e != nil {
+		return e
+	}
+	defer rows.Close()
+	secrets := make(map[string][]TokenSecret)
+	for rows.Next() {
+		var token string
+		var s TokenSecret
+		var expires sql.NullTime
+		if e := rows.Scan(&token, &s.Id, &s.Value, &expires); e != nil {
+			return e
+		}
+		if expires.Valid {
+			s.Expires = expires.Time
+		}
+		secrets[token] = append(secrets[token], s)
+	}
+	storedSecrets.lock.Lock()
+	storedSecrets.secrets = secrets
+	storedSecrets.lock.Unlock()
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	for token, v := range *globalConfig.Auth {
+		if _, ok := secrets[token]; ok {
+			applyStoredSecrets(&v)
+			(*globalConfig.Auth)[token] = v
+		}
+	}
+	return nil
+}
+
+func startTokenStore() {
+	if e := setupTokenStore(); e != nil {
+		logging.Error("[tokenstore] ", e.Error())
+		return
+	}
+	for {
+		if e := refreshStoredTokens(); e != nil {
+			logging.Warning("[tokenstore] refresh error: ", e.Error())
+		}
+		if e := refreshStoredSecrets(); e != nil {
+			logging.Warning("[tokenstore] refresh error: ", e.Error())
+		}
+		time.Sleep(globalConfig.TokenStore.Refresh)
+	}
+}
+
+// storeSecret saves the secret ( or the expiry of a known one ) and applies it right away
+func storeSecret(token string, s TokenSecret) error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	var expires interface{}
+	if !s.Expires.IsZero() {
+		expires = s.Expires
+	}
+	if e := d.db.Exec(`INSERT INTO wunderdns_secrets (token, id, secret, expires) VALUES (?, ?, ?, ?)
+		ON CONFLICT (token, id) DO UPDATE SET expires = EXCLUDED.expires`, token, s.Id, s.Value, expires).Error; e != nil {
+		return e
+	}
+	storedSecrets.lock.Lock()
+	storedSecrets.secrets[token] = append(storedSecrets.secrets[token], s)
+	storedSecrets.lock.Unlock()
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	if v, ok := (*globalConfig.Auth)[token]; ok {
+		v.addSecret(s)
+		(*globalConfig.Auth)[token] = v
+	}
+	return nil
+}
+
+// requestToken gives the token of the request, identities asserted by delegates can't manage it
+func requestToken(request *WunderRequest) (AuthData, error) {
+	if request.Asserted != nil {
+		return AuthData{}, errors.New("asserted identities can't manage the delegate token")
+	}
+	authDataLock.RLock()
+	v, ok := (*globalConfig.Auth)[request.Auth.Token]
+	authDataLock.RUnlock()
+	if !ok {
+		return v, errors.New("unknown token")
+	}
+	return v, nil
+}
+
+// checkSecretCommand refuses secret changes of identities asserted by delegates & tokens without secrets;
+// legacy signatures don't cover the secret spec, so they aren't accepted either
+func checkSecretCommand(request *WunderRequest) (AuthData, error) {
+	v, e := requestToken(request)
+	if e != nil {
+		return v, e
+	}
+	if request.Auth.Version < SignatureV2 {
+		return v, errors.New("secrets are managed with v2 signatures only")
+	}
+	if len(v.PublicKey) > 0 {
+		return v, errors.New("token has a public key, not secrets")
+	}
+	return v, nil
+}
+
+// stageSecret generates a new secret of the token, accepted along with the current ones
+func stageSecret(request *WunderRequest) (map[string]string, error) {
+	if _, e := checkSecretCommand(request); e != nil {
+		return nil, e
+	}
+	b := make([]byte, 24)
+	if _, e := rand.Read(b); e != nil {
+		return nil, e
+	}
+	s := TokenSecret{Value: hex.EncodeToString(b)}
+	s.Id = secretId(s.Value)
+	if e := storeSecret(request.Auth.Token, s); e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] secret ", s.Id, " of ", request.Auth.Token, " is staged")
+	return map[string]string{"id": s.Id, "secret": s.Value}, nil
+}
+
+// retireSecret makes the secret expire after the grace period, some other secret must stay active
+func retireSecret(request *WunderRequest) (map[string]interface{}, error) {
+	v, e := checkSecretCommand(request)
+	if e != nil {
+		return nil, e
+	}
+	if request.Secret == nil || request.Secret.Id == "" {
+		return nil, errors.New("secret id is not set")
+	}
+	if request.Secret.Grace < 0 {
+		return nil, errors.New("grace period can't be negative")
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(request.Secret.Grace) * time.Second)
+	found, remains := false, false
+	for _, s := range v.allSecrets() {
+		if s.Expires.IsZero() || now.Before(s.Expires) {
+			if s.Id == request.Secret.Id {
+				found = true
+			} else if s.Expires.IsZero() || s.Expires.After(expires) {
+				remains = true
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("secret " + request.Secret.Id + " is not active")
+	}
+	if !remains {
+		return nil, errors.New("no other secret would be left, stage a new one first")
+	}
+	if e := storeSecret(request.Auth.Token, TokenSecret{Id: request.Secret.Id, Expires: expires}); e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] secret ", request.Secret.Id, " of ", request.Auth.Token, " expires at ", expires)
+	return map[string]interface{}{"id": request.Secret.Id, "expires": expires}, nil
+}
+
+// LookupSecrets gives active secrets of a token to the api gateway running in the same process
+func LookupSecrets(token string) []string {
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	if globalConfig.Auth == nil {
+		return nil
+	}
+	v, ok := (*globalConfig.Auth)[token]
+	if !ok {
+		return nil
+	}
+	return v.activeSecrets(time.Now())
+}
@@ -0,0 +1,108 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSecret(t *testing.T) {
+	s, e := ParseSecret("a;b;expires=2030-01-02")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.Value != "a;b" || s.Expires.Format("2006-01-02") != "2030-01-02" || s.Id != secretId("a;b") {
+		t.Errorf("secret is parsed wrong: %v", s)
+	}
+	for _, bad := range []string{"", ";expires=2030-01-02", "x;expires=soon"} {
+		if _, e := ParseSecret(bad); e == nil {
+			t.Errorf("%q is accepted", bad)
+		}
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	now := time.Now()
+	a := AuthData{Token: "rot", Secret: "old"}
+	if s := a.activeSecrets(now); len(s) != 1 || s[0] != "old" {
+		t.Fatalf("single secret: %v", s)
+	}
+	a.addSecret(TokenSecret{Id: secretId("new"), Value: "new"})
+	a.addSecret(TokenSecret{Id: secretId("gone"), Value: "gone", Expires: now.Add(-time.Second)})
+	if s := a.activeSecrets(now); len(s) != 2 || s[0] != "old" || s[1] != "new" {
+		t.Fatalf("rotation: %v", s)
+	}
+	// retirement of a known secret by its id only
+	a.addSecret(TokenSecret{Id: secretId("old"), Expires: now.Add(time.Minute)})
+	if s := a.activeSecrets(now.Add(2 * time.Minute)); len(s) != 1 || s[0] != "new" {
+		t.Fatalf("retired: %v", s)
+	}
+	a.addSecret(TokenSecret{Id: "unknown"})
+	if len(a.Secrets) != 3 {
+		t.Errorf("unknown retirement is added: %v", a.Secrets)
+	}
+
+	db := &AuthDatabase{"rot": a}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	for secret, expected := range map[string]bool{"old": true, "new": true, "gone": false, "other": false} {
+		req := &WunderRequest{Cmd: CommandListDomains, Domain: &Domain{Name: "*", View: DomainViewPublic}}
+		if e := SignRequest(req, "rot", secret); e != nil {
+			t.Fatal(e)
+		}
+		if db.checkAuthentication(req) != expected {
+			t.Errorf("signed with %s: expected %v", secret, expected)
+		}
+	}
+	if secret, ok := LookupSecret("rot"); !ok || secret != "old" {
+		t.Errorf("primary secret is %s", secret)
+	}
+
+	// the last active secret can't be retired
+	req := &WunderRequest{Auth: &AuthHeader{Token: "rot", Version: SignatureV2}, Secret: &SecretSpec{Id: secretId("new")}}
+	(*db)["rot"] = AuthData{Token: "rot", Secret: "new"}
+	if _, e := retireSecret(req); e == nil || e.Error() == "secrets are managed with v2 signatures only" {
+		t.Errorf("the last secret is retired: %v", e)
+	}
+	req.Asserted = &Assertion{Subject: "alice"}
+	if _, e := stageSecret(req); e == nil {
+		t.Error("asserted identity stages a secret")
+	}
+}
+
+func TestSecretCommandsNeedV2(t *testing.T) {
+	db := &AuthDatabase{"rot": {Token: "rot", Secret: "old"}}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	for _, cmd := range []Command{CommandStageSecret, CommandRetireSecret} {
+		// a legacy signature doesn't cover the secret spec, it could be swapped in a captured request
+		req := &WunderRequest{Cmd: cmd, Domain: &Domain{Name: "*", View: DomainViewAny},
+			Secret: &SecretSpec{Id: secretId("old")}}
+		signV1(req, "rot", "old")
+		if !db.checkAuthentication(req) {
+			t.Fatalf("%s: v1 signature is rejected", cmd)
+		}
+		if e := securityProcessRequest(req); e == nil {
+			t.Errorf("%s is allowed with a v1 signature", cmd)
+		}
+	}
+	req := &WunderRequest{Auth: &AuthHeader{Token: "rot"}}
+	if _, e := stageSecret(req); e == nil {
+		t.Error("secret is staged with a v1 signature")
+	}
+	if _, e := retireSecret(req); e == nil {
+		t.Error("secret is retired with a v1 signature")
+	}
+}
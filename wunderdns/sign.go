@@ -0,0 +1,307 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2 signature: hex HMAC-SHA256 with the secret over the canonical request - JSON of the whole
+// request with the auth header but its sum, keys sorted, no insignificant whitespace, no html escaping.
+// The header carries a random nonce & unix timestamp, so a signature is good for a single request
+// within the clock skew window only.
+//
+// Ed25519 signatures follow the same rules, the sum is hex signature of the canonical request
+// made with the private key of the token; the worker knows its public key only.
+const (
+	SignatureV2      = 2
+	SignatureEd25519 = 3
+)
+
+// CanonicalRequest is what v2 signatures are calculated over
+func CanonicalRequest(request *WunderRequest) ([]byte, error) {
+	clone := *request
+	if request.Auth != nil {
+		auth := *request.Auth
+		auth.Sum = ""
+		clone.Auth = &auth
+	}
+	j, e := json.Marshal(&clone)
+	if e != nil {
+		return nil, e
+	}
+	// a round trip through interface{} sorts keys of every object
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	if e = dec.Decode(&generic); e != nil {
+		return nil, e
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if e = enc.Encode(generic); e != nil {
+		return nil, e
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func hmacSum(secret string, data []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(data)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SignRequest sets a v2 auth header of the token on the request
+func SignRequest(request *WunderRequest, token, secret string) error {
+	nonce := make([]byte, 16)
+	if _, e := rand.Read(nonce); e != nil {
+		return e
+	}
+	request.Auth = &AuthHeader{
+		Token:     token,
+		Version:   SignatureV2,
+		Nonce:     hex.EncodeToString(nonce),
+		Timestamp: time.Now().Unix(),
+	}
+	data, e := CanonicalRequest(request)
+	if e != nil {
+		return e
+	}
+	request.Auth.Sum = hmacSum(secret, data)
+	return nil
+}
+
+// SignRequestEd25519 sets an Ed25519 auth header of the token on the request
+func SignRequestEd25519(request *WunderRequest, token string, key ed25519.PrivateKey) error {
+	nonce := make([]byte, 16)
+	if _, e := rand.Read(nonce); e != nil {
+		return e
+	}
+	request.Auth = &AuthHeader{
+		Token:     token,
+		Version:   SignatureEd25519,
+		Nonce:     hex.EncodeToString(nonce),
+		Timestamp: time.Now().Unix(),
+	}
+	data, e := CanonicalRequest(request)
+	if e != nil {
+		return e
+	}
+	request.Auth.Sum = hex.EncodeToString(ed25519.Sign(key, data))
+	return nil
+}
+
+// parsePublicKey accepts base64 or hex encoded Ed25519 public key
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	b, e := base64.StdEncoding.DecodeString(s)
+	if e != nil || len(b) != ed25519.PublicKeySize {
+		if b, e = hex.DecodeString(s); e != nil {
+			return nil, errors.New("public key is neither base64 nor hex")
+		}
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("public key is not an ed25519 key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// checkSignatureV2 accepts the signature made with any of the secrets
+func checkSignatureV2(request *WunderRequest, secrets []string) bool {
+	return checkSignedRequest(request, func(data []byte) bool {
+		for _, secret := range secrets {
+			if hmac.Equal([]byte(hmacSum(secret, data)), []byte(request.Auth.Sum)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func checkSignatureEd25519(request *WunderRequest, key ed25519.PublicKey) bool {
+	return checkSignedRequest(request, func(data []byte) bool {
+		sig, e := hex.DecodeString(request.Auth.Sum)
+		return e == nil && ed25519.Verify(key, data, sig)
+	})
+}
+
+// checkSignedRequest checks timestamp window, the signature and reserves the nonce
+func checkSignedRequest(request *WunderRequest, verify func([]byte) bool) bool {
+	skew := globalConfig.security().ClockSkew
+	ts := time.Unix(request.Auth.Timestamp, 0)
+	if d := time.Since(ts); d > skew || d < -skew {
+		logging.Debug("[auth] request timestamp is out of window: ", request.Auth.Token)
+		return false
+	}
+	if request.Auth.Nonce == "" {
+		logging.Debug("[auth] request has no nonce: ", request.Auth.Token)
+		return false
+	}
+	data, e := CanonicalRequest(request)
+	if e != nil {
+		return false
+	}
+	if !verify(data) {
+		return false
+	}
+	ok, e := currentNonceStore().reserve(request.Auth.Token+"/"+request.Auth.Nonce, ts.Add(skew))
+	if e != nil {
+		logging.Error("[auth] can't reserve nonce of ", request.Auth.Token, ": ", e.Error())
+		return false
+	}
+	if !ok {
+		logging.Warning("[auth] replayed request of ", request.Auth.Token, ", nonce ", request.Auth.Nonce)
+		return false
+	}
+	return true
+}
+
+// nonceStore remembers nonces of accepted requests until their timestamps leave the window.
+// The in-process replayCache protects a single worker only: with a shared queue ( amqp queue or pgqueue )
+// a replayed request may reach another worker, which has never seen the nonce - set [security]
+// nonce_database to keep nonces in a table every worker checks.
+type nonceStore interface {
+	reserve(key string, until time.Time) (bool, error)
+	release(key string)
+}
+
+func currentNonceStore() nonceStore {
+	if globalConfig.security().NonceDatabase != "" {
+		return sharedNonceStore
+	}
+	return nonces
+}
+
+// replayCache keeps nonces in memory of this worker
+type replayCache struct {
+	lock   sync.Mutex
+	seen   map[string]time.Time
+	purged time.Time
+}
+
+var nonces = &replayCache{seen: make(map[string]time.Time)}
+
+func (c *replayCache) reserve(key string, until time.Time) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Sub(c.purged) > time.Minute {
+		for k, v := range c.seen {
+			if v.Before(now) {
+				delete(c.seen, k)
+			}
+		}
+		c.purged = now
+	}
+	if _, ok := c.seen[key]; ok {
+		return false, nil
+	}
+	c.seen[key] = until
+	return true, nil
+}
+
+// release gives the nonce back for requests which are going to be retried
+func (c *replayCache) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.seen, key)
+}
+
+const nonceSchema = `CREATE TABLE IF NOT EXISTS wunderdns_nonces (nonce VARCHAR(255) PRIMARY KEY, expires TIMESTAMP NOT NULL)`
+
+// sharedNonces keeps nonces in wunderdns_nonces of [security] nonce_database, the primary key
+// makes a nonce reserved by one worker taken for all of them
+type sharedNonces struct {
+	exec   func(query string, args ...interface{}) (int64, error)
+	lock   sync.Mutex
+	purged time.Time
+}
+
+var sharedNonceStore = &sharedNonces{exec: nonceDatabaseExec}
+
+// nonceDatabaseExec runs a statement in the nonce database, creating the table first
+func nonceDatabaseExec(query string, args ...interface{}) (int64, error) {
+	name := globalConfig.security().NonceDatabase
+	for _, d := range currentOrms() {
+		if d.config.Name != name {
+			continue
+		}
+		if e := d.db.Exec(nonceSchema).Error; e != nil {
+			return 0, e
+		}
+		r := d.db.Exec(query, args...)
+		return r.RowsAffected, r.Error
+	}
+	return 0, errors.New("nonce database " + name + " is not found")
+}
+
+func (s *sharedNonces) reserve(key string, until time.Time) (bool, error) {
+	s.lock.Lock()
+	if now := time.Now(); now.Sub(s.purged) > time.Minute {
+		s.purged = now
+		s.lock.Unlock()
+		// clocks of workers differ a bit - keep nonces a window longer than needed
+		if _, e := s.exec("DELETE FROM wunderdns_nonces WHERE expires < ?",
+			now.Add(-globalConfig.security().ClockSkew)); e != nil {
+			logging.Warning("[auth] can't purge nonces: ", e.Error())
+		}
+	} else {
+		s.lock.Unlock()
+	}
+	n, e := s.exec("INSERT INTO wunderdns_nonces (nonce, expires) VALUES (?, ?) ON CONFLICT (nonce) DO NOTHING",
+		key, until)
+	if e != nil {
+		return false, e
+	}
+	return n == 1, nil
+}
+
+func (s *sharedNonces) release(key string) {
+	if _, e := s.exec("DELETE FROM wunderdns_nonces WHERE nonce = ?", key); e != nil {
+		logging.Warning("[auth] can't release nonce: ", e.Error())
+	}
+}
+
+func releaseNonce(request *WunderRequest) {
+	if request.Auth != nil && request.Auth.Version >= SignatureV2 {
+		currentNonceStore().release(request.Auth.Token + "/" + request.Auth.Nonce)
+	}
+}
+
+// warnReplayProtection tells if workers share requests while each of them checks nonces on its own
+func warnReplayProtection(c *Config) {
+	if c.security().NonceDatabase != "" {
+		return
+	}
+	shared := len(c.PGQueues) > 0
+	for _, a := range c.AMQPConfigs {
+		shared = shared || a.Queue != ""
+	}
+	if shared {
+		logging.Warning("[auth] requests are consumed from a shared queue, but nonces are checked by each worker " +
+			"on its own: a replayed request may reach another worker - set [security] nonce_database")
+	}
+}
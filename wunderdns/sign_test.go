@@ -0,0 +1,273 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testSignedRequest(t *testing.T) *WunderRequest {
+	req := &WunderRequest{
+		Cmd: CommandCreateRecord,
+		Domain: &Domain{
+			Name: "test.com",
+			View: DomainViewPublic,
+		},
+		Record: []*Record{
+			{Name: "www", Type: RecordTypeA, Data: []string{"10.0.0.1"}, TTL: 600},
+		},
+	}
+	if e := SignRequest(req, "test", "test"); e != nil {
+		t.Fatal(e)
+	}
+	return req
+}
+
+// requests come through json, just like from amqp
+func testTransmit(t *testing.T, req *WunderRequest) *WunderRequest {
+	j, e := json.Marshal(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	ret := new(WunderRequest)
+	if e := json.Unmarshal(j, ret); e != nil {
+		t.Fatal(e)
+	}
+	return ret
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	req := &WunderRequest{
+		Auth:   &AuthHeader{Token: "t", Sum: "sum", Version: SignatureV2, Nonce: "n", Timestamp: 1},
+		Cmd:    CommandListRecords,
+		Domain: &Domain{Name: "<a&b>.com", View: DomainViewPublic},
+	}
+	c, e := CanonicalRequest(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := `{"a":{"o":"n","t":"t","ts":1,"v":2,"x":""},"c":"list_records","d":{"n":"<a&b>.com","v":"public"},` +
+		`"n":"","p":false,"r":null}`
+	if string(c) != expected {
+		t.Errorf("canonical request is\n%s\nexpected\n%s", c, expected)
+	}
+	if req.Auth.Sum != "sum" {
+		t.Error("canonical request altered the original")
+	}
+}
+
+func TestCheckSignatureV2(t *testing.T) {
+	globalConfig.Security = nil
+	defer func() { globalConfig.Security = nil }()
+
+	req := testSignedRequest(t)
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Fatal("valid request is rejected")
+	}
+	if authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Error("replayed request is accepted")
+	}
+	releaseNonce(req)
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Error("released nonce is not accepted")
+	}
+
+	req = testSignedRequest(t)
+	tampered := testTransmit(t, req)
+	tampered.Record[0].TTL = 1
+	if authdb.checkAuthentication(tampered) {
+		t.Error("request with altered ttl is accepted")
+	}
+	tampered = testTransmit(t, req)
+	tampered.Pretty = true
+	if authdb.checkAuthentication(tampered) {
+		t.Error("request with altered pretty flag is accepted")
+	}
+
+	req = testSignedRequest(t)
+	req.Auth.Timestamp = time.Now().Add(-time.Hour).Unix()
+	data, _ := CanonicalRequest(req)
+	req.Auth.Sum = hmacSum("test", data)
+	if authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Error("request out of clock skew window is accepted")
+	}
+}
+
+func TestAllowV1(t *testing.T) {
+	defer func() { globalConfig.Security = nil }()
+	req := testSignedRequest(t)
+	req.Auth = &AuthHeader{Token: "test"}
+	// legacy signature of the producer
+	x := sha256.Sum256([]byte("test@" + createVariodicHash(req, 0)))
+	req.Auth.Sum = fmt.Sprintf("%0x", x)
+	globalConfig.Security = &SecurityConfig{AllowV1: true, V1Skew: time.Minute, ClockSkew: time.Minute}
+	if !authdb.checkAuthentication(req) {
+		t.Error("v1 signature is rejected while allowed")
+	}
+	globalConfig.Security.AllowV1 = false
+	if authdb.checkAuthentication(req) {
+		t.Error("v1 signature is accepted while not allowed")
+	}
+}
+
+func TestCheckSignatureEd25519(t *testing.T) {
+	pub, priv, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	key, e := parsePublicKey(base64.StdEncoding.EncodeToString(pub))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := parsePublicKey(hex.EncodeToString(pub)); e != nil {
+		t.Errorf("hex public key is not parsed: %s", e.Error())
+	}
+	if _, e := parsePublicKey("AAAA"); e == nil {
+		t.Error("short public key is parsed")
+	}
+	db := &AuthDatabase{
+		"keyed": {Token: "keyed", PublicKey: key, Permissions: (*authdb)["test"].Permissions},
+	}
+	req := &WunderRequest{
+		Cmd:    CommandListRecords,
+		Domain: &Domain{Name: "test.com", View: DomainViewPublic},
+	}
+	if e := SignRequestEd25519(req, "keyed", priv); e != nil {
+		t.Fatal(e)
+	}
+	if !db.checkAuthentication(testTransmit(t, req)) {
+		t.Fatal("valid ed25519 request is rejected")
+	}
+	if db.checkAuthentication(testTransmit(t, req)) {
+		t.Error("replayed ed25519 request is accepted")
+	}
+	// a token with a public key has no secret to sign with
+	if e := SignRequest(req, "keyed", ""); e != nil {
+		t.Fatal(e)
+	}
+	if db.checkAuthentication(testTransmit(t, req)) {
+		t.Error("hmac request of a token with public key is accepted")
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if e := SignRequestEd25519(req, "keyed", other); e != nil {
+		t.Fatal(e)
+	}
+	if db.checkAuthentication(testTransmit(t, req)) {
+		t.Error("request signed by other key is accepted")
+	}
+}
+
+// testNonceTable is wunderdns_nonces as seen by every worker
+type testNonceTable struct {
+	lock  sync.Mutex
+	rows  map[string]time.Time
+	fails bool
+}
+
+func (tb *testNonceTable) exec(query string, args ...interface{}) (int64, error) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	if tb.fails {
+		return 0, errors.New("database is down")
+	}
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		if _, ok := tb.rows[args[0].(string)]; ok {
+			return 0, nil
+		}
+		tb.rows[args[0].(string)] = args[1].(time.Time)
+		return 1, nil
+	case strings.Contains(query, "WHERE nonce"):
+		delete(tb.rows, args[0].(string))
+		return 1, nil
+	default: // purge
+		n := int64(0)
+		for k, v := range tb.rows {
+			if v.Before(args[0].(time.Time)) {
+				delete(tb.rows, k)
+				n++
+			}
+		}
+		return n, nil
+	}
+}
+
+// workers of a shared queue: each has its own memory, a replayed request may come to any of them
+func TestSharedNonces(t *testing.T) {
+	savedCache, savedStore := nonces, sharedNonceStore
+	defer func() {
+		nonces, sharedNonceStore = savedCache, savedStore
+		globalConfig.Security = nil
+	}()
+	worker := func() { nonces = &replayCache{seen: make(map[string]time.Time)} }
+
+	// in-process nonces only - the other worker accepts the replay
+	globalConfig.Security = nil
+	req := testSignedRequest(t)
+	worker()
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Fatal("valid request is rejected")
+	}
+	worker()
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Fatal("in-process nonces are expected to protect a single worker only")
+	}
+
+	// shared nonces - the other worker rejects it
+	security := defaultSecurityConfig
+	security.NonceDatabase = "public1"
+	globalConfig.Security = &security
+	table := &testNonceTable{rows: make(map[string]time.Time)}
+	sharedNonceStore = &sharedNonces{exec: table.exec}
+	req = testSignedRequest(t)
+	worker()
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Fatal("valid request is rejected")
+	}
+	worker()
+	if authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Error("request replayed to another worker is accepted")
+	}
+	// a retried request gives the nonce back to every worker
+	releaseNonce(req)
+	worker()
+	if !authdb.checkAuthentication(testTransmit(t, req)) {
+		t.Error("released nonce is not accepted by another worker")
+	}
+	// nonces can't be checked - nothing is accepted
+	table.fails = true
+	if authdb.checkAuthentication(testTransmit(t, testSignedRequest(t))) {
+		t.Error("request is accepted while nonces can't be reserved")
+	}
+	table.fails = false
+	// expired nonces are purged
+	table.rows["old"] = time.Now().Add(-time.Hour)
+	sharedNonceStore.purged = time.Time{}
+	if ok, e := sharedNonceStore.reserve("new", time.Now().Add(time.Minute)); !ok || e != nil {
+		t.Fatalf("nonce is not reserved: %v", e)
+	}
+	if _, ok := table.rows["old"]; ok {
+		t.Error("expired nonce is not purged")
+	}
+}
@@ -14,7 +14,9 @@
 package wunderdns
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -36,9 +38,25 @@ const (
 	CommandListDomains   Command = "list_domains"
 	CommandSearchRecord  Command = "search_record"
 	CommandReplaceOwner  Command = "replace_owner"
+	CommandCheckReplicas Command = "check_replicas"
+	CommandRepairReplica Command = "repair_replica"
+	CommandTokenInfo     Command = "token_info"
+	CommandStageSecret   Command = "stage_secret"
+	CommandRetireSecret  Command = "retire_secret"
+	CommandCreateToken   Command = "create_token"
+	CommandRevokeToken   Command = "revoke_token"
+	CommandListTokens    Command = "list_tokens"
 	CommandAny           Command = "*"
 )
 
+// token store administration, tokens with `admin = true` only
+const (
+	CommandAdminCreateToken Command = "admin_create_token"
+	CommandAdminUpdateToken Command = "admin_update_token"
+	CommandAdminRevokeToken Command = "admin_revoke_token"
+	CommandAdminListTokens  Command = "admin_list_tokens"
+)
+
 const (
 	DomainViewPublic  DomainView = "public"
 	DomainViewPrivate DomainView = "private"
@@ -55,6 +73,7 @@ const (
 	RecordTypeNS    RecordType = "NS"
 	RecordTypePTR   RecordType = "PTR"
 	RecordTypeSOA   RecordType = "SOA"
+	RecordTypeCAA   RecordType = "CAA"
 )
 
 var domainViews = map[DomainView]bool{
@@ -73,6 +92,19 @@ var commands = map[Command]bool{
 	CommandReplaceRecord: true,
 	CommandSearchRecord:  true,
 	CommandReplaceOwner:  true,
+	CommandCheckReplicas: true,
+	CommandRepairReplica: true,
+	CommandTokenInfo:     true,
+	CommandStageSecret:   true,
+	CommandRetireSecret:  true,
+	CommandCreateToken:   true,
+	CommandRevokeToken:   true,
+	CommandListTokens:    true,
+
+	CommandAdminCreateToken: true,
+	CommandAdminUpdateToken: true,
+	CommandAdminRevokeToken: true,
+	CommandAdminListTokens:  true,
 }
 
 var recordTypes = map[RecordType]bool{
@@ -85,17 +117,52 @@ var recordTypes = map[RecordType]bool{
 	RecordTypeNS:    true,
 	RecordTypeSOA:   true,
 	RecordTypePTR:   true,
+	RecordTypeCAA:   true,
 }
 
 const DomainNameAny string = "*"
 
 type WunderRequest struct {
-	Auth     *AuthHeader `json:"a"`
-	Cmd      Command     `json:"c"`
-	Domain   *Domain     `json:"d"`
-	Record   []*Record   `json:"r"`
-	NewToken string      `json:"n"`
-	Pretty   bool        `json:"p"`
+	Auth      *AuthHeader  `json:"a"`
+	Cmd       Command      `json:"c"`
+	Domain    *Domain      `json:"d"`
+	Record    []*Record    `json:"r"`
+	NewToken  string       `json:"n"`
+	Pretty    bool         `json:"p"`
+	Replica   *ReplicaSpec `json:"rp,omitempty"`
+	Asserted  *Assertion   `json:"as,omitempty"`
+	Secret    *SecretSpec  `json:"sc,omitempty"`
+	Origin    string       `json:"o,omitempty"` // client address seen by the api
+	TokenSpec *TokenSpec   `json:"tk,omitempty"`
+}
+
+// Assertion is an identity vouched for by a delegate token ( e.g. an OIDC user authenticated by the api );
+// the request is permitted by both delegate's and asserted permissions and records are owned by the subject
+type Assertion struct {
+	Subject     string       `json:"s"`
+	Permissions []Permission `json:"p"`
+}
+
+// ReplicaSpec selects databases for check_replicas & repair_replica, by [psql.<name>]
+type ReplicaSpec struct {
+	Source string `json:"s"` // source of truth, [reconcile] source.<view> if empty
+	Target string `json:"t"` // replica to repair
+}
+
+// TokenSpec describes the token create_token & admin_*_token commands create, update or revoke
+type TokenSpec struct {
+	Token       string   `json:"t,omitempty"`
+	Permissions []string `json:"p,omitempty"` // ACL lines `<view>,<domain mask>=<permissions>`
+	Priority    int      `json:"pr,omitempty"`
+	Expires     int64    `json:"e,omitempty"` // unix time
+	Children    int      `json:"ch,omitempty"`
+	AllowFrom   []string `json:"af,omitempty"`
+}
+
+// SecretSpec selects the secret retire_secret retires and when
+type SecretSpec struct {
+	Id    string `json:"i"`
+	Grace int64  `json:"g,omitempty"` // seconds the secret is still accepted
 }
 
 type WunderReply struct {
@@ -104,9 +171,12 @@ type WunderReply struct {
 }
 
 type AuthHeader struct {
-	Token    string `json:"t"`
-	Sum      string `json:"x"`
-	priority int
+	Token     string `json:"t"`
+	Sum       string `json:"x"`
+	Version   int    `json:"v,omitempty"`  // signature version, 0 or 1 - legacy
+	Nonce     string `json:"o,omitempty"`  // v2: random, never reused
+	Timestamp int64  `json:"ts,omitempty"` // v2: unix time of signing
+	priority  int
 }
 
 type Domain struct {
@@ -138,39 +208,152 @@ type RecordPretty struct {
 type AuthDatabase map[string]AuthData
 
 type AuthData struct {
-	Token       string
-	Secret      string
-	Permissions []Permission
-	Priority    int
-	isVault     bool
+	Token        string
+	Secret       string
+	Secrets      []TokenSecret     // every accepted secret, Secret only if empty
+	PublicKey    ed25519.PublicKey // tokens with a key sign requests with the private one, no secret
+	Certificates []string          // client certificate subjects & SANs the api maps to this token
+	Delegate     bool              // may sign requests on behalf of asserted identities
+	AllowFrom    []*net.IPNet      // requests are accepted from these networks only, any if empty
+	Permissions  []Permission
+	Priority     int
+	NotBefore    time.Time // validity of the token, zero - unlimited
+	Expires      time.Time
+	Parent       string // child tokens are permitted what both they & their parents are
+	Children     int    // child tokens the token may create
+	Admin        bool   // manages tokens of the token store
+	isVault      bool
+	isStore      bool
+}
+
+// TokenSecret is one of secrets of a token, more than one are active while the secret is rotated
+type TokenSecret struct {
+	Id      string // sha256 prefix of the value
+	Value   string
+	Expires time.Time // zero - never
 }
 
 var authDataLock = sync.RWMutex{}
 
 type Permission struct {
-	Domain    Domain
-	Permitted []Command
+	Domain    Domain       `json:"d"`
+	Permitted []Command    `json:"c"`
+	Names     []string     `json:"n,omitempty"` // record name masks, any name if empty
+	Types     []RecordType `json:"t,omitempty"` // record types, any type if empty
+	Deny      bool         `json:"x,omitempty"`
+	NotBefore int64        `json:"nb,omitempty"` // unix time validity of the line, 0 - unlimited
+	Expires   int64        `json:"ex,omitempty"`
 }
 
+const permissionDenyPrefix = "deny:"
+
 type VaultData struct {
-	Enabled bool
-	URL     string
-	Token   string
-	TTL     time.Duration
+	Enabled   bool
+	URL       string
+	Token     string
+	TTL       time.Duration
+	KVVersion int    // 2 - tokens are read from data/ & listed in metadata/ of the mount
+	Mount     string // kv mount path, the first element after /v1/ of URL by default
+	Auth      string // token ( default ), approle or kubernetes
+	AuthPath  string // mount path of the auth method, its name by default
+	RoleId    string // approle
+	SecretId  string // approle
+	Role      string // kubernetes
+	JWTFile   string // kubernetes service account token
+	CAFile    string // CA bundle vault certificate is verified with, system CAs by default
+	Insecure  bool   // vault certificate is not verified
 }
 type Config struct {
 	AMQPConfigs []*AMQPConfig
+	PGQueues    []*PGQueueConfig
 	PSQLConfigs []*PSQLConfig
 	Auth        *AuthDatabase
 	Vault       *VaultData
+	Health      string // listen address of health check endpoint
+	Scheduler   *SchedulerConfig
+	Reconcile   *ReconcileConfig
+	Security    *SecurityConfig
+	TokenStore  *TokenStoreConfig
+	ReloadWatch time.Duration // config files are checked for changes this often, 0 - on SIGHUP only
+}
+
+// TokenStoreConfig points to the database staged & retired secrets are kept in
+type TokenStoreConfig struct {
+	Database string        // [psql.<name>]
+	Refresh  time.Duration // other workers' changes are picked up this often
+}
+
+type SecurityConfig struct {
+	AllowV1       bool          // accept legacy signatures
+	V1Skew        time.Duration // legacy signature window
+	ClockSkew     time.Duration // v2 timestamp window
+	ExpiryWarning time.Duration // expiring tokens & permissions are warned about this long before
+	NonceDatabase string        // [psql.<name>] nonces are shared through, in memory of each worker if empty
+}
+
+var defaultSecurityConfig = SecurityConfig{
+	AllowV1:       true,
+	V1Skew:        15 * time.Minute,
+	ClockSkew:     5 * time.Minute,
+	ExpiryWarning: 7 * 24 * time.Hour,
+}
+
+// securityLock guards Security, it's swapped on reload while requests are checked; a published
+// SecurityConfig is never changed
+var securityLock = sync.RWMutex{}
+
+func (c *Config) security() *SecurityConfig {
+	securityLock.RLock()
+	defer securityLock.RUnlock()
+	if c.Security == nil {
+		return &defaultSecurityConfig
+	}
+	return c.Security
+}
+
+type ReconcileConfig struct {
+	Interval time.Duration         // background check interval, 0 - disabled
+	Sources  map[DomainView]string // source of truth per view
+}
+
+type SchedulerConfig struct {
+	Workers int
+	Limits  map[int]int // max concurrent requests per priority
 }
 
 type AMQPConfig struct {
-	URL      string
-	Exchange string
+	Name               string
+	URL                string
+	Exchange           string
+	Queue              string // shared work queue name; empty means exclusive fanout queue
+	Prefetch           int    // 0 - prefetchPerWorker per scheduler worker
+	MaxRetries         int
+	RetryDelay         time.Duration
+	DeadLetterExchange string
+	ReconnectAttempts  int // consecutive failures before giving up; 0 - never give up
+	ReconnectMinDelay  time.Duration
+	ReconnectMaxDelay  time.Duration
+	MaxPriority        int // x-max-priority of the queue, 0 - not a priority queue
+}
+
+type PGQueueConfig struct {
+	Name         string
+	URL          string
+	Table        string
+	Channel      string
+	Workers      int
+	PollInterval time.Duration
+	StaleTimeout time.Duration
+	MaxRetries   int
+	RetryDelay   time.Duration
+	// as in AMQPConfig
+	ReconnectAttempts int
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
 }
 
 type PSQLConfig struct {
+	Name     string
 	Host     string
 	Port     int
 	Username string
@@ -189,6 +372,16 @@ func (r *WunderRequest) toString() string {
 	)
 }
 
+const assertedOwnerPrefix = "oidc:"
+
+// owner is who records created by the request belong to
+func (r *WunderRequest) owner() string {
+	if r.Asserted != nil {
+		return assertedOwnerPrefix + r.Asserted.Subject
+	}
+	return r.Auth.Token
+}
+
 func (r *AuthHeader) toString() string {
 	if r == nil {
 		return "[nil]"
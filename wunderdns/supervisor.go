@@ -0,0 +1,185 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	ConsumerConnecting   = "connecting"
+	ConsumerConnected    = "connected"
+	ConsumerReconnecting = "reconnecting"
+	ConsumerStopped      = "stopped"
+	ConsumerFailed       = "failed"
+)
+
+type ConsumerState struct {
+	Name      string    `json:"name"`
+	Exchange  string    `json:"exchange"`
+	Queue     string    `json:"queue"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// states of consumers which are already gone, kept for health checks
+var finishedConsumers = make(map[string]ConsumerState)
+
+// set must be called with queuesLock held
+func (s *ConsumerState) set(state string, e error) {
+	if s.State != state {
+		s.Since = time.Now()
+	}
+	s.State = state
+	if e != nil {
+		s.LastError = e.Error()
+	}
+}
+
+// setState must be called with queuesLock held
+func (aq *amqpqueue) setState(state string, e error) {
+	aq.state.Queue = aq.queue
+	aq.state.set(state, e)
+}
+
+// newAMQPQueue registers the consumer before it's started, so it's counted right away
+func newAMQPQueue(config *AMQPConfig) *amqpqueue {
+	aq := &amqpqueue{
+		exitChannel: make(chan bool, 2),
+		state: ConsumerState{
+			Name:     config.Name,
+			Exchange: config.Exchange,
+		},
+	}
+	queuesLock.Lock()
+	aq.setState(ConsumerConnecting, nil)
+	queues[config.Name] = aq
+	queuesLock.Unlock()
+	return aq
+}
+
+// superviseAMQPQueue keeps an amqp consumer running until it's stopped or the reconnect policy gives up
+func superviseAMQPQueue(config *AMQPConfig, aq *amqpqueue) error {
+	defer func() {
+		queuesLock.Lock()
+		finishedConsumers[config.Name] = aq.state
+		if queues[config.Name] == aq {
+			delete(queues, config.Name)
+		}
+		queuesLock.Unlock()
+		checkChannel <- true
+	}()
+	return supervise(config.Name, config.ReconnectAttempts, config.ReconnectMinDelay, config.ReconnectMaxDelay,
+		&aq.state, aq.setState, aq.exitChannel, func() (bool, error) { return startAMQPQueue(config, aq) })
+}
+
+// supervise runs a consumer, reconnecting with exponential backoff & jitter until it's stopped
+// or fails more than attempts times in a row; setState is called with queuesLock held
+func supervise(name string, attempts int, minDelay, maxDelay time.Duration, state *ConsumerState,
+	setState func(string, error), exit chan bool, start func() (connected bool, e error)) error {
+	delay := minDelay
+	for {
+		connected, e := start()
+		if e == errConsumerStopped {
+			queuesLock.Lock()
+			setState(ConsumerStopped, nil)
+			queuesLock.Unlock()
+			return nil
+		}
+		queuesLock.Lock()
+		if connected {
+			state.Failures = 0
+			delay = minDelay
+		}
+		state.Failures++
+		if attempts > 0 && state.Failures > attempts {
+			setState(ConsumerFailed, e)
+			queuesLock.Unlock()
+			return fmt.Errorf("giving up after %d attempts: %s", attempts, e.Error())
+		}
+		setState(ConsumerReconnecting, e)
+		queuesLock.Unlock()
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		logging.Warning(fmt.Sprintf("[%s] %s; reconnecting in %s", name, e.Error(), wait))
+		select {
+		case <-time.After(wait):
+		case <-exit:
+			queuesLock.Lock()
+			setState(ConsumerStopped, nil)
+			queuesLock.Unlock()
+			return nil
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// ConsumerStates reports connection state of every configured amqp & pgqueue consumer
+func ConsumerStates() []ConsumerState {
+	queuesLock.RLock()
+	defer queuesLock.RUnlock()
+	ret := make([]ConsumerState, 0, len(queues)+len(pgqueues)+len(finishedConsumers))
+	for _, v := range queues {
+		ret = append(ret, v.state)
+	}
+	for _, v := range pgqueues {
+		ret = append(ret, v.state)
+	}
+	for k, v := range finishedConsumers {
+		_, ok1 := queues[k]
+		_, ok2 := pgqueues[k]
+		if !ok1 && !ok2 {
+			ret = append(ret, v)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Healthy tells if every consumer is connected
+func Healthy() bool {
+	for _, s := range ConsumerStates() {
+		if s.State != ConsumerConnected {
+			return false
+		}
+	}
+	return true
+}
+
+func startHealthServer(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		if Healthy() {
+			w.WriteHeader(200)
+		} else {
+			w.WriteHeader(503)
+		}
+		_ = json.NewEncoder(w).Encode(ReturnSuccess(ConsumerStates()))
+	})
+	logging.Info("[health] listening on ", listen)
+	if e := http.ListenAndServe(listen, mux); e != nil {
+		logging.Error("[health] serve error: ", e.Error())
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var tokenNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,255}$`)
+
+// requireAdmin gives the token of the request if it administers the token store; legacy signatures
+// are refused, they don't cover the token spec
+func requireAdmin(request *WunderRequest) (AuthData, error) {
+	v, e := requestToken(request)
+	if e != nil {
+		return v, e
+	}
+	if !v.Admin {
+		return v, errors.New(v.Token + " is not an admin token")
+	}
+	if request.Auth.Version < SignatureV2 {
+		return v, errors.New("tokens are administered with v2 signatures only")
+	}
+	return v, nil
+}
+
+// tokenFromSpec makes the stored token described by the admin command
+func tokenFromSpec(spec *TokenSpec) (AuthData, error) {
+	if spec == nil || len(spec.Permissions) == 0 {
+		return AuthData{}, errors.New("permissions of the token are not set")
+	}
+	if spec.Children < 0 {
+		return AuthData{}, errors.New("children can't be negative")
+	}
+	a := AuthData{
+		Token:    spec.Token,
+		Priority: spec.Priority,
+		Expires:  unixTime(spec.Expires),
+		Children: spec.Children,
+		isStore:  true,
+	}
+	var e error
+	if a.Permissions, e = parseACL(spec.Permissions); e != nil {
+		return a, e
+	}
+	if len(spec.AllowFrom) > 0 {
+		if a.AllowFrom, e = ParseNetworks(strings.Join(spec.AllowFrom, ",")); e != nil {
+			return a, errors.New("allow_from: " + e.Error())
+		}
+	}
+	if !a.Expires.IsZero() && !a.Expires.After(time.Now()) {
+		return a, errors.New("token would be expired")
+	}
+	return a, nil
+}
+
+// storedToken finds the token of the spec, it must come from the token store: auth.ini & vault tokens
+// are managed there
+func storedToken(spec *TokenSpec) (AuthData, error) {
+	if spec == nil || spec.Token == "" {
+		return AuthData{}, errors.New("token is not set")
+	}
+	authDataLock.RLock()
+	v, ok := (*globalConfig.Auth)[spec.Token]
+	authDataLock.RUnlock()
+	if !ok {
+		return v, errors.New("unknown token " + spec.Token)
+	}
+	if !v.isStore {
+		return v, errors.New(spec.Token + " is not in the token store")
+	}
+	return v, nil
+}
+
+// adminCreateToken creates a top level token, named by the admin or randomly
+func adminCreateToken(request *WunderRequest) (map[string]interface{}, error) {
+	admin, e := requireAdmin(request)
+	if e != nil {
+		return nil, e
+	}
+	a, e := tokenFromSpec(request.TokenSpec)
+	if e != nil {
+		return nil, e
+	}
+	if a.Token == "" {
+		if a.Token, e = randomHex(8); e != nil {
+			return nil, e
+		}
+	} else if !tokenNameRegexp.MatchString(a.Token) {
+		return nil, errors.New("bad token name " + a.Token)
+	}
+	authDataLock.RLock()
+	_, exists := (*globalConfig.Auth)[a.Token]
+	authDataLock.RUnlock()
+	if exists {
+		return nil, errors.New(a.Token + " exists already")
+	}
+	if a.Secret, e = randomHex(24); e != nil {
+		return nil, e
+	}
+	if e := storeToken(a, false); e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] ", admin.Token, " created ", a.Token)
+	return map[string]interface{}{
+		"token":   a.Token,
+		"secret":  a.Secret,
+		"expires": timeOrNil(a.Expires),
+	}, nil
+}
+
+// adminUpdateToken replaces permissions, priority, expiry, children quota & networks of a stored token
+func adminUpdateToken(request *WunderRequest) (*childInfo, error) {
+	admin, e := requireAdmin(request)
+	if e != nil {
+		return nil, e
+	}
+	if _, e := storedToken(request.TokenSpec); e != nil {
+		return nil, e
+	}
+	a, e := tokenFromSpec(request.TokenSpec)
+	if e != nil {
+		return nil, e
+	}
+	if e := storeToken(a, true); e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] ", admin.Token, " updated ", a.Token)
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	v := (*globalConfig.Auth)[a.Token]
+	info := describeToken(&v)
+	return &info, nil
+}
+
+// adminRevokeToken deletes a stored token along with its children
+func adminRevokeToken(request *WunderRequest) (map[string]interface{}, error) {
+	admin, e := requireAdmin(request)
+	if e != nil {
+		return nil, e
+	}
+	if _, e := storedToken(request.TokenSpec); e != nil {
+		return nil, e
+	}
+	revoked, e := deleteStoredToken(request.TokenSpec.Token)
+	if e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] ", admin.Token, " revoked ", strings.Join(revoked, ", "))
+	return map[string]interface{}{"revoked": revoked}, nil
+}
+
+// adminListTokens lists every token of the token store, children included
+func adminListTokens(request *WunderRequest) ([]childInfo, error) {
+	if _, e := requireAdmin(request); e != nil {
+		return nil, e
+	}
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	ret := make([]childInfo, 0)
+	for _, v := range *globalConfig.Auth {
+		if v.isStore {
+			ret = append(ret, describeToken(&v))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Token < ret[j].Token })
+	return ret, nil
+}
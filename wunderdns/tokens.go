@@ -0,0 +1,482 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// tokens with `children` > 0 create child tokens for their own services ( create_token ):
+// a child is permitted what both its own ACL and its parent's permit, it's valid while the parent is
+// and the parent revokes it ( revoke_token ). Children are kept in the token store, revoking a token
+// revokes its children too. Admin tokens ( `admin = true` ) manage top level tokens of the store
+// ( admin_*_token ), so tenants are added without a config deploy.
+const tokenStoreTokensSchema = `CREATE TABLE IF NOT EXISTS wunderdns_tokens (
+	token VARCHAR(255) PRIMARY KEY,
+	secret VARCHAR(255) NOT NULL,
+	parent VARCHAR(255) NULL,
+	permissions TEXT NOT NULL DEFAULT '',
+	priority INT NOT NULL DEFAULT 0,
+	expires TIMESTAMP WITH TIME ZONE NULL,
+	created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now())`
+
+// columns added to the table after its first release
+var tokenStoreTokensMigrations = []string{
+	`ALTER TABLE wunderdns_tokens ADD COLUMN IF NOT EXISTS children INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE wunderdns_tokens ADD COLUMN IF NOT EXISTS allow_from TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE wunderdns_tokens ADD COLUMN IF NOT EXISTS updated TIMESTAMP WITH TIME ZONE NULL`,
+}
+
+const tokenStoreTokensIndex = `CREATE INDEX IF NOT EXISTS wunderdns_tokens_parent ON wunderdns_tokens (parent)`
+
+// ancestors follows parents of the token, false if any of them is missing
+func (authDatabase *AuthDatabase) ancestors(v AuthData) ([]AuthData, bool) {
+	ret := make([]AuthData, 0)
+	for v.Parent != "" {
+		p, ok := (*authDatabase)[v.Parent]
+		if !ok || len(ret) > len(*authDatabase) { // a loop
+			return nil, false
+		}
+		ret = append(ret, p)
+		v = p
+	}
+	return ret, true
+}
+
+func (authDatabase *AuthDatabase) ancestorsValid(v AuthData) bool {
+	ancestors, ok := authDatabase.ancestors(v)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	for _, a := range ancestors {
+		if !a.validAt(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseACL parses `<view>,<domain mask>=<permissions>` lines
+func parseACL(lines []string) ([]Permission, error) {
+	ret := make([]Permission, 0, len(lines))
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("bad acl line " + l)
+		}
+		p, e := ParsePermission(strings.TrimSpace(kv[0]), kv[1])
+		if e != nil {
+			return nil, e
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// coveredBy checks every command of the permission on its domain mask against the permissions;
+// denies narrow anything down, they're always covered
+func (p *Permission) coveredBy(permissions []Permission) bool {
+	if p.Deny {
+		return true
+	}
+	domain := p.Domain
+	for _, c := range p.Permitted {
+		if ok, _ := permissionsDecide(permissions, &WunderRequest{Cmd: c, Domain: &domain}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func setupTokenStoreTokens(d *orm) error {
+	if e := d.db.Exec(tokenStoreTokensSchema).Error; e != nil {
+		return e
+	}
+	for _, m := range tokenStoreTokensMigrations {
+		if e := d.db.Exec(m).Error; e != nil {
+			return e
+		}
+	}
+	return d.db.Exec(tokenStoreTokensIndex).Error
+}
+
+// refreshStoredTokens replaces tokens of the token store in the auth database with the stored ones
+func refreshStoredTokens() error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	rows, e := d.db.Raw(`SELECT token, secret, parent, permissions, priority, expires, children, allow_from
+		FROM wunderdns_tokens`).Rows()
+	if e != nil {
+		return e
+	}
+	defer rows.Close()
+	tokens := make(map[string]AuthData)
+	for rows.Next() {
+		var a AuthData
+		var parent sql.NullString
+		var acl, allowFrom string
+		var expires sql.NullTime
+		if e := rows.Scan(&a.Token, &a.Secret, &parent, &acl, &a.Priority, &expires, &a.Children, &allowFrom); e != nil {
+			return e
+		}
+		if a.Permissions, e = parseACL(strings.Split(acl, "\n")); e != nil {
+			logging.Warning("[tokenstore] ignoring ", a.Token, ": ", e.Error())
+			continue
+		}
+		if allowFrom != "" {
+			if a.AllowFrom, e = ParseNetworks(allowFrom); e != nil || len(a.AllowFrom) == 0 {
+				logging.Warning("[tokenstore] ignoring ", a.Token, ": allow_from has no valid networks")
+				continue
+			}
+		}
+		a.Parent = parent.String
+		if expires.Valid {
+			a.Expires = expires.Time
+		}
+		a.isStore = true
+		tokens[a.Token] = a
+	}
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	for k, v := range *globalConfig.Auth {
+		if _, ok := tokens[k]; v.isStore && !ok {
+			delete(*globalConfig.Auth, k) // revoked by another worker
+		}
+	}
+	for k, v := range tokens {
+		if old, ok := (*globalConfig.Auth)[k]; ok && !old.isStore {
+			logging.Warning("[tokenstore] ", k, " is configured already, the stored one is ignored")
+			continue
+		}
+		applyStoredSecrets(&v)
+		(*globalConfig.Auth)[k] = v
+	}
+	return nil
+}
+
+// checkTokenCommand refuses child token changes signed the legacy way, they don't cover the token spec
+func checkTokenCommand(request *WunderRequest) (AuthData, error) {
+	v, e := requestToken(request)
+	if e != nil {
+		return v, e
+	}
+	if request.Auth.Version < SignatureV2 {
+		return v, errors.New("child tokens are managed with v2 signatures only")
+	}
+	return v, nil
+}
+
+// createToken creates a child token of the request's token
+func createToken(request *WunderRequest) (map[string]interface{}, error) {
+	parent, e := checkTokenCommand(request)
+	if e != nil {
+		return nil, e
+	}
+	spec := request.TokenSpec
+	if spec == nil || len(spec.Permissions) == 0 {
+		return nil, errors.New("permissions of the token are not set")
+	}
+	child := AuthData{
+		Parent:   parent.Token,
+		Priority: spec.Priority,
+		Expires:  unixTime(spec.Expires),
+		isStore:  true,
+	}
+	if child.Permissions, e = parseACL(spec.Permissions); e != nil {
+		return nil, e
+	}
+	ancestors := []AuthData{parent}
+	authDataLock.RLock()
+	more, _ := globalConfig.Auth.ancestors(parent)
+	authDataLock.RUnlock()
+	if parent.Children <= 0 {
+		return nil, errors.New(fmt.Sprintf("%s may have %d child tokens", parent.Token, parent.Children))
+	}
+	for _, a := range append(ancestors, more...) {
+		for i := range child.Permissions {
+			if !child.Permissions[i].coveredBy(a.Permissions) {
+				return nil, errors.New(child.Permissions[i].String() + " is not permitted to " + a.Token)
+			}
+		}
+		if child.Priority > a.Priority {
+			return nil, errors.New(fmt.Sprintf("priority can't be higher than %d", a.Priority))
+		}
+		if !a.Expires.IsZero() && (child.Expires.IsZero() || child.Expires.After(a.Expires)) {
+			child.Expires = a.Expires
+		}
+	}
+	if !child.Expires.IsZero() && !child.Expires.After(time.Now()) {
+		return nil, errors.New("token would be expired")
+	}
+	if child.Token, e = randomHex(8); e != nil {
+		return nil, e
+	}
+	if child.Secret, e = randomHex(24); e != nil {
+		return nil, e
+	}
+	if e := storeChildToken(child, parent.Children); e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] ", parent.Token, " created ", child.Token)
+	return map[string]interface{}{
+		"token":   child.Token,
+		"secret":  child.Secret,
+		"expires": timeOrNil(child.Expires),
+	}, nil
+}
+
+// tokenColumns gives permissions, networks, parent & expiry of the token as they're stored
+func tokenColumns(a AuthData) (string, string, interface{}, interface{}) {
+	acl := make([]string, 0, len(a.Permissions))
+	for i := range a.Permissions {
+		acl = append(acl, a.Permissions[i].String())
+	}
+	allowFrom := make([]string, 0, len(a.AllowFrom))
+	for _, n := range a.AllowFrom {
+		allowFrom = append(allowFrom, n.String())
+	}
+	var parent, expires interface{}
+	if a.Parent != "" {
+		parent = a.Parent
+	}
+	if !a.Expires.IsZero() {
+		expires = a.Expires
+	}
+	return strings.Join(acl, "\n"), strings.Join(allowFrom, ","), parent, expires
+}
+
+func insertToken(db *gorm.DB, a AuthData) error {
+	acl, allowFrom, parent, expires := tokenColumns(a)
+	return db.Exec(`INSERT INTO wunderdns_tokens (token, secret, parent, permissions, priority, expires,
+		children, allow_from) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, a.Token, a.Secret, parent, acl, a.Priority, expires,
+		a.Children, allowFrom).Error
+}
+
+// storeToken saves the token and adds it to the auth database right away, an update keeps
+// the secret & the parent of the stored one
+func storeToken(a AuthData, update bool) error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	acl, allowFrom, _, expires := tokenColumns(a)
+	if update {
+		r := d.db.Exec(`UPDATE wunderdns_tokens SET permissions = ?, priority = ?, expires = ?, children = ?,
+			allow_from = ?, updated = now() WHERE token = ?`, acl, a.Priority, expires, a.Children, allowFrom, a.Token)
+		if r.Error != nil {
+			return r.Error
+		}
+		if r.RowsAffected == 0 {
+			return errors.New(a.Token + " is not in the token store")
+		}
+	} else if e := insertToken(d.db, a); e != nil {
+		return e
+	}
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	if old, ok := (*globalConfig.Auth)[a.Token]; ok && update {
+		a.Secret, a.Secrets, a.Parent = old.Secret, old.Secrets, old.Parent
+	}
+	(*globalConfig.Auth)[a.Token] = a
+	return nil
+}
+
+// storeChildToken saves the child unless its parent has limit children already: requests of the parent
+// are serialized by an advisory lock till the insert is committed, so concurrent ones ( on any worker )
+// can't both pass the count
+func storeChildToken(a AuthData, limit int) error {
+	d, e := tokenStore()
+	if e != nil {
+		return e
+	}
+	e = d.db.Transaction(func(tx *gorm.DB) error {
+		if e := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "wunderdns_tokens/"+a.Parent).Error; e != nil {
+			return e
+		}
+		var children int
+		if e := tx.Raw("SELECT count(*) FROM wunderdns_tokens WHERE parent = ?", a.Parent).Row().Scan(&children); e != nil {
+			return e
+		}
+		if children >= limit {
+			return errors.New(fmt.Sprintf("%s may have %d child tokens", a.Parent, limit))
+		}
+		return insertToken(tx, a)
+	})
+	if e != nil {
+		return e
+	}
+	authDataLock.Lock()
+	(*globalConfig.Auth)[a.Token] = a
+	authDataLock.Unlock()
+	return nil
+}
+
+// revokeOrphans deletes stored children of removed configured tokens, they can't be valid anymore
+func revokeOrphans(removed []string) {
+	parents := make([]string, 0, len(removed))
+	authDataLock.RLock()
+	for _, t := range removed {
+		if _, ok := (*globalConfig.Auth)[t]; !ok { // it could be a vault or a stored one now
+			parents = append(parents, t)
+		}
+	}
+	authDataLock.RUnlock()
+	if len(parents) == 0 || globalConfig.TokenStore == nil {
+		return
+	}
+	d, e := tokenStore()
+	if e != nil {
+		logging.Warning("[tokenstore] children of removed tokens are kept: ", e.Error())
+		return
+	}
+	rows, e := d.db.Raw("SELECT token FROM wunderdns_tokens WHERE parent IN (?)", parents).Rows()
+	if e != nil {
+		logging.Warning("[tokenstore] children of removed tokens are kept: ", e.Error())
+		return
+	}
+	children := make([]string, 0)
+	for rows.Next() {
+		var t string
+		if e := rows.Scan(&t); e == nil {
+			children = append(children, t)
+		}
+	}
+	rows.Close()
+	for _, t := range children {
+		if revoked, e := deleteStoredToken(t); e != nil {
+			logging.Warning("[tokenstore] can't revoke ", t, ": ", e.Error())
+		} else {
+			logging.Info("[tokenstore] parent is removed, revoked ", strings.Join(revoked, ", "))
+		}
+	}
+}
+
+// revokeToken deletes a child of the request's token along with its own children
+func revokeToken(request *WunderRequest) (map[string]interface{}, error) {
+	if _, e := checkTokenCommand(request); e != nil {
+		return nil, e
+	}
+	if request.TokenSpec == nil || request.TokenSpec.Token == "" {
+		return nil, errors.New("token is not set")
+	}
+	token := request.TokenSpec.Token
+	authDataLock.RLock()
+	v, ok := (*globalConfig.Auth)[token]
+	authDataLock.RUnlock()
+	if !ok || !v.isStore || v.Parent != request.Auth.Token {
+		return nil, errors.New(token + " is not a child of " + request.Auth.Token)
+	}
+	revoked, e := deleteStoredToken(token)
+	if e != nil {
+		return nil, e
+	}
+	logging.Info("[tokenstore] ", request.Auth.Token, " revoked ", strings.Join(revoked, ", "))
+	return map[string]interface{}{"revoked": revoked}, nil
+}
+
+// deleteStoredToken deletes the token with all its descendants
+func deleteStoredToken(token string) ([]string, error) {
+	d, e := tokenStore()
+	if e != nil {
+		return nil, e
+	}
+	revoked := make([]string, 0)
+	rows, e := d.db.Raw(`WITH RECURSIVE t(token) AS (
+			SELECT token FROM wunderdns_tokens WHERE token = ?
+			UNION SELECT c.token FROM wunderdns_tokens c JOIN t ON c.parent = t.token)
+		DELETE FROM wunderdns_tokens WHERE token IN (SELECT token FROM t) RETURNING token`, token).Rows()
+	if e != nil {
+		return nil, e
+	}
+	for rows.Next() {
+		var t string
+		if e := rows.Scan(&t); e == nil {
+			revoked = append(revoked, t)
+		}
+	}
+	rows.Close()
+	if len(revoked) > 0 {
+		_ = d.db.Exec("DELETE FROM wunderdns_secrets WHERE token IN (?)", revoked).Error
+	}
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
+	for _, t := range revoked {
+		delete(*globalConfig.Auth, t)
+	}
+	return revoked, nil
+}
+
+type childInfo struct {
+	Token       string     `json:"token"`
+	Parent      string     `json:"parent,omitempty"`
+	Priority    int        `json:"priority"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Children    int        `json:"children,omitempty"`
+	AllowFrom   []string   `json:"allow_from,omitempty"`
+	Permissions []string   `json:"permissions"`
+}
+
+func describeToken(v *AuthData) childInfo {
+	c := childInfo{
+		Token:    v.Token,
+		Parent:   v.Parent,
+		Priority: v.Priority,
+		Expires:  timeOrNil(v.Expires),
+		Children: v.Children,
+	}
+	for _, n := range v.AllowFrom {
+		c.AllowFrom = append(c.AllowFrom, n.String())
+	}
+	for i := range v.Permissions {
+		c.Permissions = append(c.Permissions, v.Permissions[i].String())
+	}
+	return c
+}
+
+// listTokens lists children of the request's token
+func listTokens(request *WunderRequest) ([]childInfo, error) {
+	if request.Asserted != nil {
+		return nil, errors.New("asserted identities have no child tokens")
+	}
+	authDataLock.RLock()
+	defer authDataLock.RUnlock()
+	ret := make([]childInfo, 0)
+	for _, v := range *globalConfig.Auth {
+		if v.Parent == request.Auth.Token {
+			ret = append(ret, describeToken(&v))
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseACL(t *testing.T) {
+	acl := []string{
+		"public,*.apps.company.net=create_record,delete_record;name=_acme-challenge.*;type=TXT",
+		"*,db.apps.company.net=deny:*;expires=2030-01-01T00:00:00Z",
+		"",
+	}
+	permissions, e := parseACL(acl)
+	if e != nil || len(permissions) != 2 {
+		t.Fatalf("acl is parsed wrong: %v %v", permissions, e)
+	}
+	// stored ACL lines are made by String, they must parse back the same
+	for i := range permissions {
+		if again, e := parseACL([]string{permissions[i].String()}); e != nil || again[0].String() != permissions[i].String() {
+			t.Errorf("%s doesn't round trip: %v", permissions[i].String(), e)
+		}
+	}
+	if _, e := parseACL([]string{"no equals sign"}); e == nil {
+		t.Error("bad acl line is accepted")
+	}
+}
+
+func TestChildTokens(t *testing.T) {
+	parentACL, _ := parseACL([]string{"*,*.company.net=create_record,delete_record,list_records", "*,*=list_domains"})
+	childACL, _ := parseACL([]string{"public,*.apps.company.net=*"})
+	db := &AuthDatabase{
+		"parent": {Token: "parent", Secret: "parent", Children: 1, Permissions: parentACL},
+		"child":  {Token: "child", Secret: "child", Parent: "parent", Permissions: childACL, isStore: true},
+		"orphan": {Token: "orphan", Secret: "orphan", Parent: "gone", Permissions: childACL, isStore: true},
+	}
+	cases := []struct {
+		token    string
+		cmd      Command
+		domain   string
+		expected bool
+	}{
+		{"child", CommandCreateRecord, "a.apps.company.net", true},
+		{"child", CommandCreateDomain, "a.apps.company.net", false}, // not the parent's
+		{"child", CommandCreateRecord, "a.company.net", false},      // not the child's
+		{"orphan", CommandCreateRecord, "a.apps.company.net", false},
+	}
+	for i, c := range cases {
+		req := &WunderRequest{
+			Auth:   &AuthHeader{Token: c.token},
+			Cmd:    c.cmd,
+			Domain: &Domain{Name: c.domain, View: DomainViewPublic},
+		}
+		if db.isPermitted(req) != c.expected {
+			t.Errorf("case %d: expected %v", i, c.expected)
+		}
+	}
+
+	// children are valid while their parents are
+	if !db.ancestorsValid((*db)["child"]) || db.ancestorsValid((*db)["orphan"]) {
+		t.Error("ancestors are checked wrong")
+	}
+	p := (*db)["parent"]
+	p.Expires = time.Now().Add(-time.Minute)
+	(*db)["parent"] = p
+	if db.ancestorsValid((*db)["child"]) {
+		t.Error("child of expired parent is valid")
+	}
+
+	// a child can't get more than its parent has
+	for line, expected := range map[string]bool{
+		"public,*.apps.company.net=create_record":     true,
+		"*,*.apps.company.net=list_records":           true,
+		"*,*.apps.company.net=create_domain":          false,
+		"*,*=list_records":                            false,
+		"*,*.apps.company.net=*":                      false,
+		"*,payments.company.net=deny:*":               true,
+		"public,x.company.net=delete_record;type=TXT": true,
+	} {
+		acl, e := parseACL([]string{line})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if acl[0].coveredBy(parentACL) != expected {
+			t.Errorf("%s covered by the parent: expected %v", line, expected)
+		}
+	}
+}
+
+func TestAdminTokens(t *testing.T) {
+	globalConfig.Auth = &AuthDatabase{
+		"admin":  {Token: "admin", Secret: "admin", Admin: true},
+		"user":   {Token: "user", Secret: "user"},
+		"stored": {Token: "stored", Secret: "stored", isStore: true},
+	}
+	defer func() { globalConfig.Auth = authdb }()
+
+	for token, expected := range map[string]bool{"admin": true, "user": false} {
+		req := &WunderRequest{Auth: &AuthHeader{Token: token, Version: SignatureV2}}
+		if _, e := requireAdmin(req); (e == nil) != expected {
+			t.Errorf("%s is admin: expected %v", token, expected)
+		}
+		req.Asserted = &Assertion{Subject: "someone"}
+		if _, e := requireAdmin(req); e == nil {
+			t.Errorf("asserted identity of %s is admin", token)
+		}
+	}
+
+	// auth.ini & vault tokens are not managed by admins
+	for token, expected := range map[string]bool{"stored": true, "user": false, "missing": false} {
+		if _, e := storedToken(&TokenSpec{Token: token}); (e == nil) != expected {
+			t.Errorf("%s is stored: expected %v", token, expected)
+		}
+	}
+
+	a, e := tokenFromSpec(&TokenSpec{
+		Token:       "tenant",
+		Permissions: []string{"public,*.tenant.company.net=*"},
+		Priority:    2,
+		Children:    5,
+		AllowFrom:   []string{"10.0.0.0/8", "192.168.1.1"},
+		Expires:     time.Now().Add(time.Hour).Unix(),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !a.isStore || a.Children != 5 || a.Priority != 2 || len(a.AllowFrom) != 2 || len(a.Permissions) != 1 {
+		t.Errorf("token is made wrong: %+v", a)
+	}
+	if info := describeToken(&a); info.AllowFrom[1] != "192.168.1.1/32" || info.Permissions[0] != a.Permissions[0].String() {
+		t.Errorf("token is described wrong: %+v", info)
+	}
+	for i, spec := range []*TokenSpec{
+		nil,
+		{Token: "x"},
+		{Permissions: []string{"bad line"}},
+		{Permissions: []string{"*,*=list_domains"}, AllowFrom: []string{"not a network"}},
+		{Permissions: []string{"*,*=list_domains"}, Children: -1},
+		{Permissions: []string{"*,*=list_domains"}, Expires: time.Now().Add(-time.Hour).Unix()},
+	} {
+		if _, e := tokenFromSpec(spec); e == nil {
+			t.Errorf("case %d: bad spec is accepted", i)
+		}
+	}
+}
+
+func TestChildTokenCommandsNeedV2(t *testing.T) {
+	parentACL, _ := parseACL([]string{"*,*.company.net=create_record"})
+	db := &AuthDatabase{
+		"parent": {Token: "parent", Secret: "parent", Children: 1, Permissions: parentACL},
+		"none":   {Token: "none", Secret: "none", Permissions: parentACL},
+	}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	spec := &TokenSpec{Token: "child", Permissions: []string{"*,*.company.net=create_record"}}
+	for _, cmd := range []Command{CommandCreateToken, CommandRevokeToken} {
+		// a legacy signature doesn't cover the token spec, it could be swapped in a captured request
+		req := &WunderRequest{Cmd: cmd, Domain: &Domain{Name: "*", View: DomainViewAny}, TokenSpec: spec}
+		signV1(req, "parent", "parent")
+		if !db.checkAuthentication(req) {
+			t.Fatalf("%s: v1 signature is rejected", cmd)
+		}
+		if e := securityProcessRequest(req); e == nil {
+			t.Errorf("%s is allowed with a v1 signature", cmd)
+		}
+	}
+	req := &WunderRequest{Auth: &AuthHeader{Token: "parent"}, TokenSpec: spec}
+	if _, e := createToken(req); e == nil {
+		t.Error("child token is created with a v1 signature")
+	}
+	if _, e := revokeToken(req); e == nil {
+		t.Error("child token is revoked with a v1 signature")
+	}
+	// no quota - no children, the token store isn't asked
+	req = &WunderRequest{Auth: &AuthHeader{Token: "none", Version: SignatureV2}, TokenSpec: spec}
+	if _, e := createToken(req); e == nil || e.Error() != "none may have 0 child tokens" {
+		t.Errorf("token without quota: %v", e)
+	}
+}
+
+func TestAdminCommandsNeedV2(t *testing.T) {
+	db := &AuthDatabase{"admin": {Token: "admin", Secret: "admin", Admin: true}}
+	globalConfig.Auth = db
+	defer func() { globalConfig.Auth = authdb }()
+	// a captured admin_create_token could be replayed with any other token spec
+	req := &WunderRequest{Cmd: CommandAdminCreateToken, Domain: &Domain{Name: "*", View: DomainViewAny},
+		TokenSpec: &TokenSpec{Token: "tenant", Permissions: []string{"*,*=*"}}}
+	signV1(req, "admin", "admin")
+	if !db.checkAuthentication(req) {
+		t.Fatal("v1 signature is rejected")
+	}
+	if e := securityProcessRequest(req); e == nil {
+		t.Error("admin_create_token is allowed with a v1 signature")
+	}
+	if _, e := adminCreateToken(req); e == nil {
+		t.Error("token is created with a v1 signature")
+	}
+	for _, cmd := range []Command{CommandListTokens, CommandAdminUpdateToken, CommandAdminRevokeToken,
+		CommandAdminListTokens} {
+		req := &WunderRequest{Cmd: cmd, Domain: &Domain{Name: "*", View: DomainViewAny}}
+		signV1(req, "admin", "admin")
+		if e := securityProcessRequest(req); e == nil {
+			t.Errorf("%s is allowed with a v1 signature", cmd)
+		}
+	}
+	// v2 signatures are fine
+	req = &WunderRequest{Cmd: CommandAdminListTokens, Domain: &Domain{Name: "*", View: DomainViewAny}}
+	if e := SignRequest(req, "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+	if e := securityProcessRequest(req); e != nil {
+		t.Error(e)
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a change is applied to every database of a view or to none of them:
+// each participant prepares its transaction ( PREPARE TRANSACTION ), then the commit decision
+// is written to the decision log of participants and only then prepared transactions are committed.
+// A worker dying in the middle leaves in-doubt transactions, recoverPrepared resolves them
+// by the decision log: logged - commit, not logged anywhere - rollback.
+// Transaction ids carry the id of the worker coordinating them and workers keep heartbeats
+// in every database, so only transactions of dead workers are recovered: a live coordinator
+// waiting on a slow participant is left alone. A coordinator whose own heartbeat is too old
+// to be sure others see it alive aborts instead of logging the decision.
+const (
+	twoPhasePrefix        = "wunderdns_"
+	twoPhaseLogSchema     = `CREATE TABLE IF NOT EXISTS wunderdns_transactions (gid VARCHAR(64) PRIMARY KEY, created TIMESTAMP NOT NULL DEFAULT now())`
+	twoPhaseWorkersSchema = `CREATE TABLE IF NOT EXISTS wunderdns_workers (worker VARCHAR(32) PRIMARY KEY, heartbeat TIMESTAMP NOT NULL DEFAULT now())`
+	twoPhaseHeartbeat     = 10 * time.Second
+	twoPhaseLease         = time.Minute      // a worker not heard of this long is dead
+	twoPhaseLegacyAge     = 10 * time.Minute // transactions of workers without ids are recovered by age
+	twoPhaseLogLifetime   = 24 * time.Hour   // decisions are kept for recovery of unreachable participants
+)
+
+// twoPhaseWorker identifies this worker in transaction ids & heartbeats
+var twoPhaseWorker, _ = randomHex(8)
+
+var twoPhaseState = struct {
+	lock     sync.Mutex
+	inFlight map[string]bool // transactions this worker is coordinating right now
+	alive    time.Time       // last heartbeat written to any database
+}{
+	inFlight: make(map[string]bool),
+}
+
+// participant is a database taking part in two-phase changes
+type participant interface {
+	String() string
+	prepare(gid string, request *WunderRequest) (int, error)
+	finishPrepared(gid string, commit bool) error
+	logDecision(gid string) error
+	forgetDecision(gid string)
+	decided(gid string) (bool, error)
+	inDoubt() ([]preparedTransaction, error)
+	heartbeat(worker string) error
+	lastHeartbeat(worker string) (t time.Time, found bool, e error)
+}
+
+type preparedTransaction struct {
+	gid      string
+	prepared time.Time
+}
+
+// setupTwoPhase checks if the server allows prepared transactions and creates the decision log
+func (d *orm) setupTwoPhase() {
+	var max int
+	if e := d.db.Raw("SHOW max_prepared_transactions").Row().Scan(&max); e != nil {
+		logging.Warning(fmt.Sprintf("[2pc] %s: can't check max_prepared_transactions: %s", d.config.Host, e.Error()))
+		return
+	}
+	if max == 0 {
+		logging.Warning(fmt.Sprintf("[2pc] %s: prepared transactions are disabled, using compensating mode",
+			d.config.Host))
+		return
+	}
+	for _, schema := range []string{twoPhaseLogSchema, twoPhaseWorkersSchema} {
+		if e := d.db.Exec(schema).Error; e != nil {
+			logging.Warning(fmt.Sprintf("[2pc] %s: can't create decision log, using compensating mode: %s",
+				d.config.Host, e.Error()))
+			return
+		}
+	}
+	d.twoPhase = true
+}
+
+// newTransactionId gives wunderdns_<worker>_<random>
+func newTransactionId() string {
+	id, _ := randomHex(16)
+	return twoPhasePrefix + twoPhaseWorker + "_" + id
+}
+
+// transactionWorker tells which worker coordinates the transaction, ok is false for legacy ids
+func transactionWorker(gid string) (worker string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(gid, twoPhasePrefix), "_")
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (d *orm) String() string {
+	return d.config.Host
+}
+
+// prepare applies the request in a transaction and prepares it under gid
+func (d *orm) prepare(gid string, request *WunderRequest) (n int, e error) {
+	tx := d.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	if n, e = ormApplyCommandExec(tx, d.config.View, request); e != nil {
+		tx.Rollback()
+		return
+	}
+	// gid is generated by us - safe to be quoted as is
+	if e = tx.Exec(fmt.Sprintf("PREPARE TRANSACTION '%s'", gid)).Error; e != nil {
+		tx.Rollback()
+		return
+	}
+	// the session has no transaction after PREPARE, COMMIT just gives the connection back
+	tx.Commit()
+	// PREPARE of an aborted transaction is a plain ROLLBACK, make sure we have something to commit
+	var found int64
+	if e = d.db.Raw("SELECT count(*) FROM pg_prepared_xacts WHERE gid = ?", gid).Row().Scan(&found); e != nil {
+		_ = d.db.Exec(fmt.Sprintf("ROLLBACK PREPARED '%s'", gid)).Error
+		return
+	}
+	if found == 0 {
+		return 0, errors.New("transaction is aborted on " + d.config.Host)
+	}
+	return
+}
+
+func (d *orm) finishPrepared(gid string, commit bool) error {
+	if commit {
+		return d.db.Exec(fmt.Sprintf("COMMIT PREPARED '%s'", gid)).Error
+	}
+	return d.db.Exec(fmt.Sprintf("ROLLBACK PREPARED '%s'", gid)).Error
+}
+
+func (d *orm) logDecision(gid string) error {
+	return d.db.Exec("INSERT INTO wunderdns_transactions (gid) VALUES (?)", gid).Error
+}
+
+func (d *orm) forgetDecision(gid string) {
+	_ = d.db.Exec("DELETE FROM wunderdns_transactions WHERE gid = ?", gid).Error
+}
+
+func (d *orm) decided(gid string) (bool, error) {
+	var found int64
+	if e := d.db.Raw("SELECT count(*) FROM wunderdns_transactions WHERE gid = ?", gid).Row().Scan(&found); e != nil {
+		return false, e
+	}
+	return found > 0, nil
+}
+
+// inDoubt lists prepared transactions of wunderdns workers in the database
+func (d *orm) inDoubt() ([]preparedTransaction, error) {
+	rows, e := d.db.Raw(`SELECT gid, prepared FROM pg_prepared_xacts WHERE gid LIKE ? AND database = current_database()`,
+		twoPhasePrefix+"%").Rows()
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+	ret := make([]preparedTransaction, 0)
+	for rows.Next() {
+		var t preparedTransaction
+		if e := rows.Scan(&t.gid, &t.prepared); e == nil {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+func (d *orm) heartbeat(worker string) error {
+	return d.db.Exec(`INSERT INTO wunderdns_workers (worker, heartbeat) VALUES (?, now())
+		ON CONFLICT (worker) DO UPDATE SET heartbeat = now()`, worker).Error
+}
+
+// lastHeartbeat is in the clock of this worker: database time is only compared to database time
+func (d *orm) lastHeartbeat(worker string) (time.Time, bool, error) {
+	var age float64
+	e := d.db.Raw("SELECT extract(epoch FROM now() - heartbeat) FROM wunderdns_workers WHERE worker = ?",
+		worker).Row().Scan(&age)
+	if errors.Is(e, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	} else if e != nil {
+		return time.Time{}, false, e
+	}
+	return time.Now().Add(-time.Duration(age * float64(time.Second))), true, nil
+}
+
+func twoPhaseParticipants() []participant {
+	ret := make([]participant, 0)
+	for _, d := range currentOrms() {
+		if d.twoPhase {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// startTwoPhase announces this worker, recovers what dead workers have left and keeps doing both
+func startTwoPhase() {
+	writeHeartbeats(twoPhaseParticipants())
+	recoverPrepared()
+	go func() {
+		for {
+			time.Sleep(twoPhaseHeartbeat)
+			writeHeartbeats(twoPhaseParticipants())
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(twoPhaseLease)
+			recoverPrepared()
+		}
+	}()
+}
+
+func writeHeartbeats(ps []participant) {
+	written := false
+	for _, p := range ps {
+		if e := p.heartbeat(twoPhaseWorker); e != nil {
+			logging.Warning(fmt.Sprintf("[2pc] %s: can't write heartbeat: %s", p, e.Error()))
+			continue
+		}
+		written = true
+	}
+	if written {
+		twoPhaseState.lock.Lock()
+		twoPhaseState.alive = time.Now()
+		twoPhaseState.lock.Unlock()
+	}
+}
+
+// leaseHeld tells if others surely see this worker alive: its heartbeat is well within the lease
+func leaseHeld() bool {
+	twoPhaseState.lock.Lock()
+	defer twoPhaseState.lock.Unlock()
+	return time.Since(twoPhaseState.alive) < twoPhaseLease/2
+}
+
+func ormApplyTwoPhase(participants []*orm, request *WunderRequest) (n int, e error) {
+	ps := make([]participant, 0, len(participants))
+	for _, d := range participants {
+		ps = append(ps, d)
+	}
+	return applyTwoPhase(ps, request)
+}
+
+func rollbackPrepared(prepared []participant, gid string) {
+	for _, p := range prepared {
+		if e := p.finishPrepared(gid, false); e != nil {
+			logging.Warning(fmt.Sprintf("[2pc] %s: rollback of %s failed, left for recovery: %s",
+				p, gid, e.Error()))
+		}
+	}
+}
+
+func applyTwoPhase(participants []participant, request *WunderRequest) (n int, e error) {
+	if !leaseHeld() {
+		return 0, errors.New("2pc: heartbeat of this worker is not written, can't coordinate")
+	}
+	gid := newTransactionId()
+	twoPhaseState.lock.Lock()
+	twoPhaseState.inFlight[gid] = true
+	twoPhaseState.lock.Unlock()
+	defer func() {
+		twoPhaseState.lock.Lock()
+		delete(twoPhaseState.inFlight, gid)
+		twoPhaseState.lock.Unlock()
+	}()
+	prepared := make([]participant, 0, len(participants))
+	for _, p := range participants {
+		_n, e := p.prepare(gid, request)
+		if e != nil {
+			rollbackPrepared(prepared, gid)
+			return 0, e
+		}
+		n += _n
+		prepared = append(prepared, p)
+	}
+	// others may already take us for dead and roll the transaction back
+	if !leaseHeld() {
+		rollbackPrepared(prepared, gid)
+		return 0, errors.New("2pc: heartbeat of this worker is too old, aborted")
+	}
+	// the decision is made once it's logged at least once
+	logged := 0
+	for _, p := range prepared {
+		if e := p.logDecision(gid); e != nil {
+			logging.Warning(fmt.Sprintf("[2pc] %s: can't log decision on %s: %s", p, gid, e.Error()))
+			continue
+		}
+		logged++
+	}
+	if logged == 0 {
+		rollbackPrepared(prepared, gid)
+		return 0, errors.New("2pc: can't log commit decision")
+	}
+	complete := true
+	for _, p := range prepared {
+		if e := p.finishPrepared(gid, true); e != nil {
+			// committed anyway: recovery finishes it by the decision log
+			logging.Error(fmt.Sprintf("[2pc] %s: commit of %s failed, left for recovery: %s", p, gid, e.Error()))
+			complete = false
+		}
+	}
+	if complete {
+		for _, p := range prepared {
+			p.forgetDecision(gid)
+		}
+	}
+	return
+}
+
+// recoverPrepared resolves in-doubt transactions left by dead workers
+func recoverPrepared() {
+	ps := twoPhaseParticipants()
+	recoverInDoubt(ps)
+	for _, d := range currentOrms() {
+		if !d.twoPhase {
+			continue
+		}
+		_ = d.db.Exec("DELETE FROM wunderdns_transactions WHERE created < now() - ?::interval",
+			fmt.Sprintf("%d seconds", int(twoPhaseLogLifetime.Seconds()))).Error
+		_ = d.db.Exec("DELETE FROM wunderdns_workers WHERE heartbeat < now() - ?::interval",
+			fmt.Sprintf("%d seconds", int(twoPhaseLogLifetime.Seconds()))).Error
+	}
+}
+
+func recoverInDoubt(ps []participant) {
+	for _, p := range ps {
+		transactions, e := p.inDoubt()
+		if e != nil {
+			logging.Warning(fmt.Sprintf("[2pc] %s: can't list prepared transactions: %s", p, e.Error()))
+			continue
+		}
+		for _, t := range transactions {
+			if !coordinatorDead(ps, t) {
+				continue
+			}
+			commit, known := twoPhaseDecision(ps, t.gid)
+			if !known {
+				logging.Warning(fmt.Sprintf("[2pc] %s: decision on %s is unknown yet", p, t.gid))
+				continue
+			}
+			if e := p.finishPrepared(t.gid, commit); e != nil {
+				logging.Error(fmt.Sprintf("[2pc] %s: recovery of %s failed: %s", p, t.gid, e.Error()))
+				continue
+			}
+			logging.Warning(fmt.Sprintf("[2pc] %s: in-doubt transaction %s recovered, commit: %v", p, t.gid, commit))
+		}
+	}
+}
+
+// coordinatorDead tells if nobody is going to finish the transaction but recovery:
+// it's ours and we're not coordinating it anymore, or its worker has no fresh heartbeat anywhere
+func coordinatorDead(ps []participant, t preparedTransaction) bool {
+	worker, ok := transactionWorker(t.gid)
+	if !ok {
+		return time.Since(t.prepared) > twoPhaseLegacyAge
+	}
+	if worker == twoPhaseWorker {
+		twoPhaseState.lock.Lock()
+		defer twoPhaseState.lock.Unlock()
+		return !twoPhaseState.inFlight[t.gid]
+	}
+	for _, p := range ps {
+		last, found, e := p.lastHeartbeat(worker)
+		if e != nil {
+			return false // can't be sure
+		}
+		if found && time.Since(last) < twoPhaseLease {
+			return false
+		}
+	}
+	return true
+}
+
+// twoPhaseDecision looks for the commit decision in the log of every database;
+// not logged is a rollback only if every log has been checked
+func twoPhaseDecision(ps []participant, gid string) (commit bool, known bool) {
+	for _, p := range ps {
+		found, e := p.decided(gid)
+		if e != nil {
+			return false, false
+		}
+		if found {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// domainSnapshot is what a change may touch in a database, used by compensating mode
+type domainSnapshot struct {
+	domain  *domainTable
+	records map[uint]RecordsApiTable
+}
+
+func takeSnapshot(tx *gorm.DB, name string) *domainSnapshot {
+	s := &domainSnapshot{records: make(map[uint]RecordsApiTable)}
+	var d domainTable
+	tx.Where("name = ?", name).First(&d)
+	if d.Id == 0 {
+		return s
+	}
+	s.domain = &d
+	var records []RecordsApiTable
+	tx.Where("domain_id = ?", d.Id).Find(&records)
+	for _, r := range records {
+		s.records[r.Id] = r
+	}
+	return s
+}
+
+// compensation reverts a change: added records are removed, changed ones restored, removed ones
+// recreated and an added domain is removed
+type compensation struct {
+	remove       []uint
+	restore      []RecordsApiTable
+	recreate     []RecordsApiTable
+	removeDomain uint
+}
+
+// compensationOf tells what reverts the change between before and after snapshots; SOA serial is left
+// increased, it must never go back
+func compensationOf(before, after *domainSnapshot) compensation {
+	c := compensation{}
+	for id, r := range after.records {
+		b, ok := before.records[id]
+		if !ok {
+			c.remove = append(c.remove, id)
+		} else if !reflect.DeepEqual(b, r) {
+			c.restore = append(c.restore, b)
+		}
+	}
+	for id, b := range before.records {
+		if _, ok := after.records[id]; !ok {
+			c.recreate = append(c.recreate, b)
+		}
+	}
+	if before.domain == nil && after.domain != nil {
+		c.removeDomain = after.domain.Id
+	}
+	return c
+}
+
+func (d *orm) compensate(before, after *domainSnapshot) error {
+	c := compensationOf(before, after)
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range c.remove {
+			if e := tx.Delete(&RecordsApiTable{}, id).Error; e != nil {
+				return e
+			}
+		}
+		for _, r := range c.restore {
+			r := r
+			if e := tx.Save(&r).Error; e != nil {
+				return e
+			}
+		}
+		for _, r := range c.recreate {
+			r := r
+			if e := tx.Create(&r).Error; e != nil {
+				return e
+			}
+		}
+		if c.removeDomain != 0 {
+			if e := tx.Delete(&domainTable{}, c.removeDomain).Error; e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// compensatable is a database changes are applied to one by one, reverted if a later one fails
+type compensatable interface {
+	String() string
+	applySnapshotted(request *WunderRequest) (n int, before, after *domainSnapshot, e error)
+	compensate(before, after *domainSnapshot) error
+}
+
+// applySnapshotted applies the request and takes snapshots of the domain around it
+func (d *orm) applySnapshotted(request *WunderRequest) (n int, before, after *domainSnapshot, e error) {
+	e = d.db.Transaction(func(tx *gorm.DB) error {
+		before = takeSnapshot(tx, request.Domain.Name)
+		_n, e := ormApplyCommandExec(tx, d.config.View, request)
+		if e == nil {
+			n = _n
+			after = takeSnapshot(tx, request.Domain.Name)
+		}
+		return e
+	})
+	return
+}
+
+// ormApplyCompensating applies the request to participants one by one and reverts
+// the ones already committed if any of them fails
+func ormApplyCompensating(participants []*orm, request *WunderRequest) (n int, e error) {
+	ps := make([]compensatable, 0, len(participants))
+	for _, d := range participants {
+		ps = append(ps, d)
+	}
+	return applyCompensating(ps, request)
+}
+
+func applyCompensating(participants []compensatable, request *WunderRequest) (n int, e error) {
+	type applied struct {
+		p             compensatable
+		before, after *domainSnapshot
+	}
+	done := make([]applied, 0, len(participants))
+	for _, p := range participants {
+		_n, before, after, e := p.applySnapshotted(request)
+		if e != nil {
+			for i := len(done) - 1; i >= 0; i-- {
+				if ce := done[i].p.compensate(done[i].before, done[i].after); ce != nil {
+					logging.Error(fmt.Sprintf("[compensate] %s: can't revert %s: %s", done[i].p,
+						request.toString(), ce.Error()))
+				}
+			}
+			return 0, e
+		}
+		n += _n
+		done = append(done, applied{p: p, before: before, after: after})
+	}
+	return
+}
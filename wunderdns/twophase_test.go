@@ -0,0 +1,385 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParticipant keeps prepared transactions, decisions & heartbeats in memory
+type testParticipant struct {
+	name        string
+	failPrepare bool
+	failLog     bool
+	failCommit  bool
+	failDecided bool
+	failBeat    bool
+	onPrepare   func()
+	prepared    map[string]time.Time
+	committed   []string
+	rolledBack  []string
+	decisions   map[string]bool
+	heartbeats  map[string]time.Time
+	compensated int
+}
+
+func newTestParticipant(name string) *testParticipant {
+	return &testParticipant{
+		name:       name,
+		prepared:   make(map[string]time.Time),
+		decisions:  make(map[string]bool),
+		heartbeats: make(map[string]time.Time),
+	}
+}
+
+func (p *testParticipant) String() string { return p.name }
+
+func (p *testParticipant) prepare(gid string, request *WunderRequest) (int, error) {
+	if p.onPrepare != nil {
+		p.onPrepare()
+	}
+	if p.failPrepare {
+		return 0, errors.New("prepare failed")
+	}
+	p.prepared[gid] = time.Now()
+	return 1, nil
+}
+
+func (p *testParticipant) finishPrepared(gid string, commit bool) error {
+	if _, ok := p.prepared[gid]; !ok {
+		return errors.New("no such transaction")
+	}
+	if commit && p.failCommit {
+		return errors.New("commit failed")
+	}
+	delete(p.prepared, gid)
+	if commit {
+		p.committed = append(p.committed, gid)
+	} else {
+		p.rolledBack = append(p.rolledBack, gid)
+	}
+	return nil
+}
+
+func (p *testParticipant) logDecision(gid string) error {
+	if p.failLog {
+		return errors.New("log failed")
+	}
+	p.decisions[gid] = true
+	return nil
+}
+
+func (p *testParticipant) forgetDecision(gid string) { delete(p.decisions, gid) }
+
+func (p *testParticipant) decided(gid string) (bool, error) {
+	if p.failDecided {
+		return false, errors.New("log is unreachable")
+	}
+	return p.decisions[gid], nil
+}
+
+func (p *testParticipant) inDoubt() ([]preparedTransaction, error) {
+	ret := make([]preparedTransaction, 0, len(p.prepared))
+	for gid, t := range p.prepared {
+		ret = append(ret, preparedTransaction{gid: gid, prepared: t})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].gid < ret[j].gid })
+	return ret, nil
+}
+
+func (p *testParticipant) heartbeat(worker string) error {
+	p.heartbeats[worker] = time.Now()
+	return nil
+}
+
+func (p *testParticipant) lastHeartbeat(worker string) (time.Time, bool, error) {
+	if p.failBeat {
+		return time.Time{}, false, errors.New("unreachable")
+	}
+	t, ok := p.heartbeats[worker]
+	return t, ok, nil
+}
+
+func (p *testParticipant) applySnapshotted(request *WunderRequest) (int, *domainSnapshot, *domainSnapshot, error) {
+	if p.failPrepare {
+		return 0, nil, nil, errors.New("apply failed")
+	}
+	return 1, &domainSnapshot{}, &domainSnapshot{}, nil
+}
+
+func (p *testParticipant) compensate(before, after *domainSnapshot) error {
+	p.compensated++
+	return nil
+}
+
+// setHeartbeat pretends the heartbeat of this worker was written at alive, returns the restoring func
+func setHeartbeat(alive time.Time) func() {
+	twoPhaseState.lock.Lock()
+	saved := twoPhaseState.alive
+	twoPhaseState.alive = alive
+	twoPhaseState.lock.Unlock()
+	return func() {
+		twoPhaseState.lock.Lock()
+		twoPhaseState.alive = saved
+		twoPhaseState.lock.Unlock()
+	}
+}
+
+func testTwoPhaseRequest() *WunderRequest {
+	return &WunderRequest{
+		Auth:   &AuthHeader{Token: "test"},
+		Cmd:    CommandCreateRecord,
+		Domain: &Domain{Name: "example.com", View: DomainViewPublic},
+	}
+}
+
+func TestNewTransactionId(t *testing.T) {
+	plain := regexp.MustCompile(`^[a-z0-9_]+$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		gid := newTransactionId()
+		// gids are quoted into PREPARE TRANSACTION and kept in VARCHAR(64) of the decision log
+		if !strings.HasPrefix(gid, twoPhasePrefix) || len(gid) > 64 || !plain.MatchString(gid) {
+			t.Fatalf("bad transaction id %s", gid)
+		}
+		if w, ok := transactionWorker(gid); !ok || w != twoPhaseWorker {
+			t.Fatalf("worker of %s is %s, expected %s", gid, w, twoPhaseWorker)
+		}
+		if seen[gid] {
+			t.Fatalf("duplicate transaction id %s", gid)
+		}
+		seen[gid] = true
+	}
+	if _, ok := transactionWorker(twoPhasePrefix + "0123456789abcdef0123456789abcdef"); ok {
+		t.Error("legacy transaction id has a worker")
+	}
+}
+
+func TestApplyTwoPhase(t *testing.T) {
+	defer setHeartbeat(time.Now())()
+	a, b := newTestParticipant("a"), newTestParticipant("b")
+	n, e := applyTwoPhase([]participant{a, b}, testTwoPhaseRequest())
+	if e != nil || n != 2 {
+		t.Fatalf("applyTwoPhase: %d, %v", n, e)
+	}
+	if len(a.committed) != 1 || len(b.committed) != 1 || a.committed[0] != b.committed[0] {
+		t.Errorf("not committed everywhere: %v, %v", a.committed, b.committed)
+	}
+	if len(a.decisions) != 0 || len(b.decisions) != 0 {
+		t.Error("decision is kept after complete commit")
+	}
+	if len(twoPhaseState.inFlight) != 0 {
+		t.Error("finished transaction is still in flight")
+	}
+}
+
+func TestApplyTwoPhaseFailures(t *testing.T) {
+	defer setHeartbeat(time.Now())()
+	// second participant fails to prepare - the first one is rolled back, nothing is decided
+	a, b := newTestParticipant("a"), newTestParticipant("b")
+	b.failPrepare = true
+	if _, e := applyTwoPhase([]participant{a, b}, testTwoPhaseRequest()); e == nil {
+		t.Error("failed prepare is not reported")
+	}
+	if len(a.rolledBack) != 1 || len(a.committed) != 0 || len(a.decisions) != 0 {
+		t.Errorf("prepared participant is not rolled back: %+v", a)
+	}
+	// decision can't be logged anywhere - rollback
+	a, b = newTestParticipant("a"), newTestParticipant("b")
+	a.failLog, b.failLog = true, true
+	if _, e := applyTwoPhase([]participant{a, b}, testTwoPhaseRequest()); e == nil {
+		t.Error("unlogged decision is not reported")
+	}
+	if len(a.rolledBack) != 1 || len(b.rolledBack) != 1 {
+		t.Error("transaction without decision is not rolled back")
+	}
+	// logged once is enough; a failed commit is left to recovery with its decision
+	a, b = newTestParticipant("a"), newTestParticipant("b")
+	a.failLog, b.failCommit = true, true
+	if n, e := applyTwoPhase([]participant{a, b}, testTwoPhaseRequest()); e != nil || n != 2 {
+		t.Fatalf("applyTwoPhase: %d, %v", n, e)
+	}
+	if len(a.committed) != 1 || len(b.prepared) != 1 || len(b.decisions) != 1 {
+		t.Fatalf("unexpected state: %+v, %+v", a, b)
+	}
+	// the coordinator is done with it - recovery commits it by the decision
+	b.failCommit = false
+	recoverInDoubt([]participant{a, b})
+	if len(b.committed) != 1 || len(b.prepared) != 0 {
+		t.Errorf("in-doubt transaction is not committed by recovery: %+v", b)
+	}
+}
+
+func TestApplyTwoPhaseLease(t *testing.T) {
+	// no heartbeat written - others can't see us, don't even start
+	restore := setHeartbeat(time.Time{})
+	defer restore()
+	a := newTestParticipant("a")
+	if _, e := applyTwoPhase([]participant{a}, testTwoPhaseRequest()); e == nil || len(a.prepared)+len(a.rolledBack) != 0 {
+		t.Error("transaction is started without heartbeat")
+	}
+	// heartbeat gets too old while a slow participant prepares - abort before the decision
+	setHeartbeat(time.Now())
+	a, b := newTestParticipant("a"), newTestParticipant("b")
+	b.onPrepare = func() {
+		twoPhaseState.lock.Lock()
+		twoPhaseState.alive = time.Now().Add(-twoPhaseLease)
+		twoPhaseState.lock.Unlock()
+	}
+	if _, e := applyTwoPhase([]participant{a, b}, testTwoPhaseRequest()); e == nil {
+		t.Error("transaction is committed with expired heartbeat")
+	}
+	if len(a.decisions)+len(b.decisions) != 0 || len(a.rolledBack) != 1 || len(b.rolledBack) != 1 {
+		t.Errorf("transaction is not aborted: %+v, %+v", a, b)
+	}
+}
+
+func TestTwoPhaseDecision(t *testing.T) {
+	a, b := newTestParticipant("a"), newTestParticipant("b")
+	if commit, known := twoPhaseDecision([]participant{a, b}, "x"); commit || !known {
+		t.Error("transaction logged nowhere is not rolled back")
+	}
+	b.decisions["x"] = true
+	if commit, known := twoPhaseDecision([]participant{a, b}, "x"); !commit || !known {
+		t.Error("transaction logged once is not committed")
+	}
+	// an unreachable log may hold the decision
+	a.failDecided = true
+	if _, known := twoPhaseDecision([]participant{a, b}, "y"); known {
+		t.Error("decision is known with a log unchecked")
+	}
+}
+
+func TestRecoverInDoubt(t *testing.T) {
+	a, b := newTestParticipant("a"), newTestParticipant("b")
+	old := time.Now().Add(-time.Hour)
+	gid := func(worker, id string) string { return twoPhasePrefix + worker + "_" + id }
+	a.heartbeats["alive"] = time.Now()
+	b.heartbeats["dead"] = time.Now().Add(-2 * twoPhaseLease)
+	for _, p := range []*testParticipant{a, b} {
+		p.prepared[gid("alive", "1")] = old   // coordinator waits on a slow participant
+		p.prepared[gid("dead", "2")] = old    // no decision - rollback
+		p.prepared[gid("dead", "3")] = old    // logged - commit
+		p.prepared[gid("unknown", "4")] = old // never heard of - dead
+		p.prepared[gid(twoPhaseWorker, "5")] = time.Now()
+		p.prepared[gid(twoPhaseWorker, "6")] = time.Now()
+		p.prepared[twoPhasePrefix+"legacy7"] = time.Now()
+		p.prepared[twoPhasePrefix+"legacy8"] = old
+	}
+	a.decisions[gid("dead", "3")] = true
+	twoPhaseState.lock.Lock()
+	twoPhaseState.inFlight[gid(twoPhaseWorker, "5")] = true
+	twoPhaseState.lock.Unlock()
+	defer func() {
+		twoPhaseState.lock.Lock()
+		delete(twoPhaseState.inFlight, gid(twoPhaseWorker, "5"))
+		twoPhaseState.lock.Unlock()
+	}()
+	recoverInDoubt([]participant{a, b})
+	for _, p := range []*testParticipant{a, b} {
+		left := make([]string, 0)
+		for g := range p.prepared {
+			left = append(left, g)
+		}
+		sort.Strings(left)
+		expected := []string{gid("alive", "1"), twoPhasePrefix + "legacy7", gid(twoPhaseWorker, "5")}
+		sort.Strings(expected)
+		if !reflect.DeepEqual(left, expected) {
+			t.Errorf("%s: left %v, expected %v", p, left, expected)
+		}
+		if !reflect.DeepEqual(p.committed, []string{gid("dead", "3")}) {
+			t.Errorf("%s: committed %v", p, p.committed)
+		}
+		if len(p.rolledBack) != 4 {
+			t.Errorf("%s: rolled back %v", p, p.rolledBack)
+		}
+	}
+	// heartbeat can't be checked - the worker may be alive
+	c := newTestParticipant("c")
+	c.failBeat = true
+	c.prepared[gid("dead", "9")] = old
+	recoverInDoubt([]participant{c})
+	if len(c.prepared) != 1 {
+		t.Error("transaction is recovered while its worker may be alive")
+	}
+}
+
+func TestApplyCompensating(t *testing.T) {
+	order := make([]string, 0)
+	ps := make([]*testParticipant, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		ps[i] = newTestParticipant(name)
+	}
+	ps[2].failPrepare = true
+	cs := []compensatable{
+		&orderedCompensation{ps[0], &order},
+		&orderedCompensation{ps[1], &order},
+		&orderedCompensation{ps[2], &order},
+	}
+	if n, e := applyCompensating(cs, testTwoPhaseRequest()); e == nil || n != 0 {
+		t.Fatalf("failure is not reported: %d, %v", n, e)
+	}
+	if !reflect.DeepEqual(order, []string{"b", "a"}) || ps[2].compensated != 0 {
+		t.Errorf("unexpected compensation: %v", order)
+	}
+	ps[2].failPrepare = false
+	order = order[:0]
+	if n, e := applyCompensating(cs, testTwoPhaseRequest()); e != nil || n != 3 || len(order) != 0 {
+		t.Errorf("applyCompensating: %d, %v, compensated %v", n, e, order)
+	}
+}
+
+type orderedCompensation struct {
+	*testParticipant
+	order *[]string
+}
+
+func (o *orderedCompensation) compensate(before, after *domainSnapshot) error {
+	*o.order = append(*o.order, o.name)
+	return o.testParticipant.compensate(before, after)
+}
+
+func TestCompensationOf(t *testing.T) {
+	ttl := 600
+	kept := RecordsApiTable{Id: 1, Name: "a.example.com", Type: "A", Content: "10.0.0.1", Ttl: &ttl}
+	changed := RecordsApiTable{Id: 2, Name: "b.example.com", Type: "A", Content: "10.0.0.2", Ttl: &ttl}
+	removed := RecordsApiTable{Id: 3, Name: "c.example.com", Type: "A", Content: "10.0.0.3", Ttl: &ttl}
+	added := RecordsApiTable{Id: 4, Name: "d.example.com", Type: "A", Content: "10.0.0.4", Ttl: &ttl}
+	changedAfter := changed
+	changedAfter.Content = "10.0.0.22"
+	before := &domainSnapshot{
+		domain:  &domainTable{Id: 1, Name: "example.com"},
+		records: map[uint]RecordsApiTable{1: kept, 2: changed, 3: removed},
+	}
+	after := &domainSnapshot{
+		domain:  &domainTable{Id: 1, Name: "example.com"},
+		records: map[uint]RecordsApiTable{1: kept, 2: changedAfter, 4: added},
+	}
+	c := compensationOf(before, after)
+	if !reflect.DeepEqual(c.remove, []uint{4}) || !reflect.DeepEqual(c.restore, []RecordsApiTable{changed}) ||
+		!reflect.DeepEqual(c.recreate, []RecordsApiTable{removed}) || c.removeDomain != 0 {
+		t.Errorf("unexpected compensation: %+v", c)
+	}
+	// a domain created by the change is removed with its records
+	c = compensationOf(&domainSnapshot{records: map[uint]RecordsApiTable{}}, after)
+	if c.removeDomain != 1 || len(c.remove) != 3 || len(c.restore)+len(c.recreate) != 0 {
+		t.Errorf("unexpected compensation of a new domain: %+v", c)
+	}
+}
@@ -14,25 +14,52 @@
 package wunderdns
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func (authDatabase *AuthDatabase) syncVaultData() error {
-	if !globalConfig.Vault.Enabled {
-		return errors.New("vault integration is disabled")
+const (
+	vaultAuthToken      = "token"
+	vaultAuthAppRole    = "approle"
+	vaultAuthKubernetes = "kubernetes"
+	vaultDefaultJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// vaultSession is the token got by approle or kubernetes login, renewed while its lease allows
+var vaultSession = struct {
+	lock      sync.Mutex
+	token     string
+	expires   time.Time // zero - not leased
+	renewable bool
+}{}
+
+func vaultClient(v *VaultData) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: v.Insecure}
+	if v.CAFile != "" {
+		data, e := ioutil.ReadFile(v.CAFile)
+		if e != nil {
+			return nil, errors.New("[vault] ca_file: " + e.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("[vault] ca_file: no certificates in " + v.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
-	authDataLock.Lock()
-	defer authDataLock.Unlock()
-	cli := &http.Client{
+	return &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig:       tlsConfig,
 			TLSHandshakeTimeout:   10 * time.Second,
 			DisableKeepAlives:     true,
 			DisableCompression:    true,
@@ -41,44 +68,189 @@ func (authDatabase *AuthDatabase) syncVaultData() error {
 			ExpectContinueTimeout: 10 * time.Second,
 		},
 		Timeout: 10 * time.Second,
+	}, nil
+}
+
+// address gives vault address, URL is `<address>/v1/<path>`
+func (v *VaultData) address() (string, error) {
+	if i := strings.Index(v.URL+"/", "/v1/"); i > 0 {
+		return v.URL[:i], nil
 	}
-	var req *http.Request
-	var resp *http.Response
-	var e error
-	tokens := make([]string, 0)
-	// stage 0: RENEW TOKEN ( self )
-	renewUrlParts := strings.Split(globalConfig.Vault.URL, "/")
-	var renewUrl string
-	for i, k := range renewUrlParts {
-		if k == "v1" {
-			renewUrl = strings.Join(renewUrlParts[0:i], "/") // [x:y) - remember it :)
-			renewUrl += "/v1/auth/token/renew-self"
-			break
+	return "", errors.New("[vault] url has no /v1/ in it")
+}
+
+// kvURLs gives urls tokens are listed & read at, kv v2 keeps them under metadata/ & data/ of the mount
+func (v *VaultData) kvURLs() (list, get string, e error) {
+	base := strings.TrimSuffix(v.URL, "/") + "/"
+	if v.KVVersion != 2 {
+		return base, base, nil
+	}
+	address, e := v.address()
+	if e != nil {
+		return "", "", e
+	}
+	path := strings.TrimPrefix(base, address+"/v1/")
+	mount := strings.Trim(v.Mount, "/")
+	if mount == "" {
+		mount = strings.SplitN(path, "/", 2)[0]
+	}
+	if !strings.HasPrefix(path, mount+"/") {
+		return "", "", errors.New("[vault] url is not under mount " + mount)
+	}
+	path = strings.TrimPrefix(path, mount+"/")
+	prefix := address + "/v1/" + mount
+	return prefix + "/metadata/" + path, prefix + "/data/" + path, nil
+}
+
+// vaultRequest makes the request and decodes the reply, errors of vault are returned as errors
+func vaultRequest(cli *http.Client, method, url, token string, body interface{}) (map[string]interface{}, error) {
+	var reader io.Reader
+	if body != nil {
+		data, e := json.Marshal(body)
+		if e != nil {
+			return nil, e
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, e := http.NewRequest(method, url, reader)
+	if e != nil {
+		return nil, e
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, e := cli.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	reply := make(map[string]interface{})
+	e = json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.StatusCode/100 != 2 {
+		status := resp.Status
+		if errs, ok := reply["errors"].([]interface{}); ok && len(errs) > 0 {
+			status += ": " + fmt.Sprint(errs...)
 		}
+		return nil, errors.New(method + " " + url + ": " + status)
+	}
+	if e != nil {
+		return nil, e
 	}
-	if renewUrl != "" {
-		req, e = http.NewRequest("POST", renewUrl, nil)
+	return reply, nil
+}
+
+// applyVaultAuth keeps the token of login & renewal replies, must be called with vaultSession.lock held
+func applyVaultAuth(reply map[string]interface{}) error {
+	auth, ok := reply["auth"].(map[string]interface{})
+	if !ok {
+		return errors.New("[vault] auth is not found in reply")
+	}
+	token, ok := auth["client_token"].(string)
+	if !ok || token == "" {
+		return errors.New("[vault] client_token is not found in reply")
+	}
+	vaultSession.token = token
+	vaultSession.expires = time.Time{}
+	if lease, ok := auth["lease_duration"].(float64); ok && lease > 0 {
+		vaultSession.expires = time.Now().Add(time.Duration(lease) * time.Second)
+	}
+	vaultSession.renewable, _ = auth["renewable"].(bool)
+	return nil
+}
+
+func vaultLogin(cli *http.Client, v *VaultData, address string) error {
+	path := v.AuthPath
+	if path == "" {
+		path = v.Auth
+	}
+	var body map[string]string
+	switch v.Auth {
+	case vaultAuthAppRole:
+		body = map[string]string{"role_id": v.RoleId, "secret_id": v.SecretId}
+	case vaultAuthKubernetes:
+		file := v.JWTFile
+		if file == "" {
+			file = vaultDefaultJWTFile
+		}
+		jwt, e := ioutil.ReadFile(file) // it's rotated, read every time
+		if e != nil {
+			return errors.New("[vault] jwt_file: " + e.Error())
+		}
+		body = map[string]string{"role": v.Role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+	reply, e := vaultRequest(cli, "POST", address+"/v1/auth/"+strings.Trim(path, "/")+"/login", "", body)
+	if e != nil {
+		return errors.New("[vault] login error: " + e.Error())
+	}
+	if e := applyVaultAuth(reply); e != nil {
+		return e
+	}
+	logging.Info("[vault] logged in with ", v.Auth, ", lease expires at ", vaultSession.expires)
+	return nil
+}
+
+// vaultToken gives the token requests are made with: the static one is renewed on every sync, a login one
+// is renewed when it wouldn't last until the next sync and got by login again if it can't be renewed
+func vaultToken(cli *http.Client, v *VaultData) (string, error) {
+	address, e := v.address()
+	if v.Auth == "" || v.Auth == vaultAuthToken {
 		if e == nil {
-			req.Header.Set("X-Vault-Token", globalConfig.Vault.Token)
-			_, _ = cli.Do(req)
+			if _, e := vaultRequest(cli, "POST", address+"/v1/auth/token/renew-self", v.Token, nil); e != nil {
+				logging.Debug("[vault] token renewal error: ", e.Error())
+			}
 		}
+		return v.Token, nil
 	}
-	// Stage one: make LIST request to URL
-	// create LIST request on URL
-	listUrl := globalConfig.Vault.URL
-	if listUrl[len(listUrl)-1] != '/' {
-		listUrl += "/"
+	if e != nil {
+		return "", e
+	}
+	vaultSession.lock.Lock()
+	defer vaultSession.lock.Unlock()
+	lasts := func() bool {
+		return vaultSession.expires.IsZero() || time.Until(vaultSession.expires) > 2*v.TTL
+	}
+	if vaultSession.token != "" && lasts() {
+		return vaultSession.token, nil
+	}
+	if vaultSession.token != "" && vaultSession.renewable && time.Now().Before(vaultSession.expires) {
+		reply, e := vaultRequest(cli, "POST", address+"/v1/auth/token/renew-self", vaultSession.token, nil)
+		if e == nil {
+			e = applyVaultAuth(reply)
+		}
+		if e != nil {
+			logging.Warning("[vault] token renewal error: ", e.Error())
+		} else if lasts() { // leases are capped by max ttl, login again then
+			return vaultSession.token, nil
+		}
+	}
+	vaultSession.token = ""
+	if e := vaultLogin(cli, v, address); e != nil {
+		return "", e
 	}
-	req, e = http.NewRequest("LIST", listUrl, nil)
+	return vaultSession.token, nil
+}
+
+func (authDatabase *AuthDatabase) syncVaultData() error {
+	vault := globalConfig.Vault
+	if !vault.Enabled {
+		return errors.New("vault integration is disabled")
+	}
+	cli, e := vaultClient(vault)
+	if e != nil {
+		return e
+	}
+	accessToken, e := vaultToken(cli, vault)
 	if e != nil {
 		return e
 	}
-	req.Header.Set("X-Vault-Token", globalConfig.Vault.Token)
-	if resp, e = cli.Do(req); e != nil {
+	listUrl, getUrl, e := vault.kvURLs()
+	if e != nil {
 		return e
 	}
-	listData := make(map[string]interface{})
-	if e = json.NewDecoder(resp.Body).Decode(&listData); e != nil {
+	tokens := make([]string, 0)
+	// Stage one: make LIST request to URL
+	listData, e := vaultRequest(cli, "LIST", listUrl, accessToken, nil)
+	if e != nil {
 		return e
 	}
 	if data, ok := listData["data"]; ok {
@@ -107,21 +279,15 @@ func (authDatabase *AuthDatabase) syncVaultData() error {
 	// Stage two: for every TOKEN create a GET request to URL+TOKEN
 	tempTokens := make(map[string]AuthData)
 	for _, token := range tokens {
-		newUrl := listUrl + token
-		req, e = http.NewRequest("GET", newUrl, nil)
+		authData, e := vaultRequest(cli, "GET", getUrl+token, accessToken, nil)
 		if e != nil {
-			logging.Warning("[vault.syncVaultData] ignoring ", token, ": ", e.Error())
-			continue
-		}
-		req.Header.Set("X-Vault-Token", globalConfig.Vault.Token)
-		if resp, e = cli.Do(req); e != nil {
 			logging.Warning("[vault.syncVaultData] request error for token ", token, ": ", e.Error())
 			continue
 		}
-		authData := make(map[string]interface{})
-		if e = json.NewDecoder(resp.Body).Decode(&authData); e != nil {
-			logging.Warning("[vault.syncVaultData] json error error for token ", token, ": ", e.Error())
-			continue
+		if vault.KVVersion == 2 { // data & metadata of the latest version
+			if data, ok := authData["data"].(map[string]interface{}); ok {
+				authData = data
+			}
 		}
 		if data, ok := authData["data"]; ok {
 			if mdata, ok := data.(map[string]interface{}); ok {
@@ -130,6 +296,7 @@ func (authDatabase *AuthDatabase) syncVaultData() error {
 					Permissions: make([]Permission, 0),
 					isVault:     true,
 				}
+				valid := true
 				for k, v := range mdata {
 					if _, ok := v.(string); !ok {
 						continue
@@ -138,29 +305,62 @@ func (authDatabase *AuthDatabase) syncVaultData() error {
 						newAuth.Secret = v.(string)
 						continue
 					}
-					d := strings.Split(k, ",")
-					c := strings.Split(v.(string), ",")
-					p := Permission{
-						Domain:    Domain{},
-						Permitted: make([]Command, 0),
+					if strings.HasPrefix(k, "secret.") {
+						if secret, e := ParseSecret(v.(string)); e != nil {
+							logging.Warning("[vault.syncVaultData] ", token, ": ", k, ": ", e.Error())
+						} else {
+							newAuth.addSecret(secret)
+						}
+						continue
+					}
+					if k == "children" {
+						newAuth.Children, _ = strconv.Atoi(v.(string))
+						continue
+					}
+					if k == "delegate" {
+						newAuth.Delegate = v.(string) == "true"
+						continue
+					}
+					if k == "admin" {
+						newAuth.Admin = v.(string) == "true"
+						continue
+					}
+					if k == "allow_from" {
+						if newAuth.AllowFrom, e = ParseNetworks(v.(string)); e != nil || len(newAuth.AllowFrom) == 0 {
+							logging.Warning("[vault.syncVaultData] ignoring ", token, ": allow_from has no valid networks")
+							valid = false
+						}
+						continue
 					}
-					if len(d) == 1 {
-						p.Domain.View = DomainViewAny
-						p.Domain.Name = d[0]
-					} else if len(d) == 2 {
-						p.Domain.View = DomainView(d[0])
-						p.Domain.Name = d[1]
-						if x, ok := domainViews[p.Domain.View]; !(ok && x) {
-							continue // bad type
+					if k == "not_before" || k == "expires" {
+						if e := setValidity(k, v.(string), &newAuth.NotBefore, &newAuth.Expires); e != nil {
+							logging.Warning("[vault.syncVaultData] ignoring ", token, ": ", e.Error())
+							valid = false
 						}
+						continue
+					}
+					if k == "certificate" {
+						newAuth.Certificates = parseCertificateNames(v.(string))
+						continue
 					}
-					for _, v := range c {
-						if x, ok := commands[Command(v)]; ok && x {
-							p.Permitted = append(p.Permitted, Command(v))
+					if k == "public_key" {
+						if newAuth.PublicKey, e = parsePublicKey(v.(string)); e != nil {
+							logging.Warning("[vault.syncVaultData] ignoring ", token, ": ", e.Error())
+							valid = false
 						}
+						continue
+					}
+					p, e := ParsePermission(k, v.(string))
+					if e != nil {
+						logging.Warning("[vault.syncVaultData] ", token, ": ", e.Error())
+						continue
 					}
 					newAuth.Permissions = append(newAuth.Permissions, p)
 				}
+				if !valid {
+					continue
+				}
+				applyStoredSecrets(&newAuth)
 				tempTokens[token] = newAuth
 				logging.Debug("[vault.syncVaultData] got new auth (", token, ") with ", len(newAuth.Permissions), " permissions ")
 			} else {
@@ -173,6 +373,8 @@ func (authDatabase *AuthDatabase) syncVaultData() error {
 		}
 	}
 	// replace tempTokens
+	authDataLock.Lock()
+	defer authDataLock.Unlock()
 	for k, v := range *authDatabase {
 		if v.isVault {
 			if v, ok := tempTokens[k]; ok {
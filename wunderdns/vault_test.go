@@ -0,0 +1,183 @@
+// Copyright 2018-2020 Wargaming.Net
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package wunderdns
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeVault serves a kv v2 mount `secret` with approle & kubernetes logins
+type fakeVault struct {
+	logins, renewals int
+	lease            int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(code int, data interface{}) {
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(data)
+	}
+	login := func(body map[string]string, expected map[string]string) {
+		for k, v := range expected {
+			if body[k] != v {
+				reply(400, map[string]interface{}{"errors": []string{"invalid " + k}})
+				return
+			}
+		}
+		f.logins++
+		reply(200, map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": "login-token", "lease_duration": f.lease, "renewable": true,
+		}})
+	}
+	body := make(map[string]string)
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/auth/approle/login":
+		login(body, map[string]string{"role_id": "role", "secret_id": "secret"})
+	case r.Method == "POST" && r.URL.Path == "/v1/auth/k8s/login":
+		login(body, map[string]string{"role": "wunderdns", "jwt": "service-account-jwt"})
+	case r.Method == "POST" && r.URL.Path == "/v1/auth/token/renew-self":
+		f.renewals++
+		reply(200, map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": r.Header.Get("X-Vault-Token"), "lease_duration": f.lease, "renewable": true,
+		}})
+	case r.Header.Get("X-Vault-Token") != "login-token":
+		reply(403, map[string]interface{}{"errors": []string{"permission denied"}})
+	case r.Method == "LIST" && r.URL.Path == "/v1/secret/metadata/wunderdns/":
+		reply(200, map[string]interface{}{"data": map[string]interface{}{"keys": []string{"tenant", "broken"}}})
+	case r.Method == "GET" && r.URL.Path == "/v1/secret/data/wunderdns/tenant":
+		reply(200, map[string]interface{}{"data": map[string]interface{}{
+			"data":     map[string]interface{}{"secret": "tenant", "public,*.tenant.net": "*"},
+			"metadata": map[string]interface{}{"version": 3},
+		}})
+	case r.Method == "GET" && r.URL.Path == "/v1/secret/data/wunderdns/broken":
+		reply(200, map[string]interface{}{"data": map[string]interface{}{
+			"data": map[string]interface{}{"public_key": "not a key", "public,*.broken.net": "*"},
+		}})
+	default:
+		reply(404, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func TestVaultURLs(t *testing.T) {
+	for _, c := range []struct {
+		vault      VaultData
+		list, get  string
+		shouldFail bool
+	}{
+		{VaultData{URL: "https://vault:8200/v1/secret/wunderdns"},
+			"https://vault:8200/v1/secret/wunderdns/", "https://vault:8200/v1/secret/wunderdns/", false},
+		{VaultData{URL: "https://vault:8200/v1/secret/wunderdns/", KVVersion: 2},
+			"https://vault:8200/v1/secret/metadata/wunderdns/", "https://vault:8200/v1/secret/data/wunderdns/", false},
+		{VaultData{URL: "https://vault:8200/v1/kv/prod/wunderdns", KVVersion: 2, Mount: "kv/prod"},
+			"https://vault:8200/v1/kv/prod/metadata/wunderdns/", "https://vault:8200/v1/kv/prod/data/wunderdns/", false},
+		{VaultData{URL: "https://vault:8200/v1/secret/wunderdns", KVVersion: 2, Mount: "kv"}, "", "", true},
+		{VaultData{URL: "https://vault:8200/secret/wunderdns", KVVersion: 2}, "", "", true},
+	} {
+		list, get, e := c.vault.kvURLs()
+		if (e != nil) != c.shouldFail || list != c.list || get != c.get {
+			t.Errorf("%s: got %s, %s, %v", c.vault.URL, list, get, e)
+		}
+	}
+}
+
+func TestSyncVaultData(t *testing.T) {
+	fake := &fakeVault{lease: 3600}
+	server := httptest.NewUnstartedServer(fake)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // failed handshakes are expected
+	server.StartTLS()
+	defer server.Close()
+	dir, e := ioutil.TempDir("", "wunderdns")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	caFile, jwtFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "jwt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if e := ioutil.WriteFile(caFile, ca, 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(jwtFile, []byte("service-account-jwt\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	savedVault := globalConfig.Vault
+	defer func() { globalConfig.Vault, globalConfig.Auth = savedVault, authdb }()
+	syncWith := func(v VaultData) (AuthDatabase, error) {
+		vaultSession.token = ""
+		v.Enabled, v.URL, v.TTL, v.KVVersion = true, server.URL+"/v1/secret/wunderdns", time.Minute, 2
+		globalConfig.Vault = &v
+		db := AuthDatabase{"configured": {Token: "configured", Secret: "configured"}}
+		globalConfig.Auth = &db
+		return db, db.syncVaultData()
+	}
+
+	// the certificate is verified by default
+	if _, e := syncWith(VaultData{Auth: vaultAuthAppRole, RoleId: "role", SecretId: "secret"}); e == nil {
+		t.Error("untrusted certificate is accepted")
+	}
+	if _, e := syncWith(VaultData{Auth: vaultAuthAppRole, RoleId: "role", SecretId: "secret", Insecure: true}); e != nil {
+		t.Errorf("insecure: %v", e)
+	}
+
+	db, e := syncWith(VaultData{Auth: vaultAuthAppRole, RoleId: "role", SecretId: "secret", CAFile: caFile})
+	if e != nil {
+		t.Fatal(e)
+	}
+	tenant, ok := db["tenant"]
+	if !ok || !tenant.isVault || tenant.Secret != "tenant" || len(tenant.Permissions) != 1 {
+		t.Fatalf("kv v2 token is read wrong: %+v", db)
+	}
+	if _, ok := db["configured"]; !ok {
+		t.Error("configured token is dropped")
+	}
+	// a token with a bad public key would have neither a key nor a secret
+	if _, ok := db["broken"]; ok {
+		t.Error("token with a bad public key is kept")
+	}
+
+	// the login token is used while it lasts, renewed when it wouldn't last until the next sync
+	logins := fake.logins
+	if e := db.syncVaultData(); e != nil || fake.logins != logins || fake.renewals != 0 {
+		t.Errorf("token is not reused: %v, %d logins, %d renewals", e, fake.logins, fake.renewals)
+	}
+	vaultSession.expires = time.Now().Add(time.Minute)
+	if e := db.syncVaultData(); e != nil || fake.logins != logins || fake.renewals != 1 {
+		t.Errorf("token is not renewed: %v, %d logins, %d renewals", e, fake.logins, fake.renewals)
+	}
+	// a lease capped by max ttl can't be renewed for long, it's a new login then
+	fake.lease = 60
+	vaultSession.expires = time.Now().Add(time.Minute)
+	if e := db.syncVaultData(); e != nil || fake.logins != logins+1 {
+		t.Errorf("no login after renewal failed to extend the lease: %v, %d logins", e, fake.logins)
+	}
+	fake.lease = 3600
+
+	if _, e := syncWith(VaultData{Auth: vaultAuthAppRole, RoleId: "role", SecretId: "wrong", CAFile: caFile}); e == nil {
+		t.Error("login with a wrong secret_id succeeded")
+	}
+	db, e = syncWith(VaultData{Auth: vaultAuthKubernetes, AuthPath: "k8s", Role: "wunderdns", JWTFile: jwtFile, CAFile: caFile})
+	if _, ok := db["tenant"]; e != nil || !ok {
+		t.Errorf("kubernetes login: %v", e)
+	}
+}